@@ -1,12 +1,25 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/dino16m/clippa-server/internal/blob"
 	"github.com/dino16m/clippa-server/internal/data"
 	"github.com/dino16m/clippa-server/internal/manager"
+	"github.com/dino16m/clippa-server/internal/service"
 	"github.com/glebarez/sqlite"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"gorm.io/gorm"
@@ -15,12 +28,49 @@ import (
 func configure() {
 	viper.AutomaticEnv()
 	viper.SetDefault("Logger.Level", "info")
+	viper.SetDefault("LOG_FORMAT", "text")
 	viper.SetDefault("PORT", 8080)
 	viper.SetDefault("DATABASE_URL", "clippa.db")
+	viper.SetDefault("ACK_TIMEOUT", "30s")
+	viper.SetDefault("STRICT_SENDER", false)
+	viper.SetDefault("RATE_MEMBER_MESSAGES", 20)
+	viper.SetDefault("RATE_MEMBER_BYTES", 2<<20)
+	viper.SetDefault("RATE_PARTY_MESSAGES", 100)
+	viper.SetDefault("RATE_PARTY_BYTES", 8<<20)
+	viper.SetDefault("RATE_TYPE_LIMITS", "")
+	viper.SetDefault("RATE_MAX_VIOLATIONS", 20)
+	viper.SetDefault("TRUST_PROXY", false)
+	viper.SetDefault("COMPRESSION_MODE", "disabled")
+	viper.SetDefault("COMPRESSION_THRESHOLD", 0)
+	viper.SetDefault("AUTH_IP_MAX_FAILURES", 5)
+	viper.SetDefault("AUTH_PARTY_MAX_FAILURES", 20)
+	viper.SetDefault("AUTH_MAX_LOCKOUT", "15m")
+	viper.SetDefault("CLIPBOARD_TEXT_LIMIT", 1<<20)
+	viper.SetDefault("CLIPBOARD_IMAGE_LIMIT", 10<<20)
+	viper.SetDefault("CLIPBOARD_DEFAULT_LIMIT", 5<<20)
+	viper.SetDefault("TRANSFER_MAX_SIZE", 64<<20)
+	viper.SetDefault("TRANSFER_CHUNK_SIZE", 1<<20)
+	viper.SetDefault("TRANSFER_RETENTION", "10m")
+	viper.SetDefault("TRANSFER_MAX_PER_MEMBER", 4)
+	viper.SetDefault("TRANSFER_MAX_PER_PARTY", 16)
+	viper.SetDefault("BLOB_DIR", "blobs")
+	viper.SetDefault("BLOB_MAX_SIZE", 100<<20)
+	viper.SetDefault("BLOB_QUOTA", 500<<20)
+	viper.SetDefault("BLOB_TTL", "24h")
+	viper.SetDefault("BLOB_GC_INTERVAL", "10m")
+	viper.SetDefault("TLS_CERT_FILE", "")
+	viper.SetDefault("TLS_KEY_FILE", "")
+	viper.SetDefault("TLS_MIN_VERSION", "1.2")
+	viper.SetDefault("TLS_CIPHERS", "modern")
+	viper.SetDefault("TLS_RELOAD_INTERVAL", "1m")
+	viper.SetDefault("HTTP_REDIRECT_PORT", 0)
+	viper.SetDefault("SHUTDOWN_TIMEOUT", "30s")
+	viper.SetDefault("SHUTDOWN_RECONNECT_DELAY", "5s")
 }
 
 func main() {
 	configure()
+	logger := newLogger()
 	db_url := viper.GetString("DATABASE_URL")
 	if db_url == "" {
 		logrus.Panic("DATABASE_URL is not set")
@@ -29,19 +79,61 @@ func main() {
 	if err != nil {
 		logrus.Panic("failed to connect database")
 	}
-	db.AutoMigrate(&data.Party{})
+	if err := data.Migrate(db); err != nil {
+		logrus.WithError(err).Panic("failed to migrate database")
+	}
 
 	// create the store backed by gorm.DB
 	store := data.NewPartyStore(db)
 
-	// create a logger and set level from config
-	logger := logrus.New()
-	if lvl, err := logrus.ParseLevel(viper.GetString("Logger.Level")); err == nil {
-		logger.SetLevel(lvl)
+	blobStorage, err := blob.NewFSStorage(viper.GetString("BLOB_DIR"))
+	if err != nil {
+		logrus.WithError(err).Panic("failed to create blob storage")
+	}
+
+	compressionMode, err := manager.ParseCompressionMode(viper.GetString("COMPRESSION_MODE"))
+	if err != nil {
+		logrus.WithError(err).Panic("invalid COMPRESSION_MODE")
 	}
 
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+
 	// instantiate manager controller
-	mc := manager.NewManagerCtrl(store, logger)
+	mc := manager.NewManagerCtrl(store, logger,
+		manager.WithMetrics(registry),
+		manager.WithBlobs(data.NewBlobStore(db), blobStorage, manager.BlobConfig{
+			MaxSize: viper.GetInt64("BLOB_MAX_SIZE"),
+			Quota:   viper.GetInt64("BLOB_QUOTA"),
+			TTL:     viper.GetDuration("BLOB_TTL"),
+		}),
+		manager.WithAPIKeys(data.NewAPIKeyStore(db)),
+		manager.WithInvites(data.NewInviteStore(db)),
+		manager.WithDevices(data.NewDeviceStore(db)),
+		manager.WithBruteForceProtection(guardConfig("AUTH_IP_MAX_FAILURES"), guardConfig("AUTH_PARTY_MAX_FAILURES")),
+		manager.WithTrustedProxy(viper.GetBool("TRUST_PROXY")),
+		manager.WithCompression(manager.CompressionConfig{
+			Mode:      compressionMode,
+			Threshold: viper.GetInt("COMPRESSION_THRESHOLD"),
+		}),
+		manager.WithPartyOptions(
+			service.WithAckTimeout(viper.GetDuration("ACK_TIMEOUT")),
+			service.WithClipboardLimit("text/*", viper.GetInt("CLIPBOARD_TEXT_LIMIT")),
+			service.WithClipboardLimit("image/*", viper.GetInt("CLIPBOARD_IMAGE_LIMIT")),
+			service.WithClipboardLimit("*", viper.GetInt("CLIPBOARD_DEFAULT_LIMIT")),
+			service.WithTransferLimits(viper.GetInt("TRANSFER_MAX_SIZE"), viper.GetInt("TRANSFER_CHUNK_SIZE")),
+			service.WithTransferRetention(viper.GetDuration("TRANSFER_RETENTION")),
+			service.WithTransferConcurrency(viper.GetInt("TRANSFER_MAX_PER_MEMBER"), viper.GetInt("TRANSFER_MAX_PER_PARTY")),
+			service.WithStrictSender(viper.GetBool("STRICT_SENDER")),
+			service.WithRateLimits(rateLimits()),
+		),
+	)
+
+	// SIGTERM and interrupts shut the server down gracefully
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	go mc.RunBlobCollector(ctx, viper.GetDuration("BLOB_GC_INTERVAL"))
 
 	// create global API mux and register manager routes
 	globalMux := http.NewServeMux()
@@ -50,20 +142,150 @@ func main() {
 	// mount under /api/
 	topMux := http.NewServeMux()
 	topMux.Handle("/api/", http.StripPrefix("/api", globalMux))
+	topMux.Handle("GET /metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	topMux.HandleFunc("GET /healthz", mc.Healthz)
+	topMux.HandleFunc("GET /readyz", mc.Readyz)
 
-	httpHandle := RequestLogger(logger, topMux)
+	httpHandle := manager.RequestLogger(logger, topMux)
 	portInt := viper.GetInt("PORT")
 	listenAddr := fmt.Sprintf(":%d", portInt)
-	logrus.Infof("starting server on %s", listenAddr)
-	if err := http.ListenAndServe(listenAddr, httpHandle); err != nil {
+	server := &http.Server{
+		Addr:    listenAddr,
+		Handler: httpHandle,
+	}
+	servers := []*http.Server{server}
+	serveErr := make(chan error, 2)
+	certFile, keyFile := viper.GetString("TLS_CERT_FILE"), viper.GetString("TLS_KEY_FILE")
+	if certFile != "" && keyFile != "" {
+		server.TLSConfig = tlsConfig(ctx, logger, certFile, keyFile)
+		if redirectPort := viper.GetInt("HTTP_REDIRECT_PORT"); redirectPort != 0 {
+			redirect := &http.Server{
+				Addr:    fmt.Sprintf(":%d", redirectPort),
+				Handler: redirectToHTTPS(portInt),
+			}
+			servers = append(servers, redirect)
+			logrus.Infof("redirecting HTTP on %s to HTTPS", redirect.Addr)
+			go func() { serveErr <- redirect.ListenAndServe() }()
+		}
+		logrus.Infof("starting server with TLS on %s", listenAddr)
+		go func() { serveErr <- server.ListenAndServeTLS("", "") }()
+	} else {
+		logrus.Infof("starting server on %s", listenAddr)
+		go func() { serveErr <- server.ListenAndServe() }()
+	}
+
+	select {
+	case err := <-serveErr:
 		logrus.WithError(err).Fatal("server exited")
+	case <-ctx.Done():
 	}
+	// a second signal kills the process
+	stop()
+	shutdown(mc, servers)
 }
 
-func RequestLogger(logger *logrus.Logger, mux http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		logger.Infof("Got request %s %s", r.Method, r.URL)
-		mux.ServeHTTP(w, r)
-		logger.Infof("Finished request %s %s", r.Method, r.URL)
-	})
+// shutdown tells members to reconnect later and closes their connections,
+// then shuts the servers down, giving up after SHUTDOWN_TIMEOUT.
+func shutdown(mc *manager.ManagerCtrl, servers []*http.Server) {
+	timeout := viper.GetDuration("SHUTDOWN_TIMEOUT")
+	logrus.Infof("shutting down within %s", timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := mc.Shutdown(ctx, viper.GetDuration("SHUTDOWN_RECONNECT_DELAY")); err != nil {
+		logrus.WithError(err).Warn("members did not disconnect in time")
+	}
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			logrus.WithError(err).Warn("closing the server before its requests finished")
+			server.Close()
+		}
+	}
+	logrus.Info("server stopped")
+}
+
+// tlsConfig builds the server's TLS config from config, serving the
+// certificate in certFile and keyFile and reloading it as it changes until
+// ctx is done.
+func tlsConfig(ctx context.Context, logger *logrus.Logger, certFile, keyFile string) *tls.Config {
+	minVersion, err := parseTLSVersion(viper.GetString("TLS_MIN_VERSION"))
+	if err != nil {
+		logrus.WithError(err).Panic("invalid TLS_MIN_VERSION")
+	}
+	ciphers, err := parseCipherSuites(viper.GetString("TLS_CIPHERS"))
+	if err != nil {
+		logrus.WithError(err).Panic("invalid TLS_CIPHERS")
+	}
+	certs, err := newCertReloader(certFile, keyFile, logger)
+	if err != nil {
+		logrus.WithError(err).Panic("failed to load TLS certificate")
+	}
+	go certs.Watch(ctx, viper.GetDuration("TLS_RELOAD_INTERVAL"))
+
+	return &tls.Config{
+		MinVersion:     minVersion,
+		CipherSuites:   ciphers,
+		GetCertificate: certs.GetCertificate,
+		// client certificates are checked against the CA of the party they
+		// name when members join, so any may be presented here
+		ClientAuth: tls.RequestClientCert,
+	}
+}
+
+// guardConfig builds the throttling of failed secret checks, tolerating the
+// number of failures in maxFailuresKey.
+func guardConfig(maxFailuresKey string) manager.GuardConfig {
+	return manager.GuardConfig{
+		MaxFailures: viper.GetInt(maxFailuresKey),
+		BaseLockout: time.Second,
+		MaxLockout:  viper.GetDuration("AUTH_MAX_LOCKOUT"),
+		ResetAfter:  15 * time.Minute,
+	}
+}
+
+// rateLimits builds the rate limits from config. Every bucket allows bursts of
+// twice its rate. RATE_TYPE_LIMITS lists per-member limits for message types
+// as "type=rate" pairs, e.g. "clipboard=5,ping=1".
+func rateLimits() service.RateLimits {
+	bucket := func(key string) service.RateLimit {
+		r := viper.GetFloat64(key)
+		return service.RateLimit{Rate: r, Burst: int(2 * r)}
+	}
+	limits := service.RateLimits{
+		MemberMessages:  bucket("RATE_MEMBER_MESSAGES"),
+		MemberBytes:     bucket("RATE_MEMBER_BYTES"),
+		PartyMessages:   bucket("RATE_PARTY_MESSAGES"),
+		PartyBytes:      bucket("RATE_PARTY_BYTES"),
+		PerType:         map[service.MessageType]service.RateLimit{},
+		MaxViolations:   viper.GetInt("RATE_MAX_VIOLATIONS"),
+		ViolationWindow: time.Minute,
+	}
+	for _, pair := range strings.Split(viper.GetString("RATE_TYPE_LIMITS"), ",") {
+		msgType, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			continue
+		}
+		r, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			logrus.WithField("limit", pair).Warn("ignoring invalid rate limit")
+			continue
+		}
+		limits.PerType[service.MessageType(msgType)] = service.RateLimit{Rate: r, Burst: int(2 * r)}
+	}
+	return limits
+}
+
+// newLogger builds the logger from config. LOG_FORMAT is "text" or "json";
+// the standard logger, used before the server starts, is set up the same.
+func newLogger() *logrus.Logger {
+	logger := logrus.New()
+	for _, l := range []*logrus.Logger{logger, logrus.StandardLogger()} {
+		if lvl, err := logrus.ParseLevel(viper.GetString("Logger.Level")); err == nil {
+			l.SetLevel(lvl)
+		}
+		if viper.GetString("LOG_FORMAT") == "json" {
+			l.SetFormatter(&logrus.JSONFormatter{})
+		}
+	}
+	return logger
 }
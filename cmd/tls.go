@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// modernCipherSuites are the TLS 1.2 suites with forward secrecy and AEAD.
+// TLS 1.3 suites are not configurable and always allowed.
+var modernCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+// parseTLSVersion parses a minimum TLS version such as "1.2".
+func parseTLSVersion(name string) (uint16, error) {
+	switch strings.TrimSpace(name) {
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unsupported TLS version %q, use 1.2 or 1.3", name)
+}
+
+// parseCipherSuites parses a cipher policy: "default" leaves the choice to Go,
+// "modern" allows modernCipherSuites, and anything else is a comma separated
+// list of suite names such as TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256.
+func parseCipherSuites(policy string) ([]uint16, error) {
+	switch strings.TrimSpace(policy) {
+	case "", "default":
+		return nil, nil
+	case "modern":
+		return modernCipherSuites, nil
+	}
+	known := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+	suites := []uint16{}
+	for _, name := range strings.Split(policy, ",") {
+		id, ok := known[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		suites = append(suites, id)
+	}
+	return suites, nil
+}
+
+// certReloader serves a certificate and key from files, reloading them when
+// they change or the process receives SIGHUP.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	logger   *logrus.Logger
+
+	mutex   sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string, logger *logrus.Logger) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile, logger: logger}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// lastModified returns when the certificate or key file last changed.
+func (c *certReloader) lastModified() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// reload loads the certificate and key. On failure the previous certificate
+// is kept.
+func (c *certReloader) reload() error {
+	modTime, err := c.lastModified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.cert = &cert
+	c.modTime = modTime
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.cert, nil
+}
+
+// Watch reloads the certificate on SIGHUP, and when its files change as
+// checked every interval, until ctx is done. A non-positive interval only
+// reloads on SIGHUP.
+func (c *certReloader) Watch(ctx context.Context, interval time.Duration) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			c.reloadLogged("SIGHUP")
+		case <-tick:
+			modTime, err := c.lastModified()
+			c.mutex.RLock()
+			changed := err == nil && !modTime.Equal(c.modTime)
+			c.mutex.RUnlock()
+			if changed {
+				c.reloadLogged("file change")
+			}
+		}
+	}
+}
+
+func (c *certReloader) reloadLogged(trigger string) {
+	if err := c.reload(); err != nil {
+		c.logger.WithError(err).WithField("trigger", trigger).Error("failed to reload TLS certificate, keeping the previous one")
+		return
+	}
+	c.logger.WithField("trigger", trigger).Info("reloaded TLS certificate")
+}
+
+// redirectToHTTPS redirects every request to the same URL over HTTPS on
+// httpsPort.
+func redirectToHTTPS(httpsPort int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if httpsPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(httpsPort))
+		}
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+	})
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestParseTLSVersion(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		want    uint16
+		wantErr bool
+	}{
+		{name: "1.2", want: tls.VersionTLS12},
+		{name: " 1.3 ", want: tls.VersionTLS13},
+		{name: "1.1", wantErr: true},
+		{name: "", wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseTLSVersion(tc.name)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %x", got)
+				}
+				return
+			}
+			if err != nil || got != tc.want {
+				t.Fatalf("expected %x, got %x, %v", tc.want, got, err)
+			}
+		})
+	}
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	for _, tc := range []struct {
+		policy  string
+		want    []uint16
+		wantErr bool
+	}{
+		{policy: "", want: nil},
+		{policy: "default", want: nil},
+		{policy: "modern", want: modernCipherSuites},
+		{
+			policy: "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256",
+			want:   []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256},
+		},
+		{policy: "TLS_RSA_WITH_RC4_128_SHA", wantErr: true},
+		{policy: "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,bogus", wantErr: true},
+	} {
+		t.Run(tc.policy, func(t *testing.T) {
+			got, err := parseCipherSuites(tc.policy)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", got)
+				}
+				return
+			}
+			if err != nil || !slices.Equal(got, tc.want) {
+				t.Fatalf("expected %v, got %v, %v", tc.want, got, err)
+			}
+		})
+	}
+}
+
+// writeCert writes a self-signed certificate for commonName and its key to
+// certFile and keyFile, dated modTime.
+func writeCert(t testing.TB, certFile, keyFile, commonName string, modTime time.Time) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	writeFile(t, certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), modTime)
+	writeFile(t, keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), modTime)
+}
+
+func writeFile(t testing.TB, name string, content []byte, modTime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(name, content, 0o600); err != nil {
+		t.Fatalf("write %s: %v", name, err)
+	}
+	if err := os.Chtimes(name, modTime, modTime); err != nil {
+		t.Fatalf("touch %s: %v", name, err)
+	}
+}
+
+// servedName returns the common name of the certificate c serves.
+func servedName(t testing.TB, c *certReloader) string {
+	t.Helper()
+	cert, err := c.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("get certificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("parse certificate: %v", err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	start := time.Now().Add(-time.Hour)
+	writeCert(t, certFile, keyFile, "first", start)
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	c, err := newCertReloader(certFile, keyFile, logger)
+	if err != nil {
+		t.Fatalf("new cert reloader: %v", err)
+	}
+	if name := servedName(t, c); name != "first" {
+		t.Fatalf("expected the first certificate, got %q", name)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Watch(ctx, 10*time.Millisecond)
+
+	// a changed certificate is picked up without a restart
+	writeCert(t, certFile, keyFile, "second", start.Add(time.Minute))
+	deadline := time.Now().Add(2 * time.Second)
+	for servedName(t, c) != "second" {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the changed certificate to be reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// a broken certificate is refused and the previous one kept
+	writeFile(t, certFile, []byte("not a certificate"), start.Add(2*time.Minute))
+	if err := c.reload(); err == nil {
+		t.Fatalf("expected reloading a broken certificate to fail")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if name := servedName(t, c); name != "second" {
+		t.Fatalf("expected the previous certificate to be kept, got %q", name)
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		host      string
+		httpsPort int
+		want      string
+	}{
+		{name: "host with port", host: "clippa.example:8080", httpsPort: 8443, want: "https://clippa.example:8443/api/parties?id=1"},
+		{name: "default port", host: "clippa.example:8080", httpsPort: 443, want: "https://clippa.example/api/parties?id=1"},
+		{name: "host without port", host: "clippa.example", httpsPort: 8443, want: "https://clippa.example:8443/api/parties?id=1"},
+		{name: "ipv6 host", host: "[::1]:8080", httpsPort: 8443, want: "https://[::1]:8443/api/parties?id=1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://"+tc.host+"/api/parties?id=1", nil)
+			w := httptest.NewRecorder()
+			redirectToHTTPS(tc.httpsPort).ServeHTTP(w, r)
+			if w.Code != http.StatusPermanentRedirect {
+				t.Fatalf("expected 308, got %d", w.Code)
+			}
+			if location := w.Header().Get("Location"); location != tc.want {
+				t.Fatalf("expected a redirect to %s, got %s", tc.want, location)
+			}
+		})
+	}
+}
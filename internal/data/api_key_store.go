@@ -0,0 +1,56 @@
+package data
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type APIKeyStore struct {
+	db *gorm.DB
+}
+
+func NewAPIKeyStore(db *gorm.DB) *APIKeyStore {
+	return &APIKeyStore{
+		db: db,
+	}
+}
+
+func (s *APIKeyStore) Create(key *APIKey) error {
+	return s.db.Create(key).Error
+}
+
+// GetByHash returns the unrevoked key with the given hash.
+func (s *APIKeyStore) GetByHash(hash string) (*APIKey, error) {
+	var key APIKey
+	err := s.db.Where("hash = ? AND revoked_at IS NULL", hash).First(&key).Error
+	return &key, err
+}
+
+// List returns every key of partyId, revoked or not.
+func (s *APIKeyStore) List(partyId string) ([]APIKey, error) {
+	var keys []APIKey
+	err := s.db.Where("party_id = ?", partyId).Order("created_at").Find(&keys).Error
+	return keys, err
+}
+
+// Revoke revokes key id of partyId. It returns gorm.ErrRecordNotFound if the
+// party has no such unrevoked key.
+func (s *APIKeyStore) Revoke(partyId, id string) error {
+	result := s.db.Model(&APIKey{}).
+		Where("id = ? AND party_id = ? AND revoked_at IS NULL", id, partyId).
+		Update("revoked_at", time.Now().UTC())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+func (s *APIKeyStore) Touch(key *APIKey) error {
+	now := time.Now().UTC()
+	key.LastUsedAt = &now
+	return s.db.Model(key).Update("last_used_at", now).Error
+}
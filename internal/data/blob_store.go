@@ -0,0 +1,47 @@
+package data
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type BlobStore struct {
+	db *gorm.DB
+}
+
+func NewBlobStore(db *gorm.DB) *BlobStore {
+	return &BlobStore{
+		db: db,
+	}
+}
+
+func (s *BlobStore) Create(blob *Blob) error {
+	return s.db.Create(blob).Error
+}
+
+// Get returns the unexpired blob id belonging to partyId.
+func (s *BlobStore) Get(partyId, id string) (*Blob, error) {
+	var blob Blob
+	err := s.db.Where("id = ? AND party_id = ? AND expires_at > ?", id, partyId, time.Now().UTC()).First(&blob).Error
+	return &blob, err
+}
+
+// Usage returns the total size of the blobs held for partyId, expired or not,
+// since expired blobs occupy storage until they are collected.
+func (s *BlobStore) Usage(partyId string) (int64, error) {
+	var total int64
+	err := s.db.Model(&Blob{}).Where("party_id = ?", partyId).Select("COALESCE(SUM(size), 0)").Scan(&total).Error
+	return total, err
+}
+
+// Expired returns blobs that expired before now.
+func (s *BlobStore) Expired(now time.Time) ([]Blob, error) {
+	var blobs []Blob
+	err := s.db.Where("expires_at <= ?", now).Find(&blobs).Error
+	return blobs, err
+}
+
+func (s *BlobStore) Delete(blob *Blob) error {
+	return s.db.Delete(blob).Error
+}
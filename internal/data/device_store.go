@@ -0,0 +1,53 @@
+package data
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type DeviceStore struct {
+	db *gorm.DB
+}
+
+func NewDeviceStore(db *gorm.DB) *DeviceStore {
+	return &DeviceStore{
+		db: db,
+	}
+}
+
+func (s *DeviceStore) Create(device *Device) error {
+	return s.db.Create(device).Error
+}
+
+func (s *DeviceStore) Get(partyId, memberId string) (*Device, error) {
+	var device Device
+	err := s.db.Where("party_id = ? AND member_id = ?", partyId, memberId).First(&device).Error
+	return &device, err
+}
+
+// List returns the devices enrolled in partyId.
+func (s *DeviceStore) List(partyId string) ([]Device, error) {
+	var devices []Device
+	err := s.db.Where("party_id = ?", partyId).Order("created_at").Find(&devices).Error
+	return devices, err
+}
+
+// Delete removes device memberId from partyId. It returns
+// gorm.ErrRecordNotFound if the party has no such device.
+func (s *DeviceStore) Delete(partyId, memberId string) error {
+	result := s.db.Where("party_id = ? AND member_id = ?", partyId, memberId).Delete(&Device{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+func (s *DeviceStore) Touch(device *Device) error {
+	now := time.Now().UTC()
+	device.LastSeenAt = &now
+	return s.db.Model(device).Update("last_seen_at", now).Error
+}
@@ -0,0 +1,63 @@
+package data
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type InviteStore struct {
+	db *gorm.DB
+}
+
+func NewInviteStore(db *gorm.DB) *InviteStore {
+	return &InviteStore{
+		db: db,
+	}
+}
+
+func (s *InviteStore) Create(invite *Invite) error {
+	return s.db.Create(invite).Error
+}
+
+// List returns every invite of partyId, used up or not.
+func (s *InviteStore) List(partyId string) ([]Invite, error) {
+	var invites []Invite
+	err := s.db.Where("party_id = ?", partyId).Order("created_at").Find(&invites).Error
+	return invites, err
+}
+
+// Redeem uses up one use of the invite with the given hash and returns it.
+// It returns gorm.ErrRecordNotFound if there is no such invite or it is
+// revoked, expired or used up.
+func (s *InviteStore) Redeem(hash string) (*Invite, error) {
+	var invite Invite
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&Invite{}).
+			Where("hash = ? AND revoked_at IS NULL AND expires_at > ? AND uses < max_uses", hash, time.Now().UTC()).
+			Update("uses", gorm.Expr("uses + 1"))
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return tx.Where("hash = ?", hash).First(&invite).Error
+	})
+	return &invite, err
+}
+
+// Revoke revokes invite id of partyId. It returns gorm.ErrRecordNotFound if
+// the party has no such unrevoked invite.
+func (s *InviteStore) Revoke(partyId, id string) error {
+	result := s.db.Model(&Invite{}).
+		Where("id = ? AND party_id = ? AND revoked_at IS NULL", id, partyId).
+		Update("revoked_at", time.Now().UTC())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
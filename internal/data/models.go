@@ -1,6 +1,8 @@
 package data
 
 import (
+	"time"
+
 	"github.com/google/uuid"
 	"gorm.io/gorm"
 )
@@ -14,3 +16,75 @@ type Party struct {
 	CertPEM       string    `gorm:"type:text"`
 	KeyPEM        string    `gorm:"type:text"`
 }
+
+// Blob is the metadata of a large clipboard item uploaded to a party. Its
+// contents live in a blob.Storage under PartyID/ID.
+type Blob struct {
+	ID        uuid.UUID `gorm:"primarykey"`
+	PartyID   uuid.UUID `gorm:"index"`
+	MimeType  string
+	Size      int64
+	Checksum  string
+	CreatedAt time.Time
+	ExpiresAt time.Time `gorm:"index"`
+}
+
+// APIKey is a credential granting scoped access to a party. Only the SHA-256
+// of the key is stored.
+type APIKey struct {
+	ID      uuid.UUID `gorm:"primarykey"`
+	PartyID uuid.UUID `gorm:"index"`
+	Name    string
+	Hash    string `gorm:"uniqueIndex"`
+	// Scopes is a comma separated list of scope names.
+	Scopes     string
+	CreatedAt  time.Time
+	LastUsedAt *time.Time
+	RevokedAt  *time.Time
+}
+
+// Invite lets whoever holds its code join a party without its secret, up to
+// MaxUses times before ExpiresAt. Only the SHA-256 of the code is stored.
+type Invite struct {
+	ID      uuid.UUID `gorm:"primarykey"`
+	PartyID uuid.UUID `gorm:"index"`
+	Hash    string    `gorm:"uniqueIndex"`
+	// Role is the role redeemers join with; empty leaves the default.
+	Role      string
+	MaxUses   int
+	Uses      int
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	RevokedAt *time.Time
+}
+
+// Device is an enrolled member of a party. Its member ID is reserved for it,
+// and it authenticates with its Ed25519 key or, over mutual TLS, a client
+// certificate with the given fingerprint.
+type Device struct {
+	PartyID  uuid.UUID `gorm:"primarykey"`
+	MemberID string    `gorm:"primarykey"`
+	Name     string
+	// Role is the role the device's tokens are issued with.
+	Role string
+	// PublicKey is the base64 Ed25519 public key of the device.
+	PublicKey string
+	// CertFingerprint is the hex SHA-256 of the device's certificate.
+	CertFingerprint string `gorm:"index"`
+	CreatedAt       time.Time
+	LastSeenAt      *time.Time
+}
+
+// MemberRole is the role an admin assigned to a member of a party. It takes
+// precedence over the role the member's join token was issued with.
+type MemberRole struct {
+	PartyID   uuid.UUID `gorm:"primarykey"`
+	MemberID  string    `gorm:"primarykey"`
+	Role      string
+	UpdatedAt time.Time
+}
+
+// Migrate creates or updates the tables for every model.
+func Migrate(db *gorm.DB) error {
+	return db.AutoMigrate(&Party{}, &Blob{}, &APIKey{}, &Invite{}, &Device{}, &MemberRole{})
+}
@@ -1,6 +1,12 @@
 package data
 
-import "gorm.io/gorm"
+import (
+	"context"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
 
 type PartyStore struct {
 	db *gorm.DB
@@ -26,6 +32,50 @@ func (s *PartyStore) Update(party *Party) error {
 	return s.db.Save(party).Error
 }
 
-func (s *PartyStore) Delete(party *Party) error {
-	return s.db.Delete(party).Error
+// Delete deletes party together with its API keys, invites, devices, member
+// roles and blob records. It returns the deleted blobs, whose contents the
+// caller must remove from storage.
+func (s *PartyStore) Delete(party *Party) ([]Blob, error) {
+	partyId := party.ID.String()
+	var blobs []Blob
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("party_id = ?", partyId).Find(&blobs).Error; err != nil {
+			return err
+		}
+		for _, model := range []any{&Blob{}, &APIKey{}, &Invite{}, &Device{}, &MemberRole{}} {
+			if err := tx.Where("party_id = ?", partyId).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		// the row holds the secret's hash and the CA key, so it must not
+		// merely be soft-deleted
+		return tx.Unscoped().Delete(party).Error
+	})
+	return blobs, err
+}
+
+// Ping checks that the database can be reached.
+func (s *PartyStore) Ping(ctx context.Context) error {
+	db, err := s.db.DB()
+	if err != nil {
+		return err
+	}
+	return db.PingContext(ctx)
+}
+
+// GetMemberRole returns the role assigned to memberId in partyId, or
+// gorm.ErrRecordNotFound if none was.
+func (s *PartyStore) GetMemberRole(partyId, memberId string) (string, error) {
+	var role MemberRole
+	err := s.db.Where("party_id = ? AND member_id = ?", partyId, memberId).First(&role).Error
+	return role.Role, err
+}
+
+func (s *PartyStore) SetMemberRole(partyId, memberId, role string) error {
+	id, err := uuid.Parse(partyId)
+	if err != nil {
+		return err
+	}
+	return s.db.Clauses(clause.OnConflict{UpdateAll: true}).
+		Create(&MemberRole{PartyID: id, MemberID: memberId, Role: role}).Error
 }
@@ -0,0 +1,248 @@
+package manager
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dino16m/clippa-server/internal/data"
+	"github.com/dino16m/clippa-server/internal/service"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Scope is a permission an API key can be granted. The party secret has every
+// scope.
+type Scope string
+
+const (
+	// ScopePushClipboard allows pushing clipboard items and uploading blobs.
+	ScopePushClipboard Scope = "push-clipboard"
+	// ScopeReadHistory allows downloading the party's blobs.
+	ScopeReadHistory Scope = "read-history"
+	// ScopeManageMembers allows issuing join tokens, kicking members and
+	// setting their roles, acting as an admin of the party.
+	ScopeManageMembers Scope = "manage-members"
+	// ScopeReadCerts allows reading the party's CA certificate, but never its
+	// key.
+	ScopeReadCerts Scope = "read-certs"
+)
+
+var allScopes = []Scope{ScopePushClipboard, ScopeReadHistory, ScopeManageMembers, ScopeReadCerts}
+
+// apiKeyPrefix starts every API key, so leaked keys are easy to recognise.
+const apiKeyPrefix = "clp_"
+
+// hashCredential returns the hex SHA-256 under which an API key or invite
+// code is stored.
+func hashCredential(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func parseScopes(raw string) []Scope {
+	scopes := []Scope{}
+	for _, scope := range strings.Split(raw, ",") {
+		if scope != "" {
+			scopes = append(scopes, Scope(scope))
+		}
+	}
+	return scopes
+}
+
+// access records what authorized a request: the party secret, or an API key
+// when key is set.
+type access struct {
+	party *data.Party
+	key   *data.APIKey
+}
+
+func (a access) allows(scope Scope) bool {
+	return a.key == nil || slices.Contains(parseScopes(a.key.Scopes), scope)
+}
+
+// role is the party role the credential acts with: the secret makes its
+// holder the owner, while an API key acts as an admin.
+func (a access) role() service.Role {
+	if a.key == nil {
+		return service.RoleOwner
+	}
+	return service.RoleAdmin
+}
+
+// bearerKey returns the API key in the Authorization header, if any.
+func bearerKey(r *http.Request) (string, bool) {
+	key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	key = strings.TrimSpace(key)
+	return key, ok && key != ""
+}
+
+// authorize checks the request's API key for scope, or else its party
+// secret, writing an error response if neither grants access. The id query
+// parameter is optional with an API key, which belongs to a single party.
+func (mc *ManagerCtrl) authorize(w http.ResponseWriter, r *http.Request, scope Scope) (access, bool) {
+	raw, ok := bearerKey(r)
+	if !ok {
+		party, ok := mc.authorizeParty(w, r)
+		return access{party: party}, ok
+	}
+
+	partyId := strings.TrimSpace(r.URL.Query().Get("id"))
+	ip := clientIP(r, mc.trustProxy)
+	if mc.rejectLockedOut(w, ip, partyId) {
+		return access{}, false
+	}
+	if mc.apiKeys == nil {
+		WriteError(w, http.StatusUnauthorized, service.ErrUnauthorized)
+		return access{}, false
+	}
+	key, err := mc.apiKeys.GetByHash(hashCredential(raw))
+	if err != nil || (partyId != "" && partyId != key.PartyID.String()) {
+		mc.requestLogger(r).WithField("party", partyId).Warn("invalid api key")
+		mc.recordFailure(ip, partyId, credentialAPIKey)
+		WriteError(w, http.StatusUnauthorized, service.ErrUnauthorized)
+		return access{}, false
+	}
+	partyId = key.PartyID.String()
+	mc.recordSuccess(partyId)
+
+	if !(access{key: key}).allows(scope) {
+		WriteError(w, http.StatusForbidden, service.ErrForbidden.WithMessage(fmt.Sprintf("api key lacks the %s scope", scope)))
+		return access{}, false
+	}
+	party, err := mc.store.Get(partyId)
+	if err != nil {
+		WriteError(w, http.StatusUnauthorized, service.ErrUnauthorized)
+		return access{}, false
+	}
+	if err := mc.apiKeys.Touch(key); err != nil {
+		mc.requestLogger(r).WithError(err).WithField("key", key.ID).Warn("failed to record api key use")
+	}
+	return access{party: party, key: key}, true
+}
+
+type APIKeyRequest struct {
+	Name   string  `json:"name"`
+	Scopes []Scope `json:"scopes"`
+}
+
+type APIKeyResponse struct {
+	ID         uuid.UUID  `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []Scope    `json:"scopes"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+	RevokedAt  *time.Time `json:"revokedAt,omitempty"`
+	// Key is only returned when the key is created.
+	Key string `json:"key,omitempty"`
+}
+
+func apiKeyResponse(key data.APIKey) APIKeyResponse {
+	return APIKeyResponse{
+		ID:         key.ID,
+		Name:       key.Name,
+		Scopes:     parseScopes(key.Scopes),
+		CreatedAt:  key.CreatedAt,
+		LastUsedAt: key.LastUsedAt,
+		RevokedAt:  key.RevokedAt,
+	}
+}
+
+// CreateAPIKey creates an API key for the party. It requires the party
+// secret.
+func (mc *ManagerCtrl) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	party, ok := mc.authorizeParty(w, r)
+	if !ok {
+		return
+	}
+
+	var req APIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteError(w, http.StatusBadRequest, service.ErrBadRequest.WithMessage("invalid request body"))
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Scopes) == 0 {
+		WriteError(w, http.StatusBadRequest, service.ErrBadRequest.WithMessage("name and scopes are required"))
+		return
+	}
+	scopes := make([]string, 0, len(req.Scopes))
+	for _, scope := range req.Scopes {
+		if !slices.Contains(allScopes, scope) {
+			WriteError(w, http.StatusBadRequest, service.ErrBadRequest.WithMessage(fmt.Sprintf("unknown scope %q", scope)))
+			return
+		}
+		scopes = append(scopes, string(scope))
+	}
+
+	secret, err := SecureRandomString(40)
+	if err != nil {
+		mc.requestLogger(r).WithError(err).Error("failed to generate api key")
+		WriteError(w, http.StatusInternalServerError, service.ErrInternal)
+		return
+	}
+	raw := apiKeyPrefix + secret
+	key := data.APIKey{
+		ID:        uuid.New(),
+		PartyID:   party.ID,
+		Name:      req.Name,
+		Hash:      hashCredential(raw),
+		Scopes:    strings.Join(scopes, ","),
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := mc.apiKeys.Create(&key); err != nil {
+		mc.requestLogger(r).WithError(err).WithField("party", party.ID).Error("failed to create api key")
+		WriteError(w, http.StatusInternalServerError, service.ErrInternal)
+		return
+	}
+
+	resp := apiKeyResponse(key)
+	resp.Key = raw
+	WriteJson(w, http.StatusCreated, resp)
+}
+
+// ListAPIKeys lists the party's API keys, without the keys themselves.
+func (mc *ManagerCtrl) ListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	party, ok := mc.authorizeParty(w, r)
+	if !ok {
+		return
+	}
+
+	keys, err := mc.apiKeys.List(party.ID.String())
+	if err != nil {
+		mc.requestLogger(r).WithError(err).WithField("party", party.ID).Error("failed to list api keys")
+		WriteError(w, http.StatusInternalServerError, service.ErrInternal)
+		return
+	}
+	resp := make([]APIKeyResponse, 0, len(keys))
+	for _, key := range keys {
+		resp = append(resp, apiKeyResponse(key))
+	}
+	WriteJson(w, http.StatusOK, resp)
+}
+
+// RevokeAPIKey revokes one of the party's API keys.
+func (mc *ManagerCtrl) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	party, ok := mc.authorizeParty(w, r)
+	if !ok {
+		return
+	}
+
+	err := mc.apiKeys.Revoke(party.ID.String(), r.PathValue("keyId"))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		WriteError(w, http.StatusNotFound, service.ErrNotFound.WithMessage("api key not found"))
+		return
+	}
+	if err != nil {
+		mc.requestLogger(r).WithError(err).WithField("party", party.ID).Error("failed to revoke api key")
+		WriteError(w, http.StatusInternalServerError, service.ErrInternal)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
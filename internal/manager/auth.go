@@ -2,30 +2,95 @@ package manager
 
 import (
 	"sync"
+
+	"github.com/dino16m/clippa-server/internal/service"
 )
 
+// membership is what a join token grants: membership of a party in a role,
+// as a given member when the token was issued to an enrolled device.
+type membership struct {
+	partyId  string
+	role     service.Role
+	memberId string
+	// token is the join token the membership was granted by, if any.
+	token string
+}
+
 type AuthService struct {
 	mutex      *sync.RWMutex
-	identities map[string]string
+	identities map[string]membership
+	// joined holds the used tokens of connected members, which still let
+	// them download the party's blobs.
+	joined map[string]membership
 }
 
 func NewAuthService() *AuthService {
 	return &AuthService{
 		mutex:      &sync.RWMutex{},
-		identities: map[string]string{},
+		identities: map[string]membership{},
+		joined:     map[string]membership{},
 	}
 }
 
-func (a *AuthService) SaveToken(partyId, token string) {
+func (a *AuthService) SaveToken(token string, granted membership) {
 	a.mutex.Lock()
 	defer a.mutex.Unlock()
-	a.identities[token] = partyId
+	a.identities[token] = granted
 }
 
 func (a *AuthService) GetPartyId(token string) string {
 	a.mutex.RLock()
 	defer a.mutex.RUnlock()
-	return a.identities[token]
+	return a.identities[token].partyId
+}
+
+// Take returns the membership token grants and deletes the token, so only
+// one join can use it.
+func (a *AuthService) Take(token string) (membership, bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	granted, ok := a.identities[token]
+	delete(a.identities, token)
+	return granted, ok
+}
+
+// Hold keeps a used token valid for downloads by the member that joined with
+// it, until Release.
+func (a *AuthService) Hold(token string, granted membership) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.joined[token] = granted
+}
+
+func (a *AuthService) Release(token string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	delete(a.joined, token)
+}
+
+// Lookup returns the membership a token grants for downloads: an unused
+// token, or one held for a connected member.
+func (a *AuthService) Lookup(token string) (membership, bool) {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	if granted, ok := a.identities[token]; ok {
+		return granted, true
+	}
+	granted, ok := a.joined[token]
+	return granted, ok
+}
+
+// ForgetParty deletes the tokens of party partyId, used or not.
+func (a *AuthService) ForgetParty(partyId string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for _, tokens := range []map[string]membership{a.identities, a.joined} {
+		for token, granted := range tokens {
+			if granted.partyId == partyId {
+				delete(tokens, token)
+			}
+		}
+	}
 }
 
 func (a *AuthService) DeleteToken(token string) {
@@ -0,0 +1,246 @@
+package manager
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dino16m/clippa-server/internal/data"
+	"github.com/dino16m/clippa-server/internal/service"
+	"github.com/google/uuid"
+)
+
+// BlobConfig limits the blobs a party may upload.
+type BlobConfig struct {
+	// MaxSize is the largest single blob, in bytes.
+	MaxSize int64
+	// Quota is the total size of the blobs a party may hold, in bytes.
+	Quota int64
+	// TTL is how long a blob can be downloaded after it is uploaded.
+	TTL time.Duration
+}
+
+func blobKey(partyId uuid.UUID, blobId uuid.UUID) string {
+	return partyId.String() + "/" + blobId.String()
+}
+
+// UploadBlob stores a blob for the party. Members uploading with their own
+// credentials must be connected, in a role and mode that may send clipboard
+// items.
+func (mc *ManagerCtrl) UploadBlob(w http.ResponseWriter, r *http.Request) {
+	granted, ok := mc.authorizeBlobs(w, r, ScopePushClipboard)
+	if !ok {
+		return
+	}
+	if granted.member {
+		if err := mc.partyProvider.CanSendClipboard(granted.party.ID.String(), granted.memberId); err != nil {
+			WriteError(w, http.StatusForbidden, err)
+			return
+		}
+	}
+	party := granted.party
+	logger := mc.requestLogger(r).WithField("party", party.ID)
+
+	if r.ContentLength > mc.blobConfig.MaxSize {
+		WriteError(w, http.StatusRequestEntityTooLarge, service.ErrPayloadTooLarge)
+		return
+	}
+	usage, err := mc.blobs.Usage(party.ID.String())
+	if err != nil {
+		logger.WithError(err).Error("failed to get blob usage")
+		WriteError(w, http.StatusInternalServerError, service.ErrInternal)
+		return
+	}
+	if usage+max(r.ContentLength, 0) > mc.blobConfig.Quota {
+		WriteError(w, http.StatusInsufficientStorage, service.ErrQuotaExceeded)
+		return
+	}
+
+	mimeType := r.Header.Get("Content-Type")
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+
+	record := data.Blob{
+		ID:       uuid.New(),
+		PartyID:  party.ID,
+		MimeType: mimeType,
+	}
+	key := blobKey(party.ID, record.ID)
+	hash := sha256.New()
+	body := http.MaxBytesReader(w, r.Body, mc.blobConfig.MaxSize)
+	size, err := mc.blobStorage.Put(r.Context(), key, io.TeeReader(body, hash))
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			WriteError(w, http.StatusRequestEntityTooLarge, service.ErrPayloadTooLarge)
+			return
+		}
+		logger.WithError(err).Error("failed to store blob")
+		WriteError(w, http.StatusInternalServerError, service.ErrInternal)
+		return
+	}
+	// the upload may not have declared its length up front
+	if usage+size > mc.blobConfig.Quota {
+		mc.blobStorage.Delete(r.Context(), key)
+		WriteError(w, http.StatusInsufficientStorage, service.ErrQuotaExceeded)
+		return
+	}
+
+	now := time.Now().UTC()
+	record.Size = size
+	record.Checksum = hex.EncodeToString(hash.Sum(nil))
+	record.CreatedAt = now
+	record.ExpiresAt = now.Add(mc.blobConfig.TTL)
+	if err := mc.blobs.Create(&record); err != nil {
+		mc.blobStorage.Delete(r.Context(), key)
+		logger.WithError(err).Error("failed to save blob")
+		WriteError(w, http.StatusInternalServerError, service.ErrInternal)
+		return
+	}
+
+	// RequestURI still carries any prefix the route was mounted under
+	base, _, _ := strings.Cut(r.RequestURI, "?")
+	resp := BlobResponse{
+		ID:        record.ID,
+		MimeType:  record.MimeType,
+		Size:      record.Size,
+		Checksum:  record.Checksum,
+		URL:       strings.TrimSuffix(base, "/") + "/" + record.ID.String() + "?id=" + url.QueryEscape(party.ID.String()),
+		ExpiresAt: record.ExpiresAt,
+	}
+	WriteJson(w, http.StatusCreated, resp)
+}
+
+// holdToken keeps the token a member joined with valid for downloading the
+// party's blobs while the member is connected. It returns the func ending the
+// hold.
+func (mc *ManagerCtrl) holdToken(granted membership, memberId string) func() {
+	if granted.token == "" {
+		return func() {}
+	}
+	granted.memberId = memberId
+	mc.authStore.Hold(granted.token, granted)
+	return func() { mc.authStore.Release(granted.token) }
+}
+
+// blobAccess is a client allowed to use a party's blobs. member is set for
+// clients that authenticated as a member, with a join token or a client
+// certificate, rather than with the party's credentials.
+type blobAccess struct {
+	party    *data.Party
+	member   bool
+	memberId string
+}
+
+// authorizeBlobs checks the credentials of a blob request: those of authorize
+// with scope, or those members join with. A join token stays valid while its
+// member is connected.
+func (mc *ManagerCtrl) authorizeBlobs(w http.ResponseWriter, r *http.Request, scope Scope) (blobAccess, bool) {
+	q := r.URL.Query()
+	_, hasKey := bearerKey(r)
+	_, hasCert := peerCertificate(r)
+	var granted membership
+	switch {
+	case q.Has("token"):
+		partyId := strings.TrimSpace(q.Get("id"))
+		ip := clientIP(r, mc.trustProxy)
+		if mc.rejectLockedOut(w, ip, partyId) {
+			return blobAccess{}, false
+		}
+		var ok bool
+		granted, ok = mc.authStore.Lookup(strings.TrimSpace(q.Get("token")))
+		// only held tokens carry the token, and their member must be connected
+		if ok && granted.token != "" {
+			ok = mc.partyProvider.Connected(granted.partyId, granted.memberId)
+		}
+		if !ok || granted.partyId != partyId {
+			mc.requestLogger(r).WithField("party", partyId).Warn("invalid or expired token")
+			mc.recordFailure(ip, partyId, credentialToken)
+			WriteError(w, http.StatusUnauthorized, service.ErrUnauthorized)
+			return blobAccess{}, false
+		}
+		mc.recordSuccess(partyId)
+	case hasCert && !hasKey && r.Header.Get("X-Secret") == "":
+		var err error
+		if granted, err = mc.certMembership(w, r); err != nil {
+			return blobAccess{}, false
+		}
+	default:
+		granted, ok := mc.authorize(w, r, scope)
+		return blobAccess{party: granted.party}, ok
+	}
+	party, err := mc.store.Get(granted.partyId)
+	if err != nil {
+		WriteError(w, http.StatusUnauthorized, service.ErrUnauthorized)
+		return blobAccess{}, false
+	}
+	return blobAccess{party: party, member: true, memberId: granted.memberId}, true
+}
+
+// DownloadBlob serves a blob of the party, honouring Range requests.
+func (mc *ManagerCtrl) DownloadBlob(w http.ResponseWriter, r *http.Request) {
+	granted, ok := mc.authorizeBlobs(w, r, ScopeReadHistory)
+	if !ok {
+		return
+	}
+	party := granted.party
+
+	record, err := mc.blobs.Get(party.ID.String(), r.PathValue("blobId"))
+	if err != nil {
+		WriteError(w, http.StatusNotFound, service.ErrNotFound.WithMessage("blob not found"))
+		return
+	}
+	content, err := mc.blobStorage.Open(r.Context(), blobKey(party.ID, record.ID))
+	if err != nil {
+		mc.requestLogger(r).WithError(err).WithField("blob", record.ID).Error("failed to open blob")
+		WriteError(w, http.StatusNotFound, service.ErrNotFound.WithMessage("blob not found"))
+		return
+	}
+	defer content.Close()
+
+	w.Header().Set("Content-Type", record.MimeType)
+	w.Header().Set("ETag", `"`+record.Checksum+`"`)
+	http.ServeContent(w, r, "", record.CreatedAt, content)
+}
+
+// CollectBlobs deletes every expired blob from storage and the database.
+func (mc *ManagerCtrl) CollectBlobs(ctx context.Context) {
+	expired, err := mc.blobs.Expired(time.Now().UTC())
+	if err != nil {
+		mc.logger.WithError(err).Error("failed to list expired blobs")
+		return
+	}
+	for _, record := range expired {
+		if err := mc.blobStorage.Delete(ctx, blobKey(record.PartyID, record.ID)); err != nil {
+			mc.logger.WithError(err).WithField("blob", record.ID).Error("failed to delete blob")
+			continue
+		}
+		if err := mc.blobs.Delete(&record); err != nil {
+			mc.logger.WithError(err).WithField("blob", record.ID).Error("failed to delete blob record")
+		}
+	}
+	if len(expired) > 0 {
+		mc.logger.Infof("collected %d expired blobs", len(expired))
+	}
+}
+
+// RunBlobCollector calls CollectBlobs every interval until ctx is done.
+func (mc *ManagerCtrl) RunBlobCollector(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			mc.CollectBlobs(ctx)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package manager
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/coder/websocket"
+	"github.com/dino16m/clippa-server/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// CompressionConfig controls permessage-deflate on the join socket.
+type CompressionConfig struct {
+	Mode websocket.CompressionMode
+	// Threshold is the smallest message that is compressed, in bytes. Zero
+	// uses the mode's default.
+	Threshold int
+}
+
+// ParseCompressionMode parses "disabled", "context-takeover" or
+// "no-context-takeover".
+func ParseCompressionMode(mode string) (websocket.CompressionMode, error) {
+	switch mode {
+	case "", "disabled":
+		return websocket.CompressionDisabled, nil
+	case "context-takeover":
+		return websocket.CompressionContextTakeover, nil
+	case "no-context-takeover":
+		return websocket.CompressionNoContextTakeover, nil
+	}
+	return websocket.CompressionDisabled, fmt.Errorf("unknown compression mode %q", mode)
+}
+
+// countingWriter wraps a ResponseWriter so that the connection hijacked for a
+// websocket counts the bytes it reads and writes in metrics.
+type countingWriter struct {
+	http.ResponseWriter
+	metrics *metrics.Metrics
+}
+
+func (w countingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w countingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	counted := &countingConn{
+		Conn:     conn,
+		bytesIn:  w.metrics.SocketWireBytes.WithLabelValues("in"),
+		bytesOut: w.metrics.SocketWireBytes.WithLabelValues("out"),
+	}
+	// writes must go through the counting conn; reads already buffered are
+	// not counted
+	return counted, bufio.NewReadWriter(rw.Reader, bufio.NewWriter(counted)), nil
+}
+
+type countingConn struct {
+	net.Conn
+	bytesIn  prometheus.Counter
+	bytesOut prometheus.Counter
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.bytesIn.Add(float64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.bytesOut.Add(float64(n))
+	return n, err
+}
@@ -0,0 +1,371 @@
+package manager
+
+import (
+	"crypto/ed25519"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dino16m/clippa-server/internal/data"
+	"github.com/dino16m/clippa-server/internal/service"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// challengeTTL is how long a device has to sign a challenge.
+const challengeTTL = time.Minute
+
+type EnrolDeviceRequest struct {
+	// MemberID is the ID the device joins as. Defaults to a random ID.
+	MemberID string `json:"memberId"`
+	Name     string `json:"name"`
+	// PublicKey is the base64 Ed25519 public key of the device.
+	PublicKey string `json:"publicKey"`
+	// CertFingerprint is the hex SHA-256 of the device's client certificate.
+	CertFingerprint string `json:"certFingerprint"`
+	// Role is the role the device joins with. Defaults to member, or the
+	// role of the join token the device enrols with.
+	Role service.Role `json:"role"`
+}
+
+type DeviceResponse struct {
+	MemberID        string       `json:"memberId"`
+	Name            string       `json:"name"`
+	Role            service.Role `json:"role"`
+	PublicKey       string       `json:"publicKey,omitempty"`
+	CertFingerprint string       `json:"certFingerprint,omitempty"`
+	CreatedAt       time.Time    `json:"createdAt"`
+	LastSeenAt      *time.Time   `json:"lastSeenAt,omitempty"`
+}
+
+type ChallengeResponse struct {
+	Nonce     string    `json:"nonce"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type DeviceTokenRequest struct {
+	Nonce string `json:"nonce"`
+	// Signature is the base64 Ed25519 signature of the nonce.
+	Signature string `json:"signature"`
+}
+
+func deviceResponse(device data.Device) DeviceResponse {
+	return DeviceResponse{
+		MemberID:        device.MemberID,
+		Name:            device.Name,
+		Role:            service.Role(device.Role),
+		PublicKey:       device.PublicKey,
+		CertFingerprint: device.CertFingerprint,
+		CreatedAt:       device.CreatedAt,
+		LastSeenAt:      device.LastSeenAt,
+	}
+}
+
+// challenge is a nonce issued to a device, to be signed with its key.
+type challenge struct {
+	nonce     string
+	expiresAt time.Time
+}
+
+// challenges holds the open challenge of each device. A new challenge
+// replaces the device's previous one, so there are at most as many as there
+// are enrolled devices.
+type challenges struct {
+	mutex      sync.Mutex
+	challenges map[string]challenge
+	// nextPrune is when expired challenges are next dropped.
+	nextPrune time.Time
+}
+
+func newChallenges() *challenges {
+	return &challenges{challenges: map[string]challenge{}}
+}
+
+func challengeKey(partyId, memberId string) string {
+	return partyId + "/" + memberId
+}
+
+func (c *challenges) issue(partyId, memberId string) (string, time.Time) {
+	nonce, _ := SecureRandomString(32)
+	now := time.Now()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	// challenges of devices that never answer are dropped now and then
+	if now.After(c.nextPrune) {
+		for key, issued := range c.challenges {
+			if now.After(issued.expiresAt) {
+				delete(c.challenges, key)
+			}
+		}
+		c.nextPrune = now.Add(challengeTTL)
+	}
+	expiresAt := now.Add(challengeTTL)
+	c.challenges[challengeKey(partyId, memberId)] = challenge{nonce: nonce, expiresAt: expiresAt}
+	return nonce, expiresAt
+}
+
+// take removes the open challenge of memberId of partyId and reports whether
+// it was nonce and has not expired.
+func (c *challenges) take(nonce, partyId, memberId string) bool {
+	key := challengeKey(partyId, memberId)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	issued, ok := c.challenges[key]
+	delete(c.challenges, key)
+	return ok && subtle.ConstantTimeCompare([]byte(issued.nonce), []byte(nonce)) == 1 && time.Now().Before(issued.expiresAt)
+}
+
+// joinIdentity settles who a join is for: the device its token was issued
+// to, else the memberId query parameter, else a random member. IDs of
+// enrolled devices can only be claimed with tokens issued to them, and IDs
+// that are connected only with supersede=true, by the member itself or a
+// token of at least its role.
+func (mc *ManagerCtrl) joinIdentity(w http.ResponseWriter, r *http.Request, granted membership) (string, bool, bool) {
+	q := r.URL.Query()
+	memberId := strings.TrimSpace(q.Get("memberId"))
+	supersede := false
+	if raw := strings.TrimSpace(q.Get("supersede")); raw != "" {
+		var err error
+		if supersede, err = strconv.ParseBool(raw); err != nil {
+			WriteError(w, http.StatusBadRequest, service.ErrBadRequest.WithMessage("supersede must be true or false"))
+			return "", false, false
+		}
+	}
+
+	switch {
+	case granted.memberId != "":
+		if memberId != "" && memberId != granted.memberId {
+			WriteError(w, http.StatusForbidden, service.ErrForbidden.WithMessage("the token was issued to another member"))
+			return "", false, false
+		}
+		memberId = granted.memberId
+	case memberId == "":
+		memberId = uuid.New().String()
+	case mc.devices != nil:
+		if _, err := mc.devices.Get(granted.partyId, memberId); err == nil {
+			WriteError(w, http.StatusForbidden, service.ErrForbidden.WithMessage("the member id belongs to an enrolled device"))
+			return "", false, false
+		}
+	}
+
+	if role, ok := mc.partyProvider.ConnectedRole(granted.partyId, memberId); ok {
+		if !supersede {
+			WriteError(w, http.StatusConflict, service.ErrMemberConnected)
+			return "", false, false
+		}
+		if granted.memberId == "" && !granted.role.AtLeast(role) {
+			WriteError(w, http.StatusForbidden, service.ErrForbidden.WithMessage(fmt.Sprintf("%s may not supersede %s", granted.role, memberId)))
+			return "", false, false
+		}
+	}
+	return memberId, supersede, true
+}
+
+// EnrolDevice registers a device as a member of the party. It takes the
+// party's credentials, or a join token (e.g. from an invite) with which the
+// device enrols itself in the token's role.
+func (mc *ManagerCtrl) EnrolDevice(w http.ResponseWriter, r *http.Request) {
+	var party uuid.UUID
+	var actor service.Role
+	if r.URL.Query().Has("token") {
+		granted, err := mc.validatePartyMembership(w, r)
+		if err != nil {
+			return
+		}
+		party, _ = uuid.Parse(granted.partyId)
+		actor = granted.role
+	} else {
+		granted, ok := mc.authorize(w, r, ScopeManageMembers)
+		if !ok {
+			return
+		}
+		party = granted.party.ID
+		actor = granted.role()
+	}
+
+	var req EnrolDeviceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteError(w, http.StatusBadRequest, service.ErrBadRequest.WithMessage("invalid request body"))
+		return
+	}
+	req.MemberID = strings.TrimSpace(req.MemberID)
+	if req.MemberID == "" {
+		req.MemberID = uuid.New().String()
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	req.CertFingerprint = strings.ToLower(strings.TrimSpace(req.CertFingerprint))
+	if req.Name == "" || (req.PublicKey == "" && req.CertFingerprint == "") {
+		WriteError(w, http.StatusBadRequest, service.ErrBadRequest.WithMessage("name and a public key or certificate fingerprint are required"))
+		return
+	}
+	if req.PublicKey != "" {
+		key, err := base64.StdEncoding.DecodeString(req.PublicKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			WriteError(w, http.StatusBadRequest, service.ErrBadRequest.WithMessage("publicKey must be a base64 Ed25519 public key"))
+			return
+		}
+	}
+	if req.CertFingerprint != "" {
+		if fingerprint, err := hex.DecodeString(req.CertFingerprint); err != nil || len(fingerprint) != 32 {
+			WriteError(w, http.StatusBadRequest, service.ErrBadRequest.WithMessage("certFingerprint must be a hex SHA-256"))
+			return
+		}
+	}
+	role := service.RoleMember
+	if !actor.AtLeast(role) {
+		role = actor
+	}
+	if req.Role != "" {
+		var ok bool
+		if role, ok = service.ParseRole(string(req.Role)); !ok {
+			WriteError(w, http.StatusBadRequest, service.ErrBadRequest.WithMessage(fmt.Sprintf("unknown role %q", req.Role)))
+			return
+		}
+	}
+	if !actor.AtLeast(role) {
+		WriteError(w, http.StatusForbidden, service.ErrForbidden.WithMessage(fmt.Sprintf("cannot enrol %s devices", role)))
+		return
+	}
+
+	if _, err := mc.devices.Get(party.String(), req.MemberID); err == nil {
+		WriteError(w, http.StatusConflict, service.ErrDeviceExists)
+		return
+	}
+	// enrolling binds the ID to the device, so it must not belong to anyone
+	if _, err := mc.store.GetMemberRole(party.String(), req.MemberID); err == nil {
+		WriteError(w, http.StatusConflict, service.ErrMemberHasRole)
+		return
+	}
+	if mc.partyProvider.Connected(party.String(), req.MemberID) {
+		WriteError(w, http.StatusConflict, service.ErrMemberConnected)
+		return
+	}
+	device := data.Device{
+		PartyID:         party,
+		MemberID:        req.MemberID,
+		Name:            req.Name,
+		Role:            string(role),
+		PublicKey:       req.PublicKey,
+		CertFingerprint: req.CertFingerprint,
+		CreatedAt:       time.Now().UTC(),
+	}
+	if err := mc.devices.Create(&device); err != nil {
+		mc.requestLogger(r).WithError(err).WithField("party", party).Error("failed to enrol device")
+		WriteError(w, http.StatusInternalServerError, service.ErrInternal)
+		return
+	}
+	mc.requestLogger(r).WithField("party", party).WithField("member", device.MemberID).Info("enrolled device")
+	WriteJson(w, http.StatusCreated, deviceResponse(device))
+}
+
+// ListDevices lists the devices enrolled in the party.
+func (mc *ManagerCtrl) ListDevices(w http.ResponseWriter, r *http.Request) {
+	granted, ok := mc.authorize(w, r, ScopeManageMembers)
+	if !ok {
+		return
+	}
+
+	devices, err := mc.devices.List(granted.party.ID.String())
+	if err != nil {
+		mc.requestLogger(r).WithError(err).WithField("party", granted.party.ID).Error("failed to list devices")
+		WriteError(w, http.StatusInternalServerError, service.ErrInternal)
+		return
+	}
+	resp := make([]DeviceResponse, 0, len(devices))
+	for _, device := range devices {
+		resp = append(resp, deviceResponse(device))
+	}
+	WriteJson(w, http.StatusOK, resp)
+}
+
+// RemoveDevice unenrols a device and disconnects it.
+func (mc *ManagerCtrl) RemoveDevice(w http.ResponseWriter, r *http.Request) {
+	granted, ok := mc.authorize(w, r, ScopeManageMembers)
+	if !ok {
+		return
+	}
+
+	partyId := granted.party.ID.String()
+	memberId := r.PathValue("memberId")
+	err := mc.devices.Delete(partyId, memberId)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		WriteError(w, http.StatusNotFound, service.ErrNotFound.WithMessage("device not found"))
+		return
+	}
+	if err != nil {
+		mc.requestLogger(r).WithError(err).WithField("party", partyId).Error("failed to remove device")
+		WriteError(w, http.StatusInternalServerError, service.ErrInternal)
+		return
+	}
+	// the device's credentials are revoked, not the member kicked
+	mc.partyProvider.Disconnect(partyId, memberId, service.ReasonAuthExpired)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeviceChallenge issues a nonce for an enrolled device to sign.
+// Unknown devices get a nonce too, which is never accepted, so the endpoint
+// does not tell which member IDs are enrolled.
+func (mc *ManagerCtrl) DeviceChallenge(w http.ResponseWriter, r *http.Request) {
+	partyId := strings.TrimSpace(r.URL.Query().Get("id"))
+	ip := clientIP(r, mc.trustProxy)
+	if mc.rejectLockedOut(w, ip, partyId) {
+		return
+	}
+
+	device, err := mc.devices.Get(partyId, r.PathValue("memberId"))
+	if err != nil || device.PublicKey == "" {
+		nonce, _ := SecureRandomString(32)
+		WriteJson(w, http.StatusOK, ChallengeResponse{Nonce: nonce, ExpiresAt: time.Now().Add(challengeTTL).UTC()})
+		return
+	}
+	nonce, expiresAt := mc.challenges.issue(partyId, device.MemberID)
+	WriteJson(w, http.StatusOK, ChallengeResponse{Nonce: nonce, ExpiresAt: expiresAt.UTC()})
+}
+
+// DeviceToken exchanges a challenge signed with a device's key for a join
+// token issued to the device.
+func (mc *ManagerCtrl) DeviceToken(w http.ResponseWriter, r *http.Request) {
+	partyId := strings.TrimSpace(r.URL.Query().Get("id"))
+	memberId := r.PathValue("memberId")
+	ip := clientIP(r, mc.trustProxy)
+	if mc.rejectLockedOut(w, ip, partyId) {
+		return
+	}
+
+	var req DeviceTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteError(w, http.StatusBadRequest, service.ErrBadRequest.WithMessage("invalid request body"))
+		return
+	}
+	device, err := mc.devices.Get(partyId, memberId)
+	signature, sigErr := base64.StdEncoding.DecodeString(req.Signature)
+	key, keyErr := base64.StdEncoding.DecodeString(device.PublicKey)
+	if err != nil || sigErr != nil || keyErr != nil || len(key) != ed25519.PublicKeySize ||
+		!mc.challenges.take(req.Nonce, partyId, memberId) ||
+		!ed25519.Verify(key, []byte(req.Nonce), signature) {
+		mc.requestLogger(r).WithField("party", partyId).WithField("member", memberId).Warn("invalid device signature")
+		mc.recordFailure(ip, partyId, credentialDevice)
+		WriteError(w, http.StatusUnauthorized, service.ErrUnauthorized)
+		return
+	}
+	mc.recordSuccess(partyId)
+	if err := mc.devices.Touch(device); err != nil {
+		mc.requestLogger(r).WithError(err).WithField("member", memberId).Warn("failed to record device use")
+	}
+
+	role, ok := service.ParseRole(device.Role)
+	if !ok {
+		role = service.RoleMember
+	}
+	WriteJson(w, http.StatusOK, AuthResponse{
+		Token: mc.issueToken(membership{partyId: partyId, role: role, memberId: memberId}),
+	})
+}
@@ -0,0 +1,192 @@
+package manager
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dino16m/clippa-server/internal/service"
+)
+
+// GuardConfig controls how failed secret checks are throttled for one kind of
+// key, such as a client IP or a party.
+type GuardConfig struct {
+	// MaxFailures is how many consecutive failures are tolerated before the
+	// key is locked out.
+	MaxFailures int
+	// BaseLockout is the first lockout; each further failure doubles it up
+	// to MaxLockout.
+	BaseLockout time.Duration
+	MaxLockout  time.Duration
+	// ResetAfter forgets the failures of a key that has not failed for this
+	// long.
+	ResetAfter time.Duration
+}
+
+func DefaultIPGuardConfig() GuardConfig {
+	return GuardConfig{
+		MaxFailures: 5,
+		BaseLockout: time.Second,
+		MaxLockout:  15 * time.Minute,
+		ResetAfter:  15 * time.Minute,
+	}
+}
+
+// DefaultPartyGuardConfig tolerates more failures than the per-IP default,
+// since failures against a party can come from anywhere and a lockout
+// shuts its legitimate members out too.
+func DefaultPartyGuardConfig() GuardConfig {
+	return GuardConfig{
+		MaxFailures: 20,
+		BaseLockout: time.Second,
+		MaxLockout:  5 * time.Minute,
+		ResetAfter:  15 * time.Minute,
+	}
+}
+
+type attempts struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// attemptGuard tracks failed secret checks per key and locks a key out with
+// exponential backoff once it has failed too often.
+type attemptGuard struct {
+	mutex     *sync.Mutex
+	cfg       GuardConfig
+	entries   map[string]*attempts
+	lastPrune time.Time
+}
+
+func newAttemptGuard(cfg GuardConfig) *attemptGuard {
+	return &attemptGuard{
+		mutex:   &sync.Mutex{},
+		cfg:     cfg,
+		entries: map[string]*attempts{},
+	}
+}
+
+// lockedFor returns how much longer key is locked out, or zero.
+func (g *attemptGuard) lockedFor(key string) time.Duration {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	entry, ok := g.entries[key]
+	if !ok {
+		return 0
+	}
+	return max(time.Until(entry.lockedUntil), 0)
+}
+
+// fail records a failed attempt and returns the lockout it triggered, if any.
+func (g *attemptGuard) fail(key string) time.Duration {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	now := time.Now()
+	g.prune(now)
+
+	entry, ok := g.entries[key]
+	if !ok || now.Sub(entry.lastFailure) > g.cfg.ResetAfter {
+		entry = &attempts{}
+		g.entries[key] = entry
+	}
+	entry.failures++
+	entry.lastFailure = now
+	over := entry.failures - g.cfg.MaxFailures
+	if over <= 0 {
+		return 0
+	}
+	lockout := g.cfg.BaseLockout << min(over-1, 30)
+	if lockout <= 0 || lockout > g.cfg.MaxLockout {
+		lockout = g.cfg.MaxLockout
+	}
+	entry.lockedUntil = now.Add(lockout)
+	return lockout
+}
+
+func (g *attemptGuard) succeed(key string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	delete(g.entries, key)
+}
+
+// prune drops keys that have been quiet for longer than ResetAfter, at most
+// once a minute. The caller must hold mutex.
+func (g *attemptGuard) prune(now time.Time) {
+	if now.Sub(g.lastPrune) < time.Minute {
+		return
+	}
+	g.lastPrune = now
+	for key, entry := range g.entries {
+		if now.Sub(entry.lastFailure) > g.cfg.ResetAfter && now.After(entry.lockedUntil) {
+			delete(g.entries, key)
+		}
+	}
+}
+
+// clientIP returns the address a request came from. Proxy headers are only
+// believed when trustProxy is set, as clients can send them too.
+func clientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			first, _, _ := strings.Cut(forwarded, ",")
+			return strings.TrimSpace(first)
+		}
+		if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+			return strings.TrimSpace(realIP)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// rejectLockedOut answers 429 if the client or the party is locked out. An
+// empty partyId only checks the client.
+func (mc *ManagerCtrl) rejectLockedOut(w http.ResponseWriter, ip, partyId string) bool {
+	wait := mc.ipGuard.lockedFor(ip)
+	if partyId != "" {
+		wait = max(wait, mc.partyGuard.lockedFor(partyId))
+	}
+	if wait == 0 {
+		return false
+	}
+	WriteError(w, http.StatusTooManyRequests, service.ErrTooManyAttempts.WithRetryAfter(wait))
+	return true
+}
+
+// Credentials whose failed checks are counted in the auth failure metrics.
+const (
+	credentialSecret      = "secret"
+	credentialAPIKey      = "api-key"
+	credentialToken       = "token"
+	credentialInvite      = "invite"
+	credentialDevice      = "device"
+	credentialCertificate = "certificate"
+)
+
+// recordFailure counts a failed secret check against the client and the
+// party, if one was named.
+func (mc *ManagerCtrl) recordFailure(ip, partyId, credential string) {
+	mc.metrics.AuthFailures.WithLabelValues(credential).Inc()
+	if lockout := mc.ipGuard.fail(ip); lockout > 0 {
+		mc.logger.WithField("ip", ip).WithField("lockout", lockout).Warn("locking out client after failed attempts")
+	}
+	if partyId == "" {
+		return
+	}
+	if lockout := mc.partyGuard.fail(partyId); lockout > 0 {
+		mc.logger.WithField("party", partyId).WithField("lockout", lockout).Warn("locking out party after failed attempts")
+	}
+}
+
+// recordSuccess clears the failures of the party. The client's failures are
+// kept until ResetAfter, so succeeding against a party it owns does not let a
+// client keep guessing the secrets of others.
+func (mc *ManagerCtrl) recordSuccess(partyId string) {
+	mc.partyGuard.succeed(partyId)
+}
@@ -0,0 +1,63 @@
+package manager
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// readinessTimeout bounds how long a readiness check waits for the database.
+const readinessTimeout = 2 * time.Second
+
+// Component statuses in health responses.
+const (
+	statusOK          = "ok"
+	statusUnavailable = "unavailable"
+	statusDraining    = "draining"
+)
+
+type ComponentStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type HealthResponse struct {
+	Status     string                     `json:"status"`
+	Components map[string]ComponentStatus `json:"components,omitempty"`
+}
+
+// Healthz reports that the process is alive.
+func (mc *ManagerCtrl) Healthz(w http.ResponseWriter, r *http.Request) {
+	WriteJson(w, http.StatusOK, HealthResponse{Status: statusOK})
+}
+
+// Readyz reports whether the server can take requests: the database answers
+// and the server is not shutting down. It answers 503 with the status of
+// each component otherwise.
+func (mc *ManagerCtrl) Readyz(w http.ResponseWriter, r *http.Request) {
+	resp := HealthResponse{
+		Status: statusOK,
+		Components: map[string]ComponentStatus{
+			"database": {Status: statusOK},
+			"server":   {Status: statusOK},
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+	if err := mc.store.Ping(ctx); err != nil {
+		mc.requestLogger(r).WithError(err).Warn("database is unavailable")
+		resp.Status = statusUnavailable
+		resp.Components["database"] = ComponentStatus{Status: statusUnavailable, Error: err.Error()}
+	}
+	if mc.Draining() {
+		resp.Status = statusUnavailable
+		resp.Components["server"] = ComponentStatus{Status: statusDraining}
+	}
+
+	status := http.StatusOK
+	if resp.Status != statusOK {
+		status = http.StatusServiceUnavailable
+	}
+	WriteJson(w, status, resp)
+}
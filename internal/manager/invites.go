@@ -0,0 +1,214 @@
+package manager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dino16m/clippa-server/internal/data"
+	"github.com/dino16m/clippa-server/internal/service"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	// invitePrefix starts every invite code.
+	invitePrefix = "inv_"
+	// defaultInviteTTL is how long an invite lasts when none is asked for.
+	defaultInviteTTL = 24 * time.Hour
+	// maxInviteTTL caps how long an invite can last.
+	maxInviteTTL = 30 * 24 * time.Hour
+)
+
+type InviteRequest struct {
+	// MaxUses is how many devices can redeem the invite. Defaults to 1.
+	MaxUses int `json:"maxUses"`
+	// ExpiresIn is how many seconds the invite lasts. Defaults to a day.
+	ExpiresIn int64 `json:"expiresIn"`
+	// Role is the role redeemers join with. Defaults to member.
+	Role service.Role `json:"role"`
+}
+
+type InviteResponse struct {
+	ID        uuid.UUID    `json:"id"`
+	Role      service.Role `json:"role"`
+	MaxUses   int          `json:"maxUses"`
+	Uses      int          `json:"uses"`
+	CreatedAt time.Time    `json:"createdAt"`
+	ExpiresAt time.Time    `json:"expiresAt"`
+	RevokedAt *time.Time   `json:"revokedAt,omitempty"`
+	// Code is only returned when the invite is created.
+	Code string `json:"code,omitempty"`
+}
+
+type RedeemInviteRequest struct {
+	Code string `json:"code"`
+}
+
+type RedeemInviteResponse struct {
+	Token   string       `json:"token"`
+	PartyID uuid.UUID    `json:"partyId"`
+	Role    service.Role `json:"role"`
+}
+
+func inviteResponse(invite data.Invite) InviteResponse {
+	return InviteResponse{
+		ID:        invite.ID,
+		Role:      service.Role(invite.Role),
+		MaxUses:   invite.MaxUses,
+		Uses:      invite.Uses,
+		CreatedAt: invite.CreatedAt,
+		ExpiresAt: invite.ExpiresAt,
+		RevokedAt: invite.RevokedAt,
+	}
+}
+
+// CreateInvite mints an invite code for the party.
+func (mc *ManagerCtrl) CreateInvite(w http.ResponseWriter, r *http.Request) {
+	granted, ok := mc.authorize(w, r, ScopeManageMembers)
+	if !ok {
+		return
+	}
+
+	var req InviteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteError(w, http.StatusBadRequest, service.ErrBadRequest.WithMessage("invalid request body"))
+		return
+	}
+	if req.MaxUses == 0 {
+		req.MaxUses = 1
+	}
+	ttl := time.Duration(req.ExpiresIn) * time.Second
+	if req.ExpiresIn == 0 {
+		ttl = defaultInviteTTL
+	}
+	if req.MaxUses < 0 || ttl < 0 || ttl > maxInviteTTL {
+		WriteError(w, http.StatusBadRequest, service.ErrBadRequest.WithMessage(fmt.Sprintf("maxUses must be positive and expiresIn at most %d seconds", int64(maxInviteTTL.Seconds()))))
+		return
+	}
+	role := service.RoleMember
+	if req.Role != "" {
+		var ok bool
+		if role, ok = service.ParseRole(string(req.Role)); !ok {
+			WriteError(w, http.StatusBadRequest, service.ErrBadRequest.WithMessage(fmt.Sprintf("unknown role %q", req.Role)))
+			return
+		}
+	}
+	if !granted.role().AtLeast(role) {
+		WriteError(w, http.StatusForbidden, service.ErrForbidden.WithMessage(fmt.Sprintf("cannot invite %s members", role)))
+		return
+	}
+
+	secret, err := SecureRandomString(24)
+	if err != nil {
+		mc.requestLogger(r).WithError(err).Error("failed to generate invite code")
+		WriteError(w, http.StatusInternalServerError, service.ErrInternal)
+		return
+	}
+	code := invitePrefix + secret
+	now := time.Now().UTC()
+	invite := data.Invite{
+		ID:        uuid.New(),
+		PartyID:   granted.party.ID,
+		Hash:      hashCredential(code),
+		Role:      string(role),
+		MaxUses:   req.MaxUses,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+	if err := mc.invites.Create(&invite); err != nil {
+		mc.requestLogger(r).WithError(err).WithField("party", granted.party.ID).Error("failed to create invite")
+		WriteError(w, http.StatusInternalServerError, service.ErrInternal)
+		return
+	}
+
+	resp := inviteResponse(invite)
+	resp.Code = code
+	WriteJson(w, http.StatusCreated, resp)
+}
+
+// ListInvites lists the party's invites, without their codes.
+func (mc *ManagerCtrl) ListInvites(w http.ResponseWriter, r *http.Request) {
+	granted, ok := mc.authorize(w, r, ScopeManageMembers)
+	if !ok {
+		return
+	}
+
+	invites, err := mc.invites.List(granted.party.ID.String())
+	if err != nil {
+		mc.requestLogger(r).WithError(err).WithField("party", granted.party.ID).Error("failed to list invites")
+		WriteError(w, http.StatusInternalServerError, service.ErrInternal)
+		return
+	}
+	resp := make([]InviteResponse, 0, len(invites))
+	for _, invite := range invites {
+		resp = append(resp, inviteResponse(invite))
+	}
+	WriteJson(w, http.StatusOK, resp)
+}
+
+// RevokeInvite revokes one of the party's invites.
+func (mc *ManagerCtrl) RevokeInvite(w http.ResponseWriter, r *http.Request) {
+	granted, ok := mc.authorize(w, r, ScopeManageMembers)
+	if !ok {
+		return
+	}
+
+	err := mc.invites.Revoke(granted.party.ID.String(), r.PathValue("inviteId"))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		WriteError(w, http.StatusNotFound, service.ErrNotFound.WithMessage("invite not found"))
+		return
+	}
+	if err != nil {
+		mc.requestLogger(r).WithError(err).WithField("party", granted.party.ID).Error("failed to revoke invite")
+		WriteError(w, http.StatusInternalServerError, service.ErrInternal)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RedeemInvite exchanges an invite code for a join token. It needs no other
+// credentials, so failed attempts count towards the client's lockout.
+func (mc *ManagerCtrl) RedeemInvite(w http.ResponseWriter, r *http.Request) {
+	ip := clientIP(r, mc.trustProxy)
+	if mc.rejectLockedOut(w, ip, "") {
+		return
+	}
+
+	var req RedeemInviteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Code) == "" {
+		WriteError(w, http.StatusBadRequest, service.ErrBadRequest.WithMessage("code is required"))
+		return
+	}
+	invite, err := mc.invites.Redeem(hashCredential(strings.TrimSpace(req.Code)))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		mc.requestLogger(r).WithField("ip", ip).Warn("invalid invite code")
+		mc.recordFailure(ip, "", credentialInvite)
+		WriteError(w, http.StatusUnauthorized, service.ErrUnauthorized.WithMessage("invalid, expired or used up invite"))
+		return
+	}
+	if err != nil {
+		mc.requestLogger(r).WithError(err).Error("failed to redeem invite")
+		WriteError(w, http.StatusInternalServerError, service.ErrInternal)
+		return
+	}
+	if _, err := mc.store.Get(invite.PartyID.String()); err != nil {
+		WriteError(w, http.StatusUnauthorized, service.ErrUnauthorized.WithMessage("invalid, expired or used up invite"))
+		return
+	}
+
+	role, ok := service.ParseRole(invite.Role)
+	if !ok {
+		role = service.RoleMember
+	}
+	partyId := invite.PartyID.String()
+	mc.requestLogger(r).WithField("party", partyId).WithField("invite", invite.ID).WithField("uses", invite.Uses).Info("redeemed invite")
+	WriteJson(w, http.StatusOK, RedeemInviteResponse{
+		Token:   mc.issueToken(membership{partyId: partyId, role: role}),
+		PartyID: invite.PartyID,
+		Role:    role,
+	})
+}
@@ -0,0 +1,128 @@
+package manager
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// requestIDHeader carries the ID of a request, from a proxy that set one or
+// else from the server, so log lines can be matched to it.
+const requestIDHeader = "X-Request-ID"
+
+// validRequestID limits the request IDs taken from clients to ones that are
+// safe to log.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// redactedParams are the query parameters that carry credentials: join
+// tokens and the IDs of HTTP transport sessions. Their values never reach the
+// logs. Secrets and API keys travel in headers, which are not logged.
+var redactedParams = []string{"token", "session"}
+
+type loggerKey struct{}
+
+// requestLogger returns the logger of r, carrying its request ID, or the
+// controller's logger for requests that did not go through RequestLogger.
+func (mc *ManagerCtrl) requestLogger(r *http.Request) *logrus.Entry {
+	if entry, ok := r.Context().Value(loggerKey{}).(*logrus.Entry); ok {
+		return entry
+	}
+	return logrus.NewEntry(mc.logger)
+}
+
+// requestID returns the ID RequestLogger gave r, if any.
+func requestID(r *http.Request) string {
+	if entry, ok := r.Context().Value(loggerKey{}).(*logrus.Entry); ok {
+		id, _ := entry.Data["request_id"].(string)
+		return id
+	}
+	return ""
+}
+
+// redactURL returns u for logging, with the values of redactedParams
+// replaced.
+func redactURL(u *url.URL) string {
+	query := u.Query()
+	redacted := false
+	for _, param := range redactedParams {
+		if query.Has(param) {
+			query.Set(param, "REDACTED")
+			redacted = true
+		}
+	}
+	if !redacted {
+		return u.RequestURI()
+	}
+	clean := *u
+	clean.RawQuery = query.Encode()
+	return clean.RequestURI()
+}
+
+// RequestLogger gives every request an ID, returned in the X-Request-ID
+// header and logged with every line logged for the request, and logs each
+// request once it is done with its status and latency.
+func RequestLogger(logger *logrus.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = uuid.New().String()
+		}
+		w.Header().Set(requestIDHeader, id)
+		entry := logger.WithField("request_id", id)
+
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), loggerKey{}, entry)))
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		entry.WithFields(logrus.Fields{
+			"method":     r.Method,
+			"url":        redactURL(r.URL),
+			"status":     recorder.status,
+			"latency_ms": time.Since(start).Milliseconds(),
+			"remote":     r.RemoteAddr,
+		}).Info("handled request")
+	})
+}
+
+// statusRecorder records the status of a response. Hijacked connections,
+// such as websockets, are recorded as switching protocols.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil && w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
@@ -5,14 +5,18 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"strings"
 	"time"
 
 	"github.com/coder/websocket"
+	"github.com/dino16m/clippa-server/internal/blob"
 	"github.com/dino16m/clippa-server/internal/data"
+	"github.com/dino16m/clippa-server/internal/metrics"
 	"github.com/dino16m/clippa-server/internal/service"
 	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -22,14 +26,146 @@ type ManagerCtrl struct {
 	logger        *logrus.Logger
 	authStore     *AuthService
 	partyProvider *service.PartyServiceProvider
+	blobs         *data.BlobStore
+	blobStorage   blob.Storage
+	blobConfig    BlobConfig
+	ipGuard       *attemptGuard
+	partyGuard    *attemptGuard
+	trustProxy    bool
+	compression   CompressionConfig
+	sessions      *sessions
+	apiKeys       *data.APIKeyStore
+	invites       *data.InviteStore
+	devices       *data.DeviceStore
+	challenges    *challenges
+	drain         drain
+	metrics       *metrics.Metrics
 }
 
-func NewManagerCtrl(store *data.PartyStore, logger *logrus.Logger) *ManagerCtrl {
+// Option configures a ManagerCtrl.
+type Option func(*managerOptions)
+
+type managerOptions struct {
+	partyOptions []service.Option
+	blobs        *data.BlobStore
+	blobStorage  blob.Storage
+	blobConfig   BlobConfig
+	ipGuard      GuardConfig
+	partyGuard   GuardConfig
+	trustProxy   bool
+	compression  CompressionConfig
+	apiKeys      *data.APIKeyStore
+	invites      *data.InviteStore
+	devices      *data.DeviceStore
+	registerer   prometheus.Registerer
+}
+
+// WithPartyOptions passes opts through to the PartyServiceProvider that hosts
+// the parties' websocket members.
+func WithPartyOptions(opts ...service.Option) Option {
+	return func(o *managerOptions) {
+		o.partyOptions = append(o.partyOptions, opts...)
+	}
+}
+
+// WithBlobs enables uploading large clipboard items to /parties/blobs. Blob
+// metadata is kept in records and contents in storage.
+func WithBlobs(records *data.BlobStore, storage blob.Storage, cfg BlobConfig) Option {
+	return func(o *managerOptions) {
+		o.blobs = records
+		o.blobStorage = storage
+		o.blobConfig = cfg
+	}
+}
+
+// WithBruteForceProtection replaces the default throttling of failed secret
+// checks per client IP and per party.
+func WithBruteForceProtection(ip, party GuardConfig) Option {
+	return func(o *managerOptions) {
+		o.ipGuard = ip
+		o.partyGuard = party
+	}
+}
+
+// WithTrustedProxy takes client addresses from X-Forwarded-For or X-Real-IP,
+// for deployments behind a reverse proxy.
+func WithTrustedProxy(trust bool) Option {
+	return func(o *managerOptions) {
+		o.trustProxy = trust
+	}
+}
+
+// WithCompression enables permessage-deflate on the join socket for clients
+// that support it.
+func WithCompression(cfg CompressionConfig) Option {
+	return func(o *managerOptions) {
+		o.compression = cfg
+	}
+}
+
+// WithAPIKeys enables party-scoped API keys, managed under /parties/keys and
+// presented as bearer tokens.
+func WithAPIKeys(keys *data.APIKeyStore) Option {
+	return func(o *managerOptions) {
+		o.apiKeys = keys
+	}
+}
+
+// WithInvites enables invite codes, minted under /parties/invites and
+// exchanged for join tokens without the party secret.
+func WithInvites(invites *data.InviteStore) Option {
+	return func(o *managerOptions) {
+		o.invites = invites
+	}
+}
+
+// WithDevices enables device enrolment under /parties/devices. Enrolled
+// devices own their member IDs and authenticate with their own keys.
+func WithDevices(devices *data.DeviceStore) Option {
+	return func(o *managerOptions) {
+		o.devices = devices
+	}
+}
+
+// WithMetrics registers the server's metrics with reg, for exporting them.
+func WithMetrics(reg prometheus.Registerer) Option {
+	return func(o *managerOptions) {
+		o.registerer = reg
+	}
+}
+
+func NewManagerCtrl(store *data.PartyStore, logger *logrus.Logger, opts ...Option) *ManagerCtrl {
+	options := managerOptions{
+		ipGuard:    DefaultIPGuardConfig(),
+		partyGuard: DefaultPartyGuardConfig(),
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	m := metrics.New(options.registerer)
+	partyOptions := []service.Option{service.WithMetrics(m)}
+	if options.blobs != nil {
+		partyOptions = append(partyOptions, service.WithBlobs(options.blobs))
+	}
+	partyOptions = append(partyOptions, options.partyOptions...)
 	return &ManagerCtrl{
 		store:         store,
 		logger:        logger,
 		authStore:     NewAuthService(),
-		partyProvider: service.NewPartyServiceProvider(store, logger),
+		partyProvider: service.NewPartyServiceProvider(store, logger, partyOptions...),
+		blobs:         options.blobs,
+		blobStorage:   options.blobStorage,
+		blobConfig:    options.blobConfig,
+		ipGuard:       newAttemptGuard(options.ipGuard),
+		partyGuard:    newAttemptGuard(options.partyGuard),
+		trustProxy:    options.trustProxy,
+		compression:   options.compression,
+		sessions:      newSessions(),
+		apiKeys:       options.apiKeys,
+		invites:       options.invites,
+		devices:       options.devices,
+		challenges:    newChallenges(),
+		metrics:       m,
 	}
 }
 
@@ -37,22 +173,24 @@ func (mc *ManagerCtrl) CreateParty(w http.ResponseWriter, r *http.Request) {
 
 	var req PartyCreateRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "invalid request body", http.StatusBadRequest)
+		WriteError(w, http.StatusBadRequest, service.ErrBadRequest.WithMessage("invalid request body"))
 		return
 	}
 
 	req.Name = strings.TrimSpace(req.Name)
 	req.Secret = strings.TrimSpace(req.Secret)
 	if req.Name == "" || req.Secret == "" {
-		http.Error(w, "name and secret are required", http.StatusBadRequest)
+		WriteError(w, http.StatusBadRequest, service.ErrBadRequest.WithMessage("name and secret are required"))
 		return
 	}
 
 	id := uuid.New()
+	start := time.Now()
 	hashed, err := bcrypt.GenerateFromPassword([]byte(req.Secret), bcrypt.DefaultCost)
+	mc.metrics.ObserveBcrypt("hash", start)
 	if err != nil {
-		mc.logger.WithError(err).Error("failed to hash secret")
-		http.Error(w, "internal error", http.StatusInternalServerError)
+		mc.requestLogger(r).WithError(err).Error("failed to hash secret")
+		WriteError(w, http.StatusInternalServerError, service.ErrInternal)
 		return
 	}
 
@@ -66,8 +204,8 @@ func (mc *ManagerCtrl) CreateParty(w http.ResponseWriter, r *http.Request) {
 	// generate a CA bundle for this party and store the CA cert/key
 	ca, err := generateCaBundle(req.Name)
 	if err != nil {
-		mc.logger.WithError(err).Error("failed to generate CA bundle")
-		http.Error(w, "internal error", http.StatusInternalServerError)
+		mc.requestLogger(r).WithError(err).Error("failed to generate CA bundle")
+		WriteError(w, http.StatusInternalServerError, service.ErrInternal)
 		return
 	}
 
@@ -75,10 +213,11 @@ func (mc *ManagerCtrl) CreateParty(w http.ResponseWriter, r *http.Request) {
 	party.KeyPEM = base64.StdEncoding.EncodeToString(ca.KeyPEM)
 
 	if err := mc.store.Create(&party); err != nil {
-		mc.logger.WithError(err).Error("failed to create party")
-		http.Error(w, "internal error", http.StatusInternalServerError)
+		mc.requestLogger(r).WithError(err).Error("failed to create party")
+		WriteError(w, http.StatusInternalServerError, service.ErrInternal)
 		return
 	}
+	mc.metrics.PartiesCreated.Inc()
 
 	resp := PartyResponse{
 		ID:            party.ID,
@@ -91,35 +230,88 @@ func (mc *ManagerCtrl) CreateParty(w http.ResponseWriter, r *http.Request) {
 }
 
 func (mc *ManagerCtrl) GetParty(w http.ResponseWriter, r *http.Request) {
-	req, err := getPartyRequest(r)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	party, err := mc.store.Get(req.ID)
-	if err != nil {
-		mc.logger.WithError(err).WithField("id", req.ID).Warn("party not found")
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
-		return
-	}
-
-	if err := bcrypt.CompareHashAndPassword([]byte(party.Password), []byte(req.Secret)); err != nil {
-		mc.logger.WithError(err).WithField("id", req.ID).Warn("invalid secret")
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	granted, ok := mc.authorize(w, r, ScopeReadCerts)
+	if !ok {
 		return
 	}
+	party := granted.party
 
 	resp := PartyResponse{
 		ID:            party.ID,
 		Name:          party.Name,
 		LeaderAddress: party.LeaderAddress,
 		CertPEM:       party.CertPEM,
-		KeyPEM:        party.KeyPEM,
+	}
+	// the CA key signs member certificates, so API keys never see it
+	if granted.key == nil {
+		resp.KeyPEM = party.KeyPEM
 	}
 	WriteJson(w, http.StatusOK, resp)
 }
 
+// DeleteParty deletes a party with everything it holds: its credentials,
+// devices, member roles and blobs. Its members are disconnected.
+func (mc *ManagerCtrl) DeleteParty(w http.ResponseWriter, r *http.Request) {
+	party, ok := mc.authorizeParty(w, r)
+	if !ok {
+		return
+	}
+	logger := mc.requestLogger(r).WithField("party", party.ID)
+
+	blobs, err := mc.store.Delete(party)
+	if err != nil {
+		logger.WithError(err).Error("failed to delete party")
+		WriteError(w, http.StatusInternalServerError, service.ErrInternal)
+		return
+	}
+	mc.authStore.ForgetParty(party.ID.String())
+	mc.partyProvider.CloseParty(party.ID.String(), service.ReasonPartyDeleted)
+	if mc.blobStorage != nil {
+		for _, record := range blobs {
+			if err := mc.blobStorage.Delete(r.Context(), blobKey(record.PartyID, record.ID)); err != nil {
+				logger.WithError(err).WithField("blob", record.ID).Error("failed to delete blob")
+			}
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// authorizeParty loads the party named by the id query parameter and checks
+// the X-Secret header against it, writing an error response if either fails.
+// Repeated failures lock the client and the party out for a while.
+func (mc *ManagerCtrl) authorizeParty(w http.ResponseWriter, r *http.Request) (*data.Party, bool) {
+	req, err := getPartyRequest(r)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, service.ErrBadRequest.WithMessage(err.Error()))
+		return nil, false
+	}
+
+	ip := clientIP(r, mc.trustProxy)
+	if mc.rejectLockedOut(w, ip, req.ID) {
+		return nil, false
+	}
+
+	party, err := mc.store.Get(req.ID)
+	if err != nil {
+		mc.requestLogger(r).WithError(err).WithField("party", req.ID).Warn("party not found")
+		mc.recordFailure(ip, req.ID, credentialSecret)
+		WriteError(w, http.StatusUnauthorized, service.ErrUnauthorized)
+		return nil, false
+	}
+
+	start := time.Now()
+	err = bcrypt.CompareHashAndPassword([]byte(party.Password), []byte(req.Secret))
+	mc.metrics.ObserveBcrypt("compare", start)
+	if err != nil {
+		mc.requestLogger(r).WithError(err).WithField("party", req.ID).Warn("invalid secret")
+		mc.recordFailure(ip, req.ID, credentialSecret)
+		WriteError(w, http.StatusUnauthorized, service.ErrUnauthorized)
+		return nil, false
+	}
+	mc.recordSuccess(req.ID)
+	return party, true
+}
+
 func getPartyRequest(r *http.Request) (GetPartyRequest, error) {
 	id := r.URL.Query().Get("id")
 	secret := r.Header.Get("X-Secret")
@@ -135,103 +327,159 @@ func getPartyRequest(r *http.Request) (GetPartyRequest, error) {
 }
 
 func (mc *ManagerCtrl) Authenticate(w http.ResponseWriter, r *http.Request) {
-	mc.logger.Info("authenticating")
+	mc.requestLogger(r).Debug("authenticating")
 
-	req, err := getPartyRequest(r)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	party, err := mc.store.Get(req.ID)
-	if err != nil {
-		mc.logger.WithError(err).WithField("id", req.ID).Warn("party not found")
-		http.Error(w, "invalid party", http.StatusUnauthorized)
+	granted, ok := mc.authorize(w, r, ScopeManageMembers)
+	if !ok {
 		return
 	}
-
-	if err := bcrypt.CompareHashAndPassword([]byte(party.Password), []byte(req.Secret)); err != nil {
-		mc.logger.WithError(err).WithField("id", req.ID).Warn("invalid secret")
-		http.Error(w, "invalid party", http.StatusUnauthorized)
-		return
+	party := granted.party
+
+	// tokens are issued as the caller's role unless a lower one is asked for
+	role := granted.role()
+	if name := strings.TrimSpace(r.URL.Query().Get("role")); name != "" {
+		requested, ok := service.ParseRole(name)
+		if !ok {
+			WriteError(w, http.StatusBadRequest, service.ErrBadRequest.WithMessage(fmt.Sprintf("unknown role %q", name)))
+			return
+		}
+		if !role.AtLeast(requested) {
+			WriteError(w, http.StatusForbidden, service.ErrForbidden.WithMessage(fmt.Sprintf("cannot issue %s tokens", requested)))
+			return
+		}
+		role = requested
 	}
 
-	token, _ := SecureRandomString(64)
-
-	mc.authStore.SaveToken(req.ID, token)
 	resp := AuthResponse{
-		Token: token,
+		Token: mc.issueToken(membership{partyId: party.ID.String(), role: role}),
 	}
 	WriteJson(w, http.StatusOK, resp)
 }
 
-func (mc *ManagerCtrl) validatePartyMembership(w http.ResponseWriter, r *http.Request) (string, error) {
+// issueToken returns a single-use token granting membership.
+func (mc *ManagerCtrl) issueToken(granted membership) string {
+	token, _ := SecureRandomString(64)
+	mc.authStore.SaveToken(token, granted)
+	return token
+}
+
+func (mc *ManagerCtrl) validatePartyMembership(w http.ResponseWriter, r *http.Request) (membership, error) {
 	// Validate token and party id from the websocket URL before upgrading
 	q := r.URL.Query()
 	token := strings.TrimSpace(q.Get("token"))
 	idFromURL := strings.TrimSpace(q.Get("id"))
 	if token == "" || idFromURL == "" {
-		http.Error(w, "token and id are required", http.StatusBadRequest)
-		return "", errors.New("token and id are required")
+		WriteError(w, http.StatusBadRequest, service.ErrBadRequest.WithMessage("token and id are required"))
+		return membership{}, errors.New("token and id are required")
 	}
 
 	storedPartyID := mc.authStore.GetPartyId(token)
 	if storedPartyID == "" {
-		mc.logger.WithField("token", token).Warn("invalid or expired token")
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
-		return "", errors.New("invalid or expired token")
+		mc.requestLogger(r).WithField("party", idFromURL).Warn("invalid or expired token")
+		mc.metrics.AuthFailures.WithLabelValues(credentialToken).Inc()
+		WriteError(w, http.StatusUnauthorized, service.ErrUnauthorized)
+		return membership{}, errors.New("invalid or expired token")
 	}
 
 	if storedPartyID != idFromURL {
-		mc.logger.WithField("token", token).WithField("expected", idFromURL).WithField("got", storedPartyID).Warn("token does not match party id")
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
-		return "", errors.New("token does not match party id")
+		mc.requestLogger(r).WithField("expected", idFromURL).WithField("got", storedPartyID).Warn("token does not match party id")
+		mc.metrics.AuthFailures.WithLabelValues(credentialToken).Inc()
+		WriteError(w, http.StatusUnauthorized, service.ErrUnauthorized)
+		return membership{}, errors.New("token does not match party id")
 	}
 
-	mc.authStore.DeleteToken(token)
-
-	return storedPartyID, nil
+	granted, ok := mc.authStore.Take(token)
+	if !ok {
+		// another join used the token in the meantime
+		WriteError(w, http.StatusUnauthorized, service.ErrUnauthorized)
+		return membership{}, errors.New("invalid or expired token")
+	}
+	granted.token = token
+	return granted, nil
 }
 
 func (mc *ManagerCtrl) JoinParty(w http.ResponseWriter, r *http.Request) {
+	if !mc.drain.enter() {
+		WriteError(w, http.StatusServiceUnavailable, service.ErrShuttingDown)
+		return
+	}
+	defer mc.drain.leave()
 
-	memberId := strings.TrimSpace(r.URL.Query().Get("memberId"))
-	if memberId == "" {
-		memberId = uuid.New().String()
+	requested, err := requestedProtocol(r)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	mode, err := requestedMode(r)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, err)
+		return
 	}
-	storedPartyID, err := mc.validatePartyMembership(w, r)
+	granted, err := mc.joinMembership(w, r)
 	if err != nil {
 		return
 	}
+	storedPartyID := granted.partyId
+	memberId, supersede, ok := mc.joinIdentity(w, r, granted)
+	if !ok {
+		return
+	}
+	logger := mc.requestLogger(r).WithField("party", storedPartyID).WithField("member", memberId)
 
-	conn, err := websocket.Accept(w, r, nil)
+	conn, err := websocket.Accept(countingWriter{w, mc.metrics}, r, &websocket.AcceptOptions{
+		Subprotocols:         requested.subprotocols(),
+		CompressionMode:      mc.compression.Mode,
+		CompressionThreshold: mc.compression.Threshold,
+	})
 	if err != nil {
-		mc.logger.WithError(err).Error("websocket accept failed")
+		logger.WithError(err).Error("websocket accept failed")
 		return
 	}
 	defer conn.Close(websocket.StatusNormalClosure, "")
-
-	partyHandle := mc.partyProvider.JoinParty(storedPartyID, memberId)
-	mc.logger.WithField("id", storedPartyID).Info("joined party with handle")
+	conn.SetReadLimit(mc.partyProvider.MaxFrameSize())
+
+	protocol := requested.negotiate(conn.Subprotocol())
+	partyHandle, err := mc.partyProvider.JoinParty(storedPartyID, memberId,
+		service.WithProtocolVersion(protocol.version),
+		service.WithCodec(protocol.codec),
+		service.WithRole(granted.role),
+		service.WithVerifiedIdentity(granted.memberId != ""),
+		service.WithMode(mode),
+		service.WithSupersede(supersede),
+		service.WithLogFields(logrus.Fields{"request_id": requestID(r)}),
+	)
+	if errors.Is(err, service.ErrShuttingDown) {
+		conn.Close(websocket.StatusGoingAway, err.Error())
+		return
+	}
+	if err != nil {
+		// another connection took the member ID, or one that may not be
+		// superseded, since it was checked
+		conn.Close(websocket.StatusPolicyViolation, err.Error())
+		return
+	}
+	logger.WithField("version", protocol.version).WithField("encoding", protocol.codec.Name()).Info("joined party with handle")
 	defer partyHandle.Leave()
+	defer mc.holdToken(granted, memberId)()
 	ctx := r.Context()
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	outbox := make(chan []byte)
+	outbox := make(chan service.Frame)
 
-	go func(conn *websocket.Conn, outbox chan<- []byte, ctx context.Context, cancel context.CancelFunc) {
+	go func(conn *websocket.Conn, outbox chan<- service.Frame, ctx context.Context, cancel context.CancelFunc) {
 		for {
 			select {
 			case <-ctx.Done():
 				return
 			default:
-				_, msg, err := conn.Read(ctx)
+				typ, msg, err := conn.Read(ctx)
 				if err != nil {
 					cancel()
 					return
 				}
-				outbox <- msg
+				mc.metrics.SocketMessageBytes.WithLabelValues("in").Add(float64(len(msg)))
+				outbox <- service.Frame{Binary: typ == websocket.MessageBinary, Data: msg}
 			}
 		}
 	}(conn, outbox, ctx, cancel)
@@ -242,33 +490,112 @@ func (mc *ManagerCtrl) JoinParty(w http.ResponseWriter, r *http.Request) {
 			return
 		case msg, ok := <-partyHandle.Inbox():
 			if !ok {
+				reason := partyHandle.CloseReason()
+				logger.WithField("reason", reason).Info("closing member connection")
+				conn.Close(closeStatus(reason), reason.String())
 				return
 			}
+			frame, err := partyHandle.Encode(msg)
+			if err != nil {
+				logger.WithError(err).Error("failed to encode frame")
+				continue
+			}
 			ctxWithTimeout, cancel := context.WithTimeout(ctx, 1*time.Second)
 			defer cancel()
-			if err := conn.Write(ctxWithTimeout, websocket.MessageText, msg); err != nil {
+			if err := conn.Write(ctxWithTimeout, frameType(frame), frame.Data); err != nil {
 				return
 			}
+			mc.metrics.SocketMessageBytes.WithLabelValues("out").Add(float64(len(frame.Data)))
 		case msg, ok := <-outbox:
 			if !ok {
 				return
 			}
-			err = partyHandle.HandleMessage(msg)
+			err = partyHandle.HandleFrame(msg)
 			if err != nil {
-				ctxWithTimeout, cancel := context.WithTimeout(ctx, 1*time.Second)
-				defer cancel()
-				conn.Write(ctxWithTimeout, websocket.MessageText, service.ErrorMessage(err.Error()))
+				if frame, encodeErr := partyHandle.Encode(service.TextFrame(service.ErrorMessageFor(err))); encodeErr == nil {
+					ctxWithTimeout, cancel := context.WithTimeout(ctx, 1*time.Second)
+					defer cancel()
+					conn.Write(ctxWithTimeout, frameType(frame), frame.Data)
+				}
+			}
+			if errors.Is(err, service.ErrRateLimitAbuse) {
+				logger.Warn("disconnecting member over rate limit")
+				conn.Close(closeStatus(service.ReasonRateLimited), service.ReasonRateLimited.String())
+				return
 			}
 		}
 	}
 }
 
+// closeStatus maps why a member was disconnected to the websocket close code
+// its connection is closed with. Codes 4000-4999 are reserved for
+// applications.
+func closeStatus(reason service.DisconnectReason) websocket.StatusCode {
+	switch reason {
+	case service.ReasonKicked:
+		return 4001
+	case service.ReasonPartyDeleted:
+		return 4002
+	case service.ReasonSlowConsumer:
+		return 4003
+	case service.ReasonAuthExpired:
+		return 4004
+	case service.ReasonRateLimited:
+		return websocket.StatusPolicyViolation
+	case service.ReasonSuperseded:
+		return 4005
+	case service.ReasonServerShutdown:
+		return websocket.StatusGoingAway
+	}
+	return websocket.StatusNormalClosure
+}
+
+func frameType(frame service.Frame) websocket.MessageType {
+	if frame.Binary {
+		return websocket.MessageBinary
+	}
+	return websocket.MessageText
+}
+
 func (mc *ManagerCtrl) RegisterRoutes(globalMux *http.ServeMux) {
 	localMux := http.NewServeMux()
 
 	localMux.HandleFunc("POST /", mc.CreateParty)
 	localMux.HandleFunc("GET /", mc.GetParty)
+	localMux.HandleFunc("DELETE /", mc.DeleteParty)
 	localMux.HandleFunc("GET /join", mc.JoinParty)
 	localMux.HandleFunc("GET /auth", mc.Authenticate)
+	localMux.HandleFunc("POST /clipboard", mc.PushClipboard)
+	localMux.HandleFunc("GET /members", mc.ListMembers)
+	localMux.HandleFunc("DELETE /members/{memberId}", mc.KickMember)
+	localMux.HandleFunc("PUT /members/{memberId}/mode", mc.SetMemberMode)
+	localMux.HandleFunc("PUT /members/{memberId}/role", mc.SetMemberRole)
+	localMux.HandleFunc("POST /sessions", mc.CreateSession)
+	localMux.HandleFunc("DELETE /sessions", mc.DeleteSession)
+	localMux.HandleFunc("GET /stream", mc.StreamSession)
+	localMux.HandleFunc("GET /messages", mc.PollSession)
+	localMux.HandleFunc("POST /messages", mc.PostMessage)
+	if mc.blobStorage != nil {
+		localMux.HandleFunc("POST /blobs", mc.UploadBlob)
+		localMux.HandleFunc("GET /blobs/{blobId}", mc.DownloadBlob)
+	}
+	if mc.apiKeys != nil {
+		localMux.HandleFunc("POST /keys", mc.CreateAPIKey)
+		localMux.HandleFunc("GET /keys", mc.ListAPIKeys)
+		localMux.HandleFunc("DELETE /keys/{keyId}", mc.RevokeAPIKey)
+	}
+	if mc.invites != nil {
+		localMux.HandleFunc("POST /invites", mc.CreateInvite)
+		localMux.HandleFunc("GET /invites", mc.ListInvites)
+		localMux.HandleFunc("DELETE /invites/{inviteId}", mc.RevokeInvite)
+		localMux.HandleFunc("POST /invites/redeem", mc.RedeemInvite)
+	}
+	if mc.devices != nil {
+		localMux.HandleFunc("POST /devices", mc.EnrolDevice)
+		localMux.HandleFunc("GET /devices", mc.ListDevices)
+		localMux.HandleFunc("DELETE /devices/{memberId}", mc.RemoveDevice)
+		localMux.HandleFunc("POST /devices/{memberId}/challenge", mc.DeviceChallenge)
+		localMux.HandleFunc("POST /devices/{memberId}/token", mc.DeviceToken)
+	}
 	globalMux.Handle("/parties/", http.StripPrefix("/parties", localMux))
 }
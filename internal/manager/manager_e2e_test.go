@@ -1,26 +1,51 @@
 package manager_test
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"math/big"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/coder/websocket"
+	"github.com/fxamacker/cbor/v2"
 	"github.com/glebarez/sqlite"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 	"gorm.io/gorm"
 
+	"github.com/dino16m/clippa-server/internal/blob"
 	"github.com/dino16m/clippa-server/internal/data"
 	"github.com/dino16m/clippa-server/internal/manager"
+	"github.com/dino16m/clippa-server/internal/service"
 )
 
-func createParty(t *testing.T, base, name, secret string) string {
+func createParty(t testing.TB, base, name, secret string) string {
 	t.Helper()
 	createReq := map[string]string{"name": name, "secret": secret}
 	b, _ := json.Marshal(createReq)
@@ -39,9 +64,16 @@ func createParty(t *testing.T, base, name, secret string) string {
 	return pr.ID.String()
 }
 
-func authenticate(t *testing.T, base, idStr, secret string) string {
+func authenticate(t testing.TB, base, idStr, secret string) string {
 	t.Helper()
-	req, err := http.NewRequest("GET", base+"/api/parties/auth?id="+idStr, nil)
+	return authenticateAs(t, base, idStr, secret, "")
+}
+
+// authenticateAs issues a join token with role, or the default role if role
+// is empty.
+func authenticateAs(t testing.TB, base, idStr, secret, role string) string {
+	t.Helper()
+	req, err := http.NewRequest("GET", base+"/api/parties/auth?id="+idStr+"&role="+role, nil)
 	if err != nil {
 		t.Fatalf("auth request creation: %v", err)
 	}
@@ -61,11 +93,16 @@ func authenticate(t *testing.T, base, idStr, secret string) string {
 	return ar.Token
 }
 
-func joinParty(t *testing.T, wsBase, idStr, token string) (*websocket.Conn, context.Context, context.CancelFunc) {
+func joinParty(t testing.TB, wsBase, idStr, token string) (*websocket.Conn, context.Context, context.CancelFunc) {
 	t.Helper()
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	u := wsBase + "/api/parties/join?id=" + url.QueryEscape(idStr) + "&token=" + url.QueryEscape(token)
-	wsConn, _, err := websocket.Dial(ctx, u, nil)
+	return dialParty(t, u, nil)
+}
+
+func dialParty(t testing.TB, u string, opts *websocket.DialOptions) (*websocket.Conn, context.Context, context.CancelFunc) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	wsConn, _, err := websocket.Dial(ctx, u, opts)
 	if err != nil {
 		cancel()
 		t.Fatalf("websocket dial: %v", err)
@@ -73,7 +110,7 @@ func joinParty(t *testing.T, wsBase, idStr, token string) (*websocket.Conn, cont
 	return wsConn, ctx, cancel
 }
 
-func setupServer(t *testing.T, mc *manager.ManagerCtrl) (base, wsBase string, shutdown func()) {
+func setupServer(t testing.TB, mc *manager.ManagerCtrl) (base, wsBase string, shutdown func()) {
 	t.Helper()
 
 	globalMux := http.NewServeMux()
@@ -81,6 +118,8 @@ func setupServer(t *testing.T, mc *manager.ManagerCtrl) (base, wsBase string, sh
 
 	topMux := http.NewServeMux()
 	topMux.Handle("/api/", http.StripPrefix("/api", globalMux))
+	topMux.HandleFunc("GET /healthz", mc.Healthz)
+	topMux.HandleFunc("GET /readyz", mc.Readyz)
 
 	ln, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
@@ -209,3 +248,2319 @@ func TestGetPartyRequiresCorrectSecret(t *testing.T) {
 		t.Fatalf("expected id %s, got %s", id, pr.ID.String())
 	}
 }
+
+func openDB(t testing.TB) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open("file::memory:?cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	if err := data.Migrate(db); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	return db
+}
+
+func startServer(t testing.TB, opts ...manager.Option) (base, wsBase string) {
+	t.Helper()
+	_, base, wsBase = startServerCtrl(t, opts...)
+	return base, wsBase
+}
+
+// startServerCtrl is startServer for tests that need the controller.
+func startServerCtrl(t testing.TB, opts ...manager.Option) (mc *manager.ManagerCtrl, base, wsBase string) {
+	t.Helper()
+	store := data.NewPartyStore(openDB(t))
+	logger := logrus.New()
+	mc = manager.NewManagerCtrl(store, logger, opts...)
+
+	base, wsBase, shutdown := setupServer(t, mc)
+	t.Cleanup(shutdown)
+	return mc, base, wsBase
+}
+
+// readMessageOfType reads from conn until a message of the given type arrives.
+func readMessageOfType(t testing.TB, ctx context.Context, conn *websocket.Conn, msgType string) map[string]any {
+	t.Helper()
+	for {
+		mt, msg, err := conn.Read(ctx)
+		if err != nil {
+			t.Fatalf("read waiting for %s: %v", msgType, err)
+		}
+		if mt == websocket.MessageBinary {
+			continue
+		}
+		var received map[string]any
+		if err := json.Unmarshal(msg, &received); err != nil {
+			t.Fatalf("unmarshal message: %v", err)
+		}
+		if received["messageType"] == msgType {
+			return received
+		}
+	}
+}
+
+func TestClipboardDeliveryReport(t *testing.T) {
+	base, wsBase := startServer(t)
+
+	id := createParty(t, base, "ack-party", "s3cr3t")
+	sender, ctx, cancel := joinParty(t, wsBase, id, authenticate(t, base, id, "s3cr3t"))
+	defer cancel()
+	defer sender.Close(websocket.StatusNormalClosure, "")
+	receiver, ctx2, cancel2 := joinParty(t, wsBase, id, authenticate(t, base, id, "s3cr3t"))
+	defer cancel2()
+	defer receiver.Close(websocket.StatusNormalClosure, "")
+
+	clip := `{"messageType":"clipboard","data":{"content":"hello"}}`
+	if err := sender.Write(ctx, websocket.MessageText, []byte(clip)); err != nil {
+		t.Fatalf("write clipboard: %v", err)
+	}
+
+	relayed := readMessageOfType(t, ctx2, receiver, "clipboard")
+	messageId, _ := relayed["id"].(string)
+	if messageId == "" {
+		t.Fatalf("expected relayed clipboard to carry a server id, got %v", relayed)
+	}
+
+	report := readMessageOfType(t, ctx, sender, "delivery-report")
+	data := report["data"].(map[string]any)
+	if data["messageId"] != messageId || data["delivered"] != float64(0) || data["total"] != float64(1) {
+		t.Fatalf("unexpected initial report: %v", data)
+	}
+
+	ack := fmt.Sprintf(`{"messageType":"ack","data":{"messageId":%q}}`, messageId)
+	if err := receiver.Write(ctx2, websocket.MessageText, []byte(ack)); err != nil {
+		t.Fatalf("write ack: %v", err)
+	}
+
+	report = readMessageOfType(t, ctx, sender, "delivery-report")
+	data = report["data"].(map[string]any)
+	if data["delivered"] != float64(1) || data["final"] != true {
+		t.Fatalf("expected final report with 1 delivery, got %v", data)
+	}
+}
+
+// binaryFrame lays out header and payload the way the server expects binary
+// clipboard frames: a big-endian uint32 header length, the header, the payload.
+func binaryFrame(header string, payload []byte) []byte {
+	frame := make([]byte, 4, 4+len(header)+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(header)))
+	frame = append(frame, header...)
+	return append(frame, payload...)
+}
+
+func TestBinaryClipboardRelay(t *testing.T) {
+	base, wsBase := startServer(t, manager.WithPartyOptions(service.WithClipboardLimit("text/*", 16)))
+
+	id := createParty(t, base, "binary-party", "s3cr3t")
+	sender, ctx, cancel := joinParty(t, wsBase, id, authenticate(t, base, id, "s3cr3t"))
+	defer cancel()
+	defer sender.Close(websocket.StatusNormalClosure, "")
+	receiver, ctx2, cancel2 := joinParty(t, wsBase, id, authenticate(t, base, id, "s3cr3t"))
+	defer cancel2()
+	defer receiver.Close(websocket.StatusNormalClosure, "")
+
+	png := []byte{0x89, 'P', 'N', 'G'}
+	header := `{"messageType":"clipboard","data":{"representations":[` +
+		`{"mimeType":"text/plain","content":"logo"},` +
+		`{"mimeType":"image/png","binary":true,"size":4}]}}`
+	if err := sender.Write(ctx, websocket.MessageBinary, binaryFrame(header, png)); err != nil {
+		t.Fatalf("write binary clipboard: %v", err)
+	}
+
+	mt, frame, err := receiver.Read(ctx2)
+	if err != nil {
+		t.Fatalf("read binary clipboard: %v", err)
+	}
+	if mt != websocket.MessageBinary {
+		t.Fatalf("expected binary frame, got %v", mt)
+	}
+	n := binary.BigEndian.Uint32(frame)
+	var relayed map[string]any
+	if err := json.Unmarshal(frame[4:4+n], &relayed); err != nil {
+		t.Fatalf("unmarshal relayed header: %v", err)
+	}
+	if relayed["messageType"] != "clipboard" || relayed["id"] == "" {
+		t.Fatalf("unexpected relayed header: %v", relayed)
+	}
+	if !bytes.Equal(frame[4+n:], png) {
+		t.Fatalf("payload mismatch: %v", frame[4+n:])
+	}
+
+	// text over the configured text/* limit is rejected
+	tooLong := `{"messageType":"clipboard","data":{"content":"this is more than sixteen bytes"}}`
+	if err := sender.Write(ctx, websocket.MessageText, []byte(tooLong)); err != nil {
+		t.Fatalf("write clipboard: %v", err)
+	}
+	readMessageOfType(t, ctx, sender, "error")
+}
+
+func TestChunkedClipboardTransfer(t *testing.T) {
+	base, wsBase := startServer(t)
+
+	id := createParty(t, base, "chunk-party", "s3cr3t")
+	sender, ctx, cancel := joinParty(t, wsBase, id, authenticate(t, base, id, "s3cr3t"))
+	defer cancel()
+	defer sender.Close(websocket.StatusNormalClosure, "")
+	receiver, ctx2, cancel2 := joinParty(t, wsBase, id, authenticate(t, base, id, "s3cr3t"))
+	defer cancel2()
+	defer receiver.Close(websocket.StatusNormalClosure, "")
+
+	content := []byte("0123456789")
+	sum := sha256.Sum256(content)
+	begin := fmt.Sprintf(`{"messageType":"clipboard-begin","data":{"transferId":"t1","mimeType":"application/octet-stream","totalSize":10,"chunkSize":4,"chunkCount":3,"checksum":%q}}`, hex.EncodeToString(sum[:]))
+	if err := sender.Write(ctx, websocket.MessageText, []byte(begin)); err != nil {
+		t.Fatalf("write begin: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		chunk := content[i*4 : min(len(content), (i+1)*4)]
+		header := fmt.Sprintf(`{"messageType":"clipboard-chunk","data":{"transferId":"t1","index":%d}}`, i)
+		if err := sender.Write(ctx, websocket.MessageBinary, binaryFrame(header, chunk)); err != nil {
+			t.Fatalf("write chunk %d: %v", i, err)
+		}
+	}
+	if err := sender.Write(ctx, websocket.MessageText, []byte(`{"messageType":"clipboard-end","data":{"transferId":"t1"}}`)); err != nil {
+		t.Fatalf("write end: %v", err)
+	}
+
+	readMessageOfType(t, ctx2, receiver, "clipboard-end")
+	for {
+		progress := readMessageOfType(t, ctx, sender, "clipboard-progress")
+		if progress["data"].(map[string]any)["complete"] == true {
+			break
+		}
+	}
+
+	// a late member asks for the whole transfer and gets it replayed
+	late, ctx3, cancel3 := joinParty(t, wsBase, id, authenticate(t, base, id, "s3cr3t"))
+	defer cancel3()
+	defer late.Close(websocket.StatusNormalClosure, "")
+	if err := late.Write(ctx3, websocket.MessageText, []byte(`{"messageType":"clipboard-missing","data":{"transferId":"t1"}}`)); err != nil {
+		t.Fatalf("write missing: %v", err)
+	}
+	var reassembled []byte
+	for {
+		mt, frame, err := late.Read(ctx3)
+		if err != nil {
+			t.Fatalf("read replay: %v", err)
+		}
+		if mt == websocket.MessageBinary {
+			n := binary.BigEndian.Uint32(frame)
+			reassembled = append(reassembled, frame[4+n:]...)
+			continue
+		}
+		var msg map[string]any
+		json.Unmarshal(frame, &msg)
+		if msg["messageType"] == "clipboard-end" {
+			break
+		}
+	}
+	if !bytes.Equal(reassembled, content) {
+		t.Fatalf("expected replayed content %q, got %q", content, reassembled)
+	}
+}
+
+func TestTransferLimits(t *testing.T) {
+	beginTransfer := func(t *testing.T, ctx context.Context, conn *websocket.Conn, transferId string) {
+		t.Helper()
+		sum := sha256.Sum256([]byte("0123456789"))
+		begin := fmt.Sprintf(`{"messageType":"clipboard-begin","data":{"transferId":%q,"mimeType":"text/plain","totalSize":10,"chunkSize":4,"chunkCount":3,"checksum":%q}}`, transferId, hex.EncodeToString(sum[:]))
+		if err := conn.Write(ctx, websocket.MessageText, []byte(begin)); err != nil {
+			t.Fatalf("write begin: %v", err)
+		}
+	}
+	askMissing := func(t *testing.T, ctx context.Context, conn *websocket.Conn, transferId string) map[string]any {
+		t.Helper()
+		missing := fmt.Sprintf(`{"messageType":"clipboard-missing","data":{"transferId":%q}}`, transferId)
+		if err := conn.Write(ctx, websocket.MessageText, []byte(missing)); err != nil {
+			t.Fatalf("write missing: %v", err)
+		}
+		for {
+			mt, frame, err := conn.Read(ctx)
+			if err != nil {
+				t.Fatalf("read replay: %v", err)
+			}
+			var msg map[string]any
+			if mt == websocket.MessageText && json.Unmarshal(frame, &msg) == nil &&
+				(msg["messageType"] == "clipboard-begin" || msg["messageType"] == "error") {
+				return msg
+			}
+		}
+	}
+	errorCode := func(msg map[string]any) any {
+		if msg["messageType"] != "error" {
+			return nil
+		}
+		return msg["data"].(map[string]any)["code"]
+	}
+
+	t.Run("cap and leave", func(t *testing.T) {
+		base, wsBase := startServer(t, manager.WithPartyOptions(service.WithTransferConcurrency(1, 0)))
+		id := createParty(t, base, "transfer-cap-party", "s3cr3t")
+		alice, ctxA, cancelA := joinPartyAs(t, wsBase, id, authenticate(t, base, id, "s3cr3t"), "alice")
+		defer cancelA()
+		bob, ctxB, cancelB := joinPartyAs(t, wsBase, id, authenticate(t, base, id, "s3cr3t"), "bob")
+		defer cancelB()
+		defer bob.Close(websocket.StatusNormalClosure, "")
+
+		beginTransfer(t, ctxA, alice, "t1")
+		beginTransfer(t, ctxA, alice, "t2")
+		if code := errorCode(readMessageOfType(t, ctxA, alice, "error")); code != "TOO_MANY_TRANSFERS" {
+			t.Fatalf("expected TOO_MANY_TRANSFERS past the cap, got %v", code)
+		}
+		if msg := askMissing(t, ctxB, bob, "t1"); msg["messageType"] != "clipboard-begin" {
+			t.Fatalf("expected the transfer to be replayed, got %v", msg)
+		}
+
+		// the transfers of a member that leaves are dropped
+		alice.Close(websocket.StatusNormalClosure, "")
+		readMessageOfType(t, ctxB, bob, "left")
+		if code := errorCode(askMissing(t, ctxB, bob, "t1")); code != "UNKNOWN_TRANSFER" {
+			t.Fatalf("expected the sender's transfer to be dropped, got %v", code)
+		}
+	})
+
+	t.Run("idle sweep", func(t *testing.T) {
+		base, wsBase := startServer(t, manager.WithPartyOptions(service.WithTransferRetention(50*time.Millisecond)))
+		id := createParty(t, base, "transfer-sweep-party", "s3cr3t")
+		alice, ctxA, cancelA := joinPartyAs(t, wsBase, id, authenticate(t, base, id, "s3cr3t"), "alice")
+		defer cancelA()
+		defer alice.Close(websocket.StatusNormalClosure, "")
+		bob, ctxB, cancelB := joinPartyAs(t, wsBase, id, authenticate(t, base, id, "s3cr3t"), "bob")
+		defer cancelB()
+		defer bob.Close(websocket.StatusNormalClosure, "")
+
+		beginTransfer(t, ctxA, alice, "idle")
+		readMessageOfType(t, ctxB, bob, "clipboard-begin")
+		// no other transfer begins, so only the sweep can drop it
+		time.Sleep(300 * time.Millisecond)
+		if code := errorCode(askMissing(t, ctxB, bob, "idle")); code != "UNKNOWN_TRANSFER" {
+			t.Fatalf("expected the idle transfer to be swept, got %v", code)
+		}
+	})
+}
+
+func TestBlobUploadAndRangeDownload(t *testing.T) {
+	storage, err := blob.NewFSStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("blob storage: %v", err)
+	}
+	base, _ := startServer(t, manager.WithBlobs(data.NewBlobStore(openDB(t)), storage, manager.BlobConfig{
+		MaxSize: 1 << 10,
+		Quota:   1 << 11,
+		TTL:     time.Hour,
+	}))
+	id := createParty(t, base, "blob-party", "s3cr3t")
+
+	upload := func(body []byte) *http.Response {
+		req, _ := http.NewRequest("POST", base+"/api/parties/blobs?id="+id, bytes.NewReader(body))
+		req.Header.Set("X-Secret", "s3cr3t")
+		req.Header.Set("Content-Type", "image/png")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("upload: %v", err)
+		}
+		return resp
+	}
+
+	content := bytes.Repeat([]byte("clippa"), 100)
+	resp := upload(content)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201 from upload, got %d", resp.StatusCode)
+	}
+	var br manager.BlobResponse
+	if err := json.NewDecoder(resp.Body).Decode(&br); err != nil {
+		t.Fatalf("decode upload resp: %v", err)
+	}
+	if br.Size != int64(len(content)) || br.URL == "" {
+		t.Fatalf("unexpected upload response: %+v", br)
+	}
+
+	req, _ := http.NewRequest("GET", base+br.URL, nil)
+	req.Header.Set("X-Secret", "s3cr3t")
+	req.Header.Set("Range", "bytes=6-11")
+	resp2, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("download: %v", err)
+	}
+	defer resp2.Body.Close()
+	body, _ := io.ReadAll(resp2.Body)
+	if resp2.StatusCode != http.StatusPartialContent || string(body) != "clippa" {
+		t.Fatalf("expected 206 with range content, got %d %q", resp2.StatusCode, body)
+	}
+	if ct := resp2.Header.Get("Content-Type"); ct != "image/png" {
+		t.Fatalf("expected image/png, got %s", ct)
+	}
+
+	// a blob over the per-blob limit is refused
+	resp3 := upload(make([]byte, 2<<10))
+	resp3.Body.Close()
+	if resp3.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413 for oversized blob, got %d", resp3.StatusCode)
+	}
+
+	// a fourth 600 byte blob exceeds the 2KiB party quota
+	upload(content).Body.Close()
+	upload(content).Body.Close()
+	resp4 := upload(content)
+	resp4.Body.Close()
+	if resp4.StatusCode != http.StatusInsufficientStorage {
+		t.Fatalf("expected 507 once over quota, got %d", resp4.StatusCode)
+	}
+}
+
+func TestBlobMemberAccess(t *testing.T) {
+	db := openDB(t)
+	storage, err := blob.NewFSStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("blob storage: %v", err)
+	}
+	// the expired token is polled for, which counts as failures
+	guard := manager.GuardConfig{MaxFailures: 1000, BaseLockout: time.Second, MaxLockout: time.Second, ResetAfter: time.Minute}
+	base, wsBase := startServer(t,
+		manager.WithInvites(data.NewInviteStore(db)),
+		manager.WithBlobs(data.NewBlobStore(db), storage, manager.BlobConfig{MaxSize: 1 << 10, Quota: 1 << 20, TTL: time.Hour}),
+		manager.WithBruteForceProtection(guard, guard),
+	)
+	uploadAs := func(partyId, token string) int {
+		t.Helper()
+		resp, err := http.Post(base+"/api/parties/blobs?id="+partyId+"&token="+url.QueryEscape(token), "text/plain", strings.NewReader("blob"))
+		if err != nil {
+			t.Fatalf("upload: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	upload := func(partyId string) manager.BlobResponse {
+		t.Helper()
+		req, _ := http.NewRequest("POST", base+"/api/parties/blobs?id="+partyId, strings.NewReader("blob"))
+		req.Header.Set("X-Secret", "s3cr3t")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil || resp.StatusCode != http.StatusCreated {
+			t.Fatalf("upload: %v %v", resp, err)
+		}
+		defer resp.Body.Close()
+		var br manager.BlobResponse
+		json.NewDecoder(resp.Body).Decode(&br)
+		return br
+	}
+	download := func(br manager.BlobResponse, token string) int {
+		t.Helper()
+		resp, err := http.Get(base + br.URL + "&token=" + url.QueryEscape(token))
+		if err != nil {
+			t.Fatalf("download: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	id := createParty(t, base, "member-blob-party", "s3cr3t")
+	other := createParty(t, base, "other-blob-party", "s3cr3t")
+	own, foreign := upload(id), upload(other)
+
+	req, _ := http.NewRequest("POST", base+"/api/parties/invites?id="+id, strings.NewReader(`{"role":"read-only"}`))
+	req.Header.Set("X-Secret", "s3cr3t")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("create invite: %v", err)
+	}
+	var invite manager.InviteResponse
+	json.NewDecoder(resp.Body).Decode(&invite)
+	resp.Body.Close()
+	resp, err = http.Post(base+"/api/parties/invites/redeem", "application/json", strings.NewReader(`{"code":"`+invite.Code+`"}`))
+	if err != nil {
+		t.Fatalf("redeem invite: %v", err)
+	}
+	var redeemed manager.RedeemInviteResponse
+	json.NewDecoder(resp.Body).Decode(&redeemed)
+	resp.Body.Close()
+
+	// the invited member downloads with the token it joined with
+	guest, ctxG, cancelG := joinPartyAs(t, wsBase, id, redeemed.Token, "guest")
+	defer cancelG()
+	if status := download(own, redeemed.Token); status != http.StatusOK {
+		t.Fatalf("expected a connected member to download, got %d", status)
+	}
+	if status := download(own, "not-a-token"); status != http.StatusUnauthorized {
+		t.Fatalf("expected an unknown token to be refused, got %d", status)
+	}
+	if status := download(foreign, redeemed.Token); status != http.StatusUnauthorized {
+		t.Fatalf("expected the token to be refused for another party, got %d", status)
+	}
+	crossed := own
+	crossed.URL = strings.Replace(own.URL, own.ID.String(), foreign.ID.String(), 1)
+	if status := download(crossed, redeemed.Token); status != http.StatusNotFound {
+		t.Fatalf("expected another party's blob to be out of reach, got %d", status)
+	}
+
+	// members upload with their token too, if they may send
+	senderToken := authenticate(t, base, id, "s3cr3t")
+	if status := uploadAs(id, senderToken); status != http.StatusForbidden {
+		t.Fatalf("expected a token not yet joined with to be refused, got %d", status)
+	}
+	if status := uploadAs(id, redeemed.Token); status != http.StatusForbidden {
+		t.Fatalf("expected a read-only member to be refused, got %d", status)
+	}
+
+	// clipboard items may only reference the party's own blobs
+	sender, ctxS, cancelS := joinPartyAs(t, wsBase, id, senderToken, "sender")
+	defer cancelS()
+	defer sender.Close(websocket.StatusNormalClosure, "")
+	if status := uploadAs(id, senderToken); status != http.StatusCreated {
+		t.Fatalf("expected a connected member to upload, got %d", status)
+	}
+	listenerToken := authenticate(t, base, id, "s3cr3t")
+	listener, _, cancelL := dialParty(t, wsBase+"/api/parties/join?id="+id+"&token="+url.QueryEscape(listenerToken)+"&memberId=listener&mode=receive-only", nil)
+	defer cancelL()
+	defer listener.Close(websocket.StatusNormalClosure, "")
+	if joined := readMessageOfType(t, ctxS, sender, "joined"); joined["sender"] != "listener" {
+		t.Fatalf("expected the listener to join, got %v", joined)
+	}
+	if status := uploadAs(id, listenerToken); status != http.StatusForbidden {
+		t.Fatalf("expected a receive-only member to be refused, got %d", status)
+	}
+	item := `{"messageType":"clipboard","data":{"representations":[{"mimeType":"image/png","blobId":%q}]}}`
+	if err := sender.Write(ctxS, websocket.MessageText, []byte(fmt.Sprintf(item, foreign.ID))); err != nil {
+		t.Fatalf("write clipboard: %v", err)
+	}
+	if code := readMessageOfType(t, ctxS, sender, "error")["data"].(map[string]any)["code"]; code != "INVALID_MESSAGE" {
+		t.Fatalf("expected a foreign blob to be refused, got %v", code)
+	}
+	if err := sender.Write(ctxS, websocket.MessageText, []byte(fmt.Sprintf(item, own.ID))); err != nil {
+		t.Fatalf("write clipboard: %v", err)
+	}
+	readMessageOfType(t, ctxG, guest, "clipboard")
+
+	// the token stops working once its member leaves
+	guest.Close(websocket.StatusNormalClosure, "")
+	deadline := time.Now().Add(5 * time.Second)
+	for download(own, redeemed.Token) != http.StatusUnauthorized {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the token to expire with its member")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBlobTokenLockout(t *testing.T) {
+	db := openDB(t)
+	storage, err := blob.NewFSStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("blob storage: %v", err)
+	}
+	guard := manager.GuardConfig{MaxFailures: 2, BaseLockout: time.Minute, MaxLockout: time.Hour, ResetAfter: time.Hour}
+	base, _ := startServer(t,
+		manager.WithBlobs(data.NewBlobStore(db), storage, manager.BlobConfig{MaxSize: 1 << 10, Quota: 1 << 20, TTL: time.Hour}),
+		manager.WithBruteForceProtection(guard, manager.DefaultPartyGuardConfig()),
+	)
+	id := createParty(t, base, "blob-lockout-party", "s3cr3t")
+
+	var statuses []int
+	for range 4 {
+		resp, err := http.Get(base + "/api/parties/blobs/00000000-0000-0000-0000-000000000000?id=" + id + "&token=guess")
+		if err != nil {
+			t.Fatalf("download: %v", err)
+		}
+		resp.Body.Close()
+		statuses = append(statuses, resp.StatusCode)
+	}
+	if !reflect.DeepEqual(statuses, []int{401, 401, 401, 429}) {
+		t.Fatalf("expected guessed tokens to be locked out, got %v", statuses)
+	}
+}
+
+func joinPartyAs(t testing.TB, wsBase, idStr, token, memberId string) (*websocket.Conn, context.Context, context.CancelFunc) {
+	t.Helper()
+	u := wsBase + "/api/parties/join?id=" + url.QueryEscape(idStr) + "&token=" + url.QueryEscape(token) + "&memberId=" + url.QueryEscape(memberId)
+	return dialParty(t, u, nil)
+}
+
+func TestEncryptedMessagesOnlyReachRecipients(t *testing.T) {
+	base, wsBase := startServer(t)
+	id := createParty(t, base, "e2ee-party", "s3cr3t")
+
+	alice, ctxA, cancelA := joinPartyAs(t, wsBase, id, authenticate(t, base, id, "s3cr3t"), "alice")
+	defer cancelA()
+	defer alice.Close(websocket.StatusNormalClosure, "")
+	bob, ctxB, cancelB := joinPartyAs(t, wsBase, id, authenticate(t, base, id, "s3cr3t"), "bob")
+	defer cancelB()
+	defer bob.Close(websocket.StatusNormalClosure, "")
+
+	announce := `{"messageType":"key-announce","data":{"keyId":"k-bob","algorithm":"x25519-xsalsa20-poly1305","publicKey":"AAECAw=="}}`
+	if err := bob.Write(ctxB, websocket.MessageText, []byte(announce)); err != nil {
+		t.Fatalf("write announce: %v", err)
+	}
+	readMessageOfType(t, ctxA, alice, "key-announce")
+
+	// a member joining later is sent the keys announced so far
+	carol, ctxC, cancelC := joinPartyAs(t, wsBase, id, authenticate(t, base, id, "s3cr3t"), "carol")
+	defer cancelC()
+	defer carol.Close(websocket.StatusNormalClosure, "")
+	readMessageOfType(t, ctxC, carol, "key-announce")
+
+	envelope := `{"messageType":"encrypted","data":{"keyId":"k-alice","nonce":"AAEC","ciphertext":"c2VhbGVk","recipients":[{"memberId":"carol","keyId":"k-carol","wrappedKey":"a2V5"}]}}`
+	if err := alice.Write(ctxA, websocket.MessageText, []byte(envelope)); err != nil {
+		t.Fatalf("write envelope: %v", err)
+	}
+	if err := alice.Write(ctxA, websocket.MessageText, []byte(`{"messageType":"ping"}`)); err != nil {
+		t.Fatalf("write ping: %v", err)
+	}
+
+	readMessageOfType(t, ctxC, carol, "encrypted")
+	// bob was not a recipient, so the ping sent after the envelope is the
+	// next thing he sees once carol's join notice is out of the way
+	readMessageOfType(t, ctxB, bob, "joined")
+	_, msg, err := bob.Read(ctxB)
+	if err != nil {
+		t.Fatalf("read bob: %v", err)
+	}
+	var next map[string]any
+	json.Unmarshal(msg, &next)
+	if next["messageType"] != "ping" {
+		t.Fatalf("expected ping, got %v", next)
+	}
+}
+
+func TestSenderIsStampedByServer(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		t.Run(fmt.Sprintf("strict=%v", strict), func(t *testing.T) {
+			base, wsBase := startServer(t, manager.WithPartyOptions(service.WithStrictSender(strict)))
+			id := createParty(t, base, "stamp-party", "s3cr3t")
+
+			alice, ctxA, cancelA := joinPartyAs(t, wsBase, id, authenticate(t, base, id, "s3cr3t"), "alice")
+			defer cancelA()
+			defer alice.Close(websocket.StatusNormalClosure, "")
+			bob, ctxB, cancelB := joinPartyAs(t, wsBase, id, authenticate(t, base, id, "s3cr3t"), "bob")
+			defer cancelB()
+			defer bob.Close(websocket.StatusNormalClosure, "")
+
+			spoofed := `{"messageType":"clipboard","sender":"bob","createdAt":1,"data":{"content":"hi"}}`
+			if err := alice.Write(ctxA, websocket.MessageText, []byte(spoofed)); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			if strict {
+				errMsg := readMessageOfType(t, ctxA, alice, "error")
+				if errMsg["data"].(map[string]any)["error"] != "SENDER_MISMATCH" {
+					t.Fatalf("expected SENDER_MISMATCH, got %v", errMsg)
+				}
+				return
+			}
+			relayed := readMessageOfType(t, ctxB, bob, "clipboard")
+			if relayed["sender"] != "alice" || relayed["createdAt"] == float64(1) {
+				t.Fatalf("expected sender and time stamped by the server, got %v", relayed)
+			}
+		})
+	}
+}
+
+func TestRateLimitedMemberIsDisconnected(t *testing.T) {
+	limits := service.DefaultRateLimits()
+	limits.PerType = map[service.MessageType]service.RateLimit{service.Ping: {Rate: 0.1, Burst: 1}}
+	limits.MaxViolations = 2
+	base, wsBase := startServer(t, manager.WithPartyOptions(service.WithRateLimits(limits)))
+	id := createParty(t, base, "rate-party", "s3cr3t")
+
+	conn, ctx, cancel := joinParty(t, wsBase, id, authenticate(t, base, id, "s3cr3t"))
+	defer cancel()
+	defer conn.Close(websocket.StatusNormalClosure, "")
+
+	ping := []byte(`{"messageType":"ping"}`)
+	for i := 0; i < 2; i++ {
+		if err := conn.Write(ctx, websocket.MessageText, ping); err != nil {
+			t.Fatalf("write ping %d: %v", i, err)
+		}
+	}
+	errMsg := readMessageOfType(t, ctx, conn, "error")
+	data := errMsg["data"].(map[string]any)
+	if data["error"] != "RATE_LIMITED" || data["retryAfter"].(float64) <= 0 {
+		t.Fatalf("expected RATE_LIMITED with retryAfter, got %v", data)
+	}
+
+	for i := 0; i < 2; i++ {
+		conn.Write(ctx, websocket.MessageText, ping)
+	}
+	for {
+		_, _, err := conn.Read(ctx)
+		if err == nil {
+			continue
+		}
+		if status := websocket.CloseStatus(err); status != websocket.StatusPolicyViolation {
+			t.Fatalf("expected policy violation close, got %v", err)
+		}
+		break
+	}
+}
+
+func TestRepeatedBadSecretsAreLockedOut(t *testing.T) {
+	guard := manager.GuardConfig{MaxFailures: 2, BaseLockout: time.Minute, MaxLockout: time.Hour, ResetAfter: time.Hour}
+	base, _ := startServer(t, manager.WithBruteForceProtection(guard, manager.DefaultPartyGuardConfig()))
+	id := createParty(t, base, "lockout-party", "correct-secret")
+
+	attempt := func(secret string) *http.Response {
+		req, _ := http.NewRequest("GET", base+"/api/parties/auth?id="+id, nil)
+		req.Header.Set("X-Secret", secret)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("auth request: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	for i := 0; i < 3; i++ {
+		if resp := attempt("bad-secret"); resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: expected 401, got %d", i, resp.StatusCode)
+		}
+	}
+	// locked out now, even with the right secret
+	resp := attempt("correct-secret")
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 while locked out, got %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Retry-After") != "60" {
+		t.Fatalf("expected Retry-After of 60s, got %q", resp.Header.Get("Retry-After"))
+	}
+}
+
+func TestDeletePartyRemovesCredentialsAndBlobs(t *testing.T) {
+	db := openDB(t)
+	blobDir := t.TempDir()
+	storage, err := blob.NewFSStorage(blobDir)
+	if err != nil {
+		t.Fatalf("blob storage: %v", err)
+	}
+	base, wsBase := startServer(t,
+		manager.WithAPIKeys(data.NewAPIKeyStore(db)),
+		manager.WithInvites(data.NewInviteStore(db)),
+		manager.WithBlobs(data.NewBlobStore(db), storage, manager.BlobConfig{MaxSize: 1 << 10, Quota: 1 << 20, TTL: time.Hour}),
+	)
+	id := createParty(t, base, "deleted-party", "s3cr3t")
+	do := func(method, path, body string, header http.Header) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, base+"/api/parties"+path, strings.NewReader(body))
+		req.Header = header
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	secret := http.Header{"X-Secret": {"s3cr3t"}}
+
+	var key manager.APIKeyResponse
+	json.NewDecoder(do("POST", "/keys?id="+id, `{"name":"ci","scopes":["read-certs"]}`, secret).Body).Decode(&key)
+	var invite manager.InviteResponse
+	json.NewDecoder(do("POST", "/invites?id="+id, `{}`, secret).Body).Decode(&invite)
+	if resp := do("POST", "/blobs?id="+id, "blob", secret); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201 uploading, got %d", resp.StatusCode)
+	}
+	token := authenticate(t, base, id, "s3cr3t")
+
+	if resp := do("DELETE", "/?id="+id, "", secret); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204 deleting the party, got %d", resp.StatusCode)
+	}
+	if err := db.Unscoped().First(&data.Party{}, "id = ?", id).Error; !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("expected the party row to be gone, got %v", err)
+	}
+
+	if resp := do("GET", "/?id="+id, "", http.Header{"Authorization": {"Bearer " + key.Key}}); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected the api key to be refused, got %d", resp.StatusCode)
+	}
+	if resp := do("POST", "/invites/redeem", `{"code":"`+invite.Code+`"}`, http.Header{}); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected the invite to be refused, got %d", resp.StatusCode)
+	}
+	_, resp, err := websocket.Dial(context.Background(), wsBase+"/api/parties/join?id="+id+"&token="+url.QueryEscape(token), nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected the join token to be refused, got %v %v", resp, err)
+	}
+	var left []string
+	filepath.WalkDir(blobDir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			left = append(left, path)
+		}
+		return nil
+	})
+	if len(left) > 0 {
+		t.Fatalf("expected the party's blobs to be removed, found %v", left)
+	}
+}
+
+func TestSuccessDoesNotClearClientLockout(t *testing.T) {
+	guard := manager.GuardConfig{MaxFailures: 2, BaseLockout: time.Minute, MaxLockout: time.Hour, ResetAfter: time.Hour}
+	base, _ := startServer(t, manager.WithBruteForceProtection(guard, manager.DefaultPartyGuardConfig()))
+	owned := createParty(t, base, "attacker-party", "own-secret")
+	target := createParty(t, base, "target-party", "target-secret")
+
+	attempt := func(id, secret string) int {
+		req, _ := http.NewRequest("GET", base+"/api/parties/?id="+id, nil)
+		req.Header.Set("X-Secret", secret)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("get party: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// guesses against the target alternate with successes on an owned party
+	for i := 0; i < 2; i++ {
+		if status := attempt(target, "guess"); status != http.StatusUnauthorized {
+			t.Fatalf("guess %d: expected 401, got %d", i, status)
+		}
+		if status := attempt(owned, "own-secret"); status != http.StatusOK {
+			t.Fatalf("success %d: expected 200, got %d", i, status)
+		}
+	}
+	attempt(target, "guess")
+	if status := attempt(target, "guess"); status != http.StatusTooManyRequests {
+		t.Fatalf("expected the client to be locked out, got %d", status)
+	}
+}
+
+func TestErrorsAreStructured(t *testing.T) {
+	base, wsBase := startServer(t)
+	id := createParty(t, base, "error-party", "s3cr3t")
+
+	req, _ := http.NewRequest("GET", base+"/api/parties/?id="+id, nil)
+	req.Header.Set("X-Secret", "wrong")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("get party: %v", err)
+	}
+	var httpErr map[string]any
+	json.NewDecoder(resp.Body).Decode(&httpErr)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized || httpErr["code"] != "UNAUTHORIZED" || httpErr["message"] == "" {
+		t.Fatalf("expected JSON UNAUTHORIZED error, got %d %v", resp.StatusCode, httpErr)
+	}
+
+	conn, ctx, cancel := joinParty(t, wsBase, id, authenticate(t, base, id, "s3cr3t"))
+	defer cancel()
+	defer conn.Close(websocket.StatusNormalClosure, "")
+
+	if err := conn.Write(ctx, websocket.MessageText, []byte(`{"id":"m-1","messageType":"clipboard-end","data":{"transferId":"nope"}}`)); err != nil {
+		t.Fatalf("write clipboard-end: %v", err)
+	}
+	data := readMessageOfType(t, ctx, conn, "error")["data"].(map[string]any)
+	if data["code"] != "UNKNOWN_TRANSFER" || data["messageId"] != "m-1" || data["retryable"] == true {
+		t.Fatalf("expected UNKNOWN_TRANSFER for m-1, got %v", data)
+	}
+
+	req, _ = http.NewRequest("DELETE", base+"/api/parties/?id="+id, nil)
+	req.Header.Set("X-Secret", "s3cr3t")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("delete party: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204 from delete, got %d", resp.StatusCode)
+	}
+	for {
+		_, _, err := conn.Read(ctx)
+		if err == nil {
+			continue
+		}
+		if status := websocket.CloseStatus(err); status != 4002 {
+			t.Fatalf("expected party deleted close code 4002, got %v", err)
+		}
+		break
+	}
+}
+
+func TestProtocolVersionNegotiation(t *testing.T) {
+	base, wsBase := startServer(t)
+	id := createParty(t, base, "version-party", "s3cr3t")
+	joinURL := func(token string) string {
+		return wsBase + "/api/parties/join?id=" + url.QueryEscape(id) + "&token=" + url.QueryEscape(token)
+	}
+
+	_, resp, err := websocket.Dial(context.Background(), joinURL(authenticate(t, base, id, "s3cr3t"))+"&version=99", nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for unsupported version, got %v", err)
+	}
+
+	conn, ctx, cancel := dialParty(t, joinURL(authenticate(t, base, id, "s3cr3t")), &websocket.DialOptions{Subprotocols: []string{"clippa.v2"}})
+	defer cancel()
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	if conn.Subprotocol() != "clippa.v2" {
+		t.Fatalf("expected clippa.v2 subprotocol, got %q", conn.Subprotocol())
+	}
+
+	_, first, err := conn.Read(ctx)
+	if err != nil {
+		t.Fatalf("read welcome: %v", err)
+	}
+	var welcome struct {
+		MessageType string              `json:"messageType"`
+		Data        service.WelcomeData `json:"data"`
+	}
+	json.Unmarshal(first, &welcome)
+	if welcome.MessageType != "welcome" || welcome.Data.Version != 2 || welcome.Data.MemberID == "" || len(welcome.Data.MessageTypes) == 0 {
+		t.Fatalf("expected welcome for version 2, got %s", first)
+	}
+
+	if err := conn.Write(ctx, websocket.MessageText, []byte(`{"id":"m-1","messageType":"teleport","data":{},"unknownField":true}`)); err != nil {
+		t.Fatalf("write unknown type: %v", err)
+	}
+	data := readMessageOfType(t, ctx, conn, "error")["data"].(map[string]any)
+	if data["code"] != "UNSUPPORTED_MESSAGE_TYPE" || data["messageId"] != "m-1" {
+		t.Fatalf("expected UNSUPPORTED_MESSAGE_TYPE for m-1, got %v", data)
+	}
+
+	// the query wins over offered subprotocols, and the handshake agrees
+	plain, ctx, cancel := dialParty(t, joinURL(authenticate(t, base, id, "s3cr3t"))+"&version=1&encoding=json", &websocket.DialOptions{Subprotocols: []string{"clippa.v3+cbor"}})
+	defer cancel()
+	defer plain.Close(websocket.StatusNormalClosure, "")
+	if plain.Subprotocol() != "" {
+		t.Fatalf("expected no subprotocol against the query, got %q", plain.Subprotocol())
+	}
+	if err := plain.Write(ctx, websocket.MessageText, []byte(`{"messageType":"teleport","data":{}}`)); err != nil {
+		t.Fatalf("write unknown type: %v", err)
+	}
+	// version 1 members only know INVALID_MESSAGE
+	if code := readMessageOfType(t, ctx, plain, "error")["data"].(map[string]any)["code"]; code != "INVALID_MESSAGE" {
+		t.Fatalf("expected a version 1 JSON error, got %v", code)
+	}
+	picked, _, cancel := dialParty(t, joinURL(authenticate(t, base, id, "s3cr3t"))+"&encoding=cbor", &websocket.DialOptions{Subprotocols: []string{"clippa.v3", "clippa.v2+cbor"}})
+	defer cancel()
+	defer picked.Close(websocket.StatusNormalClosure, "")
+	if picked.Subprotocol() != "clippa.v2+cbor" {
+		t.Fatalf("expected the subprotocol matching the query, got %q", picked.Subprotocol())
+	}
+}
+
+func readCBORMessageOfType(t *testing.T, ctx context.Context, conn *websocket.Conn, msgType string) map[string]any {
+	t.Helper()
+	for {
+		typ, frame, err := conn.Read(ctx)
+		if err != nil {
+			t.Fatalf("read waiting for %s: %v", msgType, err)
+		}
+		if typ != websocket.MessageBinary {
+			t.Fatalf("expected only binary frames, got %s", frame)
+		}
+		headerLen := binary.BigEndian.Uint32(frame[:4])
+		decMode, _ := cbor.DecOptions{DefaultMapType: reflect.TypeOf(map[string]any{})}.DecMode()
+		var msg map[string]any
+		if err := decMode.Unmarshal(frame[4:4+headerLen], &msg); err != nil {
+			t.Fatalf("decode cbor: %v", err)
+		}
+		if msg["messageType"] == msgType {
+			return msg
+		}
+	}
+}
+
+func TestCBORMembersInterworkWithJSONMembers(t *testing.T) {
+	base, wsBase := startServer(t)
+	id := createParty(t, base, "cbor-party", "s3cr3t")
+	joinURL := wsBase + "/api/parties/join?id=" + url.QueryEscape(id) + "&memberId=compact&token="
+
+	compact, ctx, cancel := dialParty(t, joinURL+url.QueryEscape(authenticate(t, base, id, "s3cr3t")), &websocket.DialOptions{Subprotocols: []string{"clippa.v2+cbor"}})
+	defer cancel()
+	defer compact.Close(websocket.StatusNormalClosure, "")
+	if compact.Subprotocol() != "clippa.v2+cbor" {
+		t.Fatalf("expected clippa.v2+cbor subprotocol, got %q", compact.Subprotocol())
+	}
+	readCBORMessageOfType(t, ctx, compact, "welcome")
+
+	plain, ctx2, cancel2 := joinPartyAs(t, wsBase, id, authenticate(t, base, id, "s3cr3t"), "plain")
+	defer cancel2()
+	defer plain.Close(websocket.StatusNormalClosure, "")
+	readCBORMessageOfType(t, ctx, compact, "joined")
+
+	header, _ := cbor.Marshal(map[string]any{
+		"messageType": "clipboard",
+		"data":        map[string]any{"content": "hello from cbor"},
+	})
+	if err := compact.Write(ctx, websocket.MessageBinary, binaryFrame(string(header), nil)); err != nil {
+		t.Fatalf("write cbor clipboard: %v", err)
+	}
+
+	clip := readMessageOfType(t, ctx2, plain, "clipboard")
+	if clip["sender"] != "compact" || clip["data"].(map[string]any)["content"] != "hello from cbor" {
+		t.Fatalf("expected transcoded clipboard, got %v", clip)
+	}
+	ack := fmt.Sprintf(`{"messageType":"ack","data":{"messageId":%q}}`, clip["id"])
+	if err := plain.Write(ctx2, websocket.MessageText, []byte(ack)); err != nil {
+		t.Fatalf("write ack: %v", err)
+	}
+
+	for {
+		report := readCBORMessageOfType(t, ctx, compact, "delivery-report")
+		data := report["data"].(map[string]any)
+		if data["final"] == true {
+			if data["delivered"] != uint64(1) {
+				t.Fatalf("expected integer delivered count of 1, got %#v", data["delivered"])
+			}
+			break
+		}
+	}
+
+	// data is decoded into its message type, so CBOR the server does not
+	// look at, such as maps with integer keys, does not get in the way
+	header, _ = cbor.Marshal(map[string]any{
+		"messageType": "clipboard",
+		"data":        map[string]any{"content": "typed", "extension": map[int]string{1: "one"}},
+	})
+	if err := compact.Write(ctx, websocket.MessageBinary, binaryFrame(string(header), nil)); err != nil {
+		t.Fatalf("write cbor clipboard: %v", err)
+	}
+	if clip := readMessageOfType(t, ctx2, plain, "clipboard"); clip["data"].(map[string]any)["content"] != "typed" {
+		t.Fatalf("expected the clipboard to be relayed, got %v", clip)
+	}
+}
+
+// compressibleText is clipboard text of roughly size bytes, as repetitive as
+// copied logs or source code.
+func compressibleText(size int) string {
+	var b bytes.Buffer
+	for i := 0; b.Len() < size; i++ {
+		fmt.Fprintf(&b, "%04d INFO request handled path=/api/parties/join status=101 duration=%dms\n", i, i%97)
+	}
+	return b.String()[:size]
+}
+
+// relayClipboard sends content from sender and waits until receiver gets it.
+func relayClipboard(t testing.TB, ctx context.Context, sender, receiver *websocket.Conn, content string) {
+	t.Helper()
+	msg, _ := json.Marshal(map[string]any{"messageType": "clipboard", "data": map[string]any{"content": content}})
+	if err := sender.Write(ctx, websocket.MessageText, msg); err != nil {
+		t.Fatalf("write clipboard: %v", err)
+	}
+	readMessageOfType(t, ctx, receiver, "clipboard")
+}
+
+// joinCompressed joins two members negotiating mode and drains the sender's
+// delivery reports in the background.
+func joinCompressed(t testing.TB, base, wsBase string, mode websocket.CompressionMode) (sender, receiver *websocket.Conn, ctx context.Context) {
+	t.Helper()
+	id := createParty(t, base, "compressed-party", "s3cr3t")
+	joinURL := func(memberId string) string {
+		return wsBase + "/api/parties/join?id=" + url.QueryEscape(id) + "&memberId=" + memberId + "&token=" + url.QueryEscape(authenticate(t, base, id, "s3cr3t"))
+	}
+	opts := &websocket.DialOptions{CompressionMode: mode}
+	sender, ctx, cancel := dialParty(t, joinURL("sender"), opts)
+	t.Cleanup(cancel)
+	receiver, _, cancel2 := dialParty(t, joinURL("receiver"), opts)
+	t.Cleanup(cancel2)
+	receiver.SetReadLimit(-1)
+	t.Cleanup(func() {
+		sender.Close(websocket.StatusNormalClosure, "")
+		receiver.Close(websocket.StatusNormalClosure, "")
+	})
+	readMessageOfType(t, ctx, sender, "joined")
+	go func() {
+		for {
+			if _, _, err := sender.Read(ctx); err != nil {
+				return
+			}
+		}
+	}()
+	return sender, receiver, ctx
+}
+
+// socketBytes reads the websocket byte counters of reg.
+func socketBytes(t testing.TB, reg *prometheus.Registry) (messageOut, wireIn, wireOut float64) {
+	t.Helper()
+	return gathered(t, reg, "clippa_websocket_message_bytes_total", "direction", "out"),
+		gathered(t, reg, "clippa_websocket_wire_bytes_total", "direction", "in"),
+		gathered(t, reg, "clippa_websocket_wire_bytes_total", "direction", "out")
+}
+
+func TestCompressionReducesWireBytes(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	base, wsBase := startServer(t,
+		manager.WithCompression(manager.CompressionConfig{Mode: websocket.CompressionContextTakeover}),
+		manager.WithMetrics(reg),
+	)
+	sender, receiver, ctx := joinCompressed(t, base, wsBase, websocket.CompressionContextTakeover)
+
+	_, wireInBefore, _ := socketBytes(t, reg)
+	relayClipboard(t, ctx, sender, receiver, compressibleText(256<<10))
+	messageOut, wireIn, wireOut := socketBytes(t, reg)
+
+	if uploaded := wireIn - wireInBefore; uploaded <= 0 || uploaded > 64<<10 {
+		t.Fatalf("expected the upload to be compressed below 64KiB, got %v bytes", uploaded)
+	}
+	if ratio := wireOut / messageOut; ratio >= 0.5 {
+		t.Fatalf("expected a compression ratio below 0.5, got %.2f (%v wire bytes for %v message bytes)", ratio, wireOut, messageOut)
+	}
+}
+
+func BenchmarkClipboardCompression(b *testing.B) {
+	modes := []struct {
+		name string
+		mode websocket.CompressionMode
+	}{
+		{"disabled", websocket.CompressionDisabled},
+		{"context-takeover", websocket.CompressionContextTakeover},
+		{"no-context-takeover", websocket.CompressionNoContextTakeover},
+	}
+	for _, size := range []int{4 << 10, 64 << 10, 512 << 10} {
+		content := compressibleText(size)
+		for _, m := range modes {
+			b.Run(fmt.Sprintf("%s/%dKiB", m.name, size>>10), func(b *testing.B) {
+				reg := prometheus.NewRegistry()
+				base, wsBase := startServer(b,
+					manager.WithCompression(manager.CompressionConfig{Mode: m.mode}),
+					manager.WithPartyOptions(service.WithRateLimits(service.RateLimits{})),
+					manager.WithMetrics(reg),
+				)
+				sender, receiver, ctx := joinCompressed(b, base, wsBase, m.mode)
+				_, wireInBefore, wireOutBefore := socketBytes(b, reg)
+				b.SetBytes(int64(size))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					relayClipboard(b, ctx, sender, receiver, content)
+				}
+				b.StopTimer()
+				messageOut, wireIn, wireOut := socketBytes(b, reg)
+				b.ReportMetric((wireIn-wireInBefore+wireOut-wireOutBefore)/float64(b.N), "wire-B/op")
+				b.ReportMetric(wireOut/messageOut, "wire/msg")
+			})
+		}
+	}
+}
+
+type sseEvent struct {
+	event string
+	data  string
+}
+
+// readEvent reads the next server-sent event, skipping comments.
+func readEvent(t testing.TB, r *bufio.Reader) sseEvent {
+	t.Helper()
+	var ev sseEvent
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read event: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && ev.data != "":
+			return ev
+		case strings.HasPrefix(line, "event: "):
+			ev.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			ev.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+// readEventOfType reads events until a message of the given type arrives.
+func readEventOfType(t testing.TB, r *bufio.Reader, msgType string) map[string]any {
+	t.Helper()
+	for {
+		ev := readEvent(t, r)
+		if ev.event != "" {
+			continue
+		}
+		var msg map[string]any
+		if err := json.Unmarshal([]byte(ev.data), &msg); err != nil {
+			t.Fatalf("unmarshal event %q: %v", ev.data, err)
+		}
+		if msg["messageType"] == msgType {
+			return msg
+		}
+	}
+}
+
+func postMessage(t testing.TB, base, sessionId, msg string) *http.Response {
+	t.Helper()
+	resp, err := http.Post(base+"/api/parties/messages?session="+url.QueryEscape(sessionId), "application/json", strings.NewReader(msg))
+	if err != nil {
+		t.Fatalf("post message: %v", err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestEventStreamMembersInteroperateWithWebsocketMembers(t *testing.T) {
+	base, wsBase := startServer(t)
+	id := createParty(t, base, "sse-party", "s3cr3t")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	streamURL := base + "/api/parties/stream?id=" + url.QueryEscape(id) + "&memberId=sse&token=" + url.QueryEscape(authenticate(t, base, id, "s3cr3t"))
+	req, _ := http.NewRequestWithContext(ctx, "GET", streamURL, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("open stream: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("expected an event stream, got %q", resp.Header.Get("Content-Type"))
+	}
+	stream := bufio.NewReader(resp.Body)
+	announce := readEvent(t, stream)
+	var sess manager.SessionResponse
+	if err := json.Unmarshal([]byte(announce.data), &sess); announce.event != "session" || err != nil || sess.MemberID != "sse" {
+		t.Fatalf("expected session event, got %+v", announce)
+	}
+
+	conn, wsCtx, wsCancel := joinPartyAs(t, wsBase, id, authenticate(t, base, id, "s3cr3t"), "ws")
+	defer wsCancel()
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	readEventOfType(t, stream, "joined")
+
+	if err := conn.Write(wsCtx, websocket.MessageText, []byte(`{"messageType":"clipboard","data":{"content":"to sse"}}`)); err != nil {
+		t.Fatalf("write clipboard: %v", err)
+	}
+	clip := readEventOfType(t, stream, "clipboard")
+	if clip["sender"] != "ws" || clip["data"].(map[string]any)["content"] != "to sse" {
+		t.Fatalf("expected clipboard from ws, got %v", clip)
+	}
+	if resp := postMessage(t, base, sess.SessionID, fmt.Sprintf(`{"messageType":"ack","data":{"messageId":%q}}`, clip["id"])); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected 202 for ack, got %d", resp.StatusCode)
+	}
+	report := readMessageOfType(t, wsCtx, conn, "delivery-report")
+	for report["data"].(map[string]any)["final"] != true {
+		report = readMessageOfType(t, wsCtx, conn, "delivery-report")
+	}
+
+	if resp := postMessage(t, base, sess.SessionID, `{"messageType":"clipboard","data":{"content":"from sse"}}`); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected 202 for clipboard, got %d", resp.StatusCode)
+	}
+	got := readMessageOfType(t, wsCtx, conn, "clipboard")
+	if got["sender"] != "sse" || got["data"].(map[string]any)["content"] != "from sse" {
+		t.Fatalf("expected clipboard from sse, got %v", got)
+	}
+	readEventOfType(t, stream, "delivery-report")
+
+	if resp := postMessage(t, base, sess.SessionID, `{"messageType":"clipboard-end","data":{"transferId":"nope"}}`); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for unknown transfer, got %d", resp.StatusCode)
+	}
+}
+
+func TestLongPollMembers(t *testing.T) {
+	base, wsBase := startServer(t)
+	id := createParty(t, base, "poll-party", "s3cr3t")
+
+	resp, err := http.Post(base+"/api/parties/sessions?id="+url.QueryEscape(id)+"&token="+url.QueryEscape(authenticate(t, base, id, "s3cr3t")), "application/json", nil)
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	var sess manager.SessionResponse
+	json.NewDecoder(resp.Body).Decode(&sess)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || sess.SessionID == "" {
+		t.Fatalf("expected 201 with a session, got %d", resp.StatusCode)
+	}
+	poll := func() (int, manager.PollResponse) {
+		resp, err := http.Get(base + "/api/parties/messages?session=" + url.QueryEscape(sess.SessionID))
+		if err != nil {
+			t.Fatalf("poll: %v", err)
+		}
+		defer resp.Body.Close()
+		var polled manager.PollResponse
+		json.NewDecoder(resp.Body).Decode(&polled)
+		return resp.StatusCode, polled
+	}
+
+	conn, ctx, cancel := joinPartyAs(t, wsBase, id, authenticate(t, base, id, "s3cr3t"), "ws")
+	defer cancel()
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	if err := conn.Write(ctx, websocket.MessageText, []byte(`{"messageType":"clipboard","data":{"content":"polled"}}`)); err != nil {
+		t.Fatalf("write clipboard: %v", err)
+	}
+
+	var types []string
+	for len(types) < 2 {
+		status, polled := poll()
+		if status != http.StatusOK {
+			t.Fatalf("expected 200 from poll, got %d", status)
+		}
+		for _, ev := range polled.Events {
+			var msg service.Message[json.RawMessage]
+			json.Unmarshal(ev.Message, &msg)
+			types = append(types, string(msg.MessageType))
+		}
+	}
+	if types[0] != "joined" || types[1] != "clipboard" {
+		t.Fatalf("expected joined then clipboard, got %v", types)
+	}
+
+	req, _ := http.NewRequest("DELETE", base+"/api/parties/?id="+url.QueryEscape(id), nil)
+	req.Header.Set("X-Secret", "s3cr3t")
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete party: %v", err)
+	}
+	if status, _ := poll(); status != http.StatusGone {
+		t.Fatalf("expected 410 once the party is deleted, got %d", status)
+	}
+}
+
+func TestKickedSessionCannotPost(t *testing.T) {
+	base, _ := startServer(t)
+	id := createParty(t, base, "kicked-poll-party", "s3cr3t")
+
+	resp, err := http.Post(base+"/api/parties/sessions?id="+url.QueryEscape(id)+"&memberId=poller&token="+url.QueryEscape(authenticate(t, base, id, "s3cr3t")), "application/json", nil)
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	var sess manager.SessionResponse
+	json.NewDecoder(resp.Body).Decode(&sess)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201 with a session, got %d", resp.StatusCode)
+	}
+
+	req, _ := http.NewRequest("DELETE", base+"/api/parties/members/poller?id="+url.QueryEscape(id), nil)
+	req.Header.Set("X-Secret", "s3cr3t")
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("kick member: %v", err)
+	}
+
+	resp, err = http.Post(base+"/api/parties/messages?session="+url.QueryEscape(sess.SessionID), "application/json", strings.NewReader(`{"messageType":"clipboard","data":{"content":"after kick"}}`))
+	if err != nil {
+		t.Fatalf("post message: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGone {
+		t.Fatalf("expected 410 once kicked, got %d", resp.StatusCode)
+	}
+}
+
+func TestPushClipboardOverHTTP(t *testing.T) {
+	base, wsBase := startServer(t)
+	id := createParty(t, base, "push-party", "s3cr3t")
+	push := func(contentType, body string) (*http.Response, service.PushResult) {
+		req, _ := http.NewRequest("POST", base+"/api/parties/clipboard?sender=ci&id="+url.QueryEscape(id), strings.NewReader(body))
+		req.Header.Set("X-Secret", "s3cr3t")
+		req.Header.Set("Content-Type", contentType)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("push clipboard: %v", err)
+		}
+		defer resp.Body.Close()
+		var result service.PushResult
+		json.NewDecoder(resp.Body).Decode(&result)
+		return resp, result
+	}
+
+	if resp, result := push("text/plain", "nobody home"); resp.StatusCode != http.StatusOK || result.Delivered != 0 {
+		t.Fatalf("expected 200 with no recipients, got %d %+v", resp.StatusCode, result)
+	}
+
+	conn, ctx, cancel := joinPartyAs(t, wsBase, id, authenticate(t, base, id, "s3cr3t"), "laptop")
+	defer cancel()
+	defer conn.Close(websocket.StatusNormalClosure, "")
+
+	resp, result := push("text/plain; charset=utf-8", "build 42 passed")
+	if resp.StatusCode != http.StatusOK || result.Delivered != 1 || result.Recipients[0] != "laptop" {
+		t.Fatalf("expected delivery to laptop, got %d %+v", resp.StatusCode, result)
+	}
+	clip := readMessageOfType(t, ctx, conn, "clipboard")
+	if clip["sender"] != "api:ci" || clip["id"] != result.MessageID || clip["data"].(map[string]any)["content"] != "build 42 passed" {
+		t.Fatalf("expected pushed clipboard, got %v", clip)
+	}
+
+	if resp, _ := push("application/json", `{"representations":[{"mimeType":"text/html","content":"<b>hi</b>"}]}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 for JSON item, got %d", resp.StatusCode)
+	}
+	if resp, _ := push("image/png", "\x89PNG"); resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Fatalf("expected 415 for binary body, got %d", resp.StatusCode)
+	}
+}
+
+func TestScopedAPIKeys(t *testing.T) {
+	db := openDB(t)
+	base, _ := startServer(t, manager.WithAPIKeys(data.NewAPIKeyStore(db)))
+	id := createParty(t, base, "keys-party", "s3cr3t")
+	do := func(method, path, key, body string) *http.Response {
+		req, _ := http.NewRequest(method, base+"/api/parties"+path, strings.NewReader(body))
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		} else {
+			req.Header.Set("X-Secret", "s3cr3t")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	resp := do("POST", "/keys?id="+id, "", `{"name":"ci","scopes":["push-clipboard","read-certs"]}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201 creating key, got %d", resp.StatusCode)
+	}
+	var created manager.APIKeyResponse
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil || !strings.HasPrefix(created.Key, "clp_") {
+		t.Fatalf("expected key in response, got %+v (%v)", created, err)
+	}
+	if resp := do("POST", "/keys?id="+id, "", `{"name":"bad","scopes":["everything"]}`); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for unknown scope, got %d", resp.StatusCode)
+	}
+
+	if resp := do("POST", "/clipboard", created.Key, "from ci"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected push with key to succeed, got %d", resp.StatusCode)
+	}
+	resp = do("GET", "/?id="+id, created.Key, "")
+	var party manager.PartyResponse
+	json.NewDecoder(resp.Body).Decode(&party)
+	if resp.StatusCode != http.StatusOK || party.CertPEM == "" || party.KeyPEM != "" {
+		t.Fatalf("expected cert without key, got %d %+v", resp.StatusCode, party)
+	}
+	if resp := do("GET", "/auth", created.Key, ""); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 without manage-members, got %d", resp.StatusCode)
+	}
+	other := createParty(t, base, "other-party", "s3cr3t")
+	if resp := do("POST", "/clipboard?id="+other, created.Key, "elsewhere"); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for another party, got %d", resp.StatusCode)
+	}
+	if resp := do("GET", "/keys?id="+id, created.Key, ""); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected key management to require the secret, got %d", resp.StatusCode)
+	}
+
+	resp = do("GET", "/keys?id="+id, "", "")
+	var keys []manager.APIKeyResponse
+	json.NewDecoder(resp.Body).Decode(&keys)
+	if len(keys) != 1 || keys[0].Key != "" || keys[0].LastUsedAt == nil {
+		t.Fatalf("expected one used key without its secret, got %+v", keys)
+	}
+
+	if resp := do("DELETE", "/keys/"+created.ID.String()+"?id="+id, "", ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204 revoking key, got %d", resp.StatusCode)
+	}
+	if resp := do("POST", "/clipboard", created.Key, "revoked"); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for revoked key, got %d", resp.StatusCode)
+	}
+}
+
+func TestMemberRoles(t *testing.T) {
+	base, wsBase := startServer(t)
+	id := createParty(t, base, "roles-party", "s3cr3t")
+	join := func(role, memberId string) (*websocket.Conn, context.Context) {
+		u := wsBase + "/api/parties/join?version=3&id=" + url.QueryEscape(id) + "&token=" + url.QueryEscape(authenticateAs(t, base, id, "s3cr3t", role)) + "&memberId=" + memberId
+		conn, _, cancel := dialParty(t, u, nil)
+		t.Cleanup(cancel)
+		// the connections outlive several slow secret checks, so they get
+		// more time than dialParty gives
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		t.Cleanup(cancel)
+		t.Cleanup(func() { conn.Close(websocket.StatusNormalClosure, "") })
+		return conn, ctx
+	}
+	expectForbidden := func(conn *websocket.Conn, ctx context.Context, msg string) {
+		t.Helper()
+		if err := conn.Write(ctx, websocket.MessageText, []byte(msg)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		errMsg := readMessageOfType(t, ctx, conn, "error")
+		if code := errMsg["data"].(map[string]any)["code"]; code != "FORBIDDEN" {
+			t.Fatalf("expected FORBIDDEN for %s, got %v", msg, errMsg)
+		}
+	}
+
+	// roles can be assigned before anyone joins
+	req, _ := http.NewRequest("PUT", base+"/api/parties/members/early/role?id="+id, strings.NewReader(`{"role":"read-only"}`))
+	req.Header.Set("X-Secret", "s3cr3t")
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("set role of an idle party: %v %v", resp, err)
+	}
+
+	owner, ctxO := join("", "owner")
+	phone, ctxP := join("member", "phone")
+	kiosk, ctxK := join("read-only", "kiosk")
+	readMessageOfType(t, ctxO, owner, "joined")
+	early, ctxE := join("member", "early")
+	expectForbidden(early, ctxE, `{"messageType":"clipboard","data":{"content":"assigned read-only"}}`)
+
+	expectForbidden(kiosk, ctxK, `{"messageType":"clipboard","data":{"content":"hi"}}`)
+	expectForbidden(phone, ctxP, `{"messageType":"conclave","data":{"addresses":[],"generation":"g1"}}`)
+	expectForbidden(phone, ctxP, `{"messageType":"kick","data":{"memberId":"kiosk"}}`)
+
+	if err := owner.Write(ctxO, websocket.MessageText, []byte(`{"messageType":"set-role","data":{"memberId":"phone","role":"admin"}}`)); err != nil {
+		t.Fatalf("write set-role: %v", err)
+	}
+	changed := readMessageOfType(t, ctxP, phone, "set-role")
+	if data := changed["data"].(map[string]any); data["memberId"] != "phone" || data["role"] != "admin" || changed["sender"] != "owner" {
+		t.Fatalf("expected phone to be made admin, got %v", changed)
+	}
+	// admins cannot touch owners
+	expectForbidden(phone, ctxP, `{"messageType":"kick","data":{"memberId":"owner"}}`)
+
+	if err := phone.Write(ctxP, websocket.MessageText, []byte(`{"messageType":"kick","data":{"memberId":"kiosk"}}`)); err != nil {
+		t.Fatalf("write kick: %v", err)
+	}
+	for {
+		if _, _, err := kiosk.Read(ctxK); err != nil {
+			if status := websocket.CloseStatus(err); status != 4001 {
+				t.Fatalf("expected close code 4001 for kicked member, got %v", err)
+			}
+			break
+		}
+	}
+
+	// roles assigned over HTTP apply to later joins
+	do := func(method, path, body string) int {
+		req, _ := http.NewRequest(method, base+"/api/parties"+path+"?id="+id, strings.NewReader(body))
+		req.Header.Set("X-Secret", "s3cr3t")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := do("PUT", "/members/kiosk/role", `{"role":"read-only"}`); status != http.StatusNoContent {
+		t.Fatalf("expected 204 setting role, got %d", status)
+	}
+	if status := do("DELETE", "/members/ghost", ""); status != http.StatusNotFound {
+		t.Fatalf("expected 404 kicking a missing member, got %d", status)
+	}
+	kiosk, ctxK = join("member", "kiosk")
+	expectForbidden(kiosk, ctxK, `{"messageType":"clipboard","data":{"content":"still read-only"}}`)
+
+	// a role assigned to a member ID does not outrank the token it joins with
+	if status := do("PUT", "/members/tablet/role", `{"role":"admin"}`); status != http.StatusNoContent {
+		t.Fatalf("expected 204 setting role, got %d", status)
+	}
+	tablet, ctxT := join("read-only", "tablet")
+	expectForbidden(tablet, ctxT, `{"messageType":"conclave","data":{"addresses":[],"generation":"g2"}}`)
+
+	// nor can a lower token take over a connected admin's ID
+	resp, err := http.Get(base + "/api/parties/join?version=3&id=" + url.QueryEscape(id) + "&token=" + url.QueryEscape(authenticateAs(t, base, id, "s3cr3t", "read-only")) + "&memberId=phone&supersede=true")
+	if err != nil {
+		t.Fatalf("supersede admin: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 superseding an admin with a read-only token, got %d", resp.StatusCode)
+	}
+	join("", "phone&supersede=true")
+	for {
+		if _, _, err := phone.Read(ctxP); err != nil {
+			if status := websocket.CloseStatus(err); status != 4005 {
+				t.Fatalf("expected the owner to supersede the admin, got %v", err)
+			}
+			break
+		}
+	}
+}
+
+func TestMemberModes(t *testing.T) {
+	base, wsBase := startServer(t)
+	id := createParty(t, base, "modes-party", "s3cr3t")
+	join := func(memberId, mode string) (*websocket.Conn, context.Context) {
+		u := wsBase + "/api/parties/join?id=" + url.QueryEscape(id) + "&token=" + url.QueryEscape(authenticate(t, base, id, "s3cr3t")) + "&memberId=" + memberId + "&mode=" + mode
+		conn, _, cancel := dialParty(t, u, nil)
+		t.Cleanup(cancel)
+		// the connections outlive several slow secret checks, so they get
+		// more time than dialParty gives
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		t.Cleanup(cancel)
+		t.Cleanup(func() { conn.Close(websocket.StatusNormalClosure, "") })
+		return conn, ctx
+	}
+	send := func(conn *websocket.Conn, ctx context.Context, content string) {
+		t.Helper()
+		if err := conn.Write(ctx, websocket.MessageText, []byte(`{"messageType":"clipboard","data":{"content":"`+content+`"}}`)); err != nil {
+			t.Fatalf("write clipboard: %v", err)
+		}
+	}
+
+	resp, err := http.Get(base + "/api/parties/join?id=" + id + "&token=x&mode=sideways")
+	if err != nil {
+		t.Fatalf("join with bad mode: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for unknown mode, got %d", resp.StatusCode)
+	}
+
+	laptop, ctxL := join("laptop", "")
+	agent, ctxA := join("agent", "send-only")
+	kiosk, ctxK := join("kiosk", "receive-only")
+	readMessageOfType(t, ctxL, laptop, "joined")
+
+	send(agent, ctxA, "from agent")
+	if clip := readMessageOfType(t, ctxK, kiosk, "clipboard"); clip["sender"] != "agent" {
+		t.Fatalf("expected kiosk to receive from agent, got %v", clip)
+	}
+	if report := readMessageOfType(t, ctxA, agent, "delivery-report"); report["data"].(map[string]any)["total"] != float64(2) {
+		t.Fatalf("expected agent's item relayed to two members, got %v", report)
+	}
+
+	send(laptop, ctxL, "from laptop")
+	report := readMessageOfType(t, ctxL, laptop, "delivery-report")
+	if recipients := report["data"].(map[string]any)["total"]; recipients != float64(1) {
+		t.Fatalf("expected send-only agent to be skipped, got %v", report)
+	}
+
+	send(kiosk, ctxK, "from kiosk")
+	if errMsg := readMessageOfType(t, ctxK, kiosk, "error"); errMsg["data"].(map[string]any)["code"] != "FORBIDDEN" {
+		t.Fatalf("expected receive-only kiosk to be refused, got %v", errMsg)
+	}
+
+	do := func(method, path, body string) *http.Response {
+		req, _ := http.NewRequest(method, base+"/api/parties"+path+"?id="+id, strings.NewReader(body))
+		req.Header.Set("X-Secret", "s3cr3t")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	var roster []service.MemberInfo
+	json.NewDecoder(do("GET", "/members", "").Body).Decode(&roster)
+	modes := map[string]service.Mode{}
+	for _, member := range roster {
+		modes[member.MemberID] = member.Mode
+	}
+	if !reflect.DeepEqual(modes, map[string]service.Mode{"agent": "send-only", "kiosk": "receive-only", "laptop": "send-receive"}) {
+		t.Fatalf("unexpected roster %+v", roster)
+	}
+
+	if resp := do("PUT", "/members/kiosk/mode", `{"mode":"send-receive"}`); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204 setting mode, got %d", resp.StatusCode)
+	}
+	send(kiosk, ctxK, "kiosk unlocked")
+	if clip := readMessageOfType(t, ctxL, laptop, "clipboard"); clip["sender"] != "kiosk" {
+		t.Fatalf("expected clipboard from kiosk, got %v", clip)
+	}
+}
+
+func TestInvites(t *testing.T) {
+	db := openDB(t)
+	base, wsBase := startServer(t, manager.WithInvites(data.NewInviteStore(db)))
+	id := createParty(t, base, "invite-party", "s3cr3t")
+	post := func(path, body string, secret bool) *http.Response {
+		req, _ := http.NewRequest("POST", base+"/api/parties"+path, strings.NewReader(body))
+		if secret {
+			req.Header.Set("X-Secret", "s3cr3t")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST %s: %v", path, err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	redeem := func(code string) (*http.Response, manager.RedeemInviteResponse) {
+		resp := post("/invites/redeem", `{"code":"`+code+`"}`, false)
+		var redeemed manager.RedeemInviteResponse
+		json.NewDecoder(resp.Body).Decode(&redeemed)
+		return resp, redeemed
+	}
+
+	resp := post("/invites?id="+id, `{"maxUses":2,"expiresIn":3600,"role":"read-only"}`, true)
+	var invite manager.InviteResponse
+	json.NewDecoder(resp.Body).Decode(&invite)
+	if resp.StatusCode != http.StatusCreated || !strings.HasPrefix(invite.Code, "inv_") || invite.Role != service.RoleReadOnly {
+		t.Fatalf("expected invite, got %d %+v", resp.StatusCode, invite)
+	}
+	if resp := post("/invites?id="+id, `{"maxUses":1}`, false); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected minting without credentials to fail, got %d", resp.StatusCode)
+	}
+
+	resp, redeemed := redeem(invite.Code)
+	if resp.StatusCode != http.StatusOK || redeemed.PartyID.String() != id || redeemed.Role != service.RoleReadOnly {
+		t.Fatalf("expected token for the party, got %d %+v", resp.StatusCode, redeemed)
+	}
+	conn, ctx, cancel := joinPartyAs(t, wsBase, id, redeemed.Token, "guest")
+	defer cancel()
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	if err := conn.Write(ctx, websocket.MessageText, []byte(`{"messageType":"clipboard","data":{"content":"hi"}}`)); err != nil {
+		t.Fatalf("write clipboard: %v", err)
+	}
+	if errMsg := readMessageOfType(t, ctx, conn, "error"); errMsg["data"].(map[string]any)["code"] != "FORBIDDEN" {
+		t.Fatalf("expected guest to join read-only, got %v", errMsg)
+	}
+
+	if resp, _ := redeem(invite.Code); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected second use to succeed, got %d", resp.StatusCode)
+	}
+	if resp, _ := redeem(invite.Code); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected used up invite to be refused, got %d", resp.StatusCode)
+	}
+
+	resp = post("/invites?id="+id, `{}`, true)
+	json.NewDecoder(resp.Body).Decode(&invite)
+	req, _ := http.NewRequest("DELETE", base+"/api/parties/invites/"+invite.ID.String()+"?id="+id, nil)
+	req.Header.Set("X-Secret", "s3cr3t")
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204 revoking invite, got %v %v", resp, err)
+	}
+	if resp, _ := redeem(invite.Code); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected revoked invite to be refused, got %d", resp.StatusCode)
+	}
+}
+
+func TestInvitesAreSingleUseUnderConcurrency(t *testing.T) {
+	db := openDB(t)
+	// the losing redemptions count as failures, which must not lock out the
+	// winner
+	guard := manager.GuardConfig{MaxFailures: 100, BaseLockout: time.Second, MaxLockout: time.Second, ResetAfter: time.Minute}
+	base, _ := startServer(t, manager.WithInvites(data.NewInviteStore(db)), manager.WithBruteForceProtection(guard, guard))
+	id := createParty(t, base, "race-invite-party", "s3cr3t")
+
+	req, _ := http.NewRequest("POST", base+"/api/parties/invites?id="+id, strings.NewReader(`{"maxUses":1,"expiresIn":3600}`))
+	req.Header.Set("X-Secret", "s3cr3t")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("create invite: %v", err)
+	}
+	var invite manager.InviteResponse
+	json.NewDecoder(resp.Body).Decode(&invite)
+	resp.Body.Close()
+
+	const racers = 10
+	race := func(attempt func(i int) int) []int {
+		var wg sync.WaitGroup
+		statuses := make([]int, racers)
+		for i := range racers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				statuses[i] = attempt(i)
+			}()
+		}
+		wg.Wait()
+		return statuses
+	}
+	count := func(statuses []int, status int) int {
+		n := 0
+		for _, s := range statuses {
+			if s == status {
+				n++
+			}
+		}
+		return n
+	}
+
+	tokens := make([]string, racers)
+	statuses := race(func(i int) int {
+		resp, err := http.Post(base+"/api/parties/invites/redeem", "application/json", strings.NewReader(`{"code":"`+invite.Code+`"}`))
+		if err != nil {
+			return 0
+		}
+		defer resp.Body.Close()
+		var redeemed manager.RedeemInviteResponse
+		json.NewDecoder(resp.Body).Decode(&redeemed)
+		tokens[i] = redeemed.Token
+		return resp.StatusCode
+	})
+	if n := count(statuses, http.StatusOK); n != 1 {
+		t.Fatalf("expected one redemption of a single-use invite, got %d: %v", n, statuses)
+	}
+	var token string
+	for i, status := range statuses {
+		if status == http.StatusOK {
+			token = tokens[i]
+		}
+	}
+
+	statuses = race(func(i int) int {
+		resp, err := http.Post(base+"/api/parties/sessions?id="+url.QueryEscape(id)+"&token="+url.QueryEscape(token)+"&memberId="+fmt.Sprint("racer-", i), "application/json", nil)
+		if err != nil {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	})
+	if n := count(statuses, http.StatusCreated); n != 1 {
+		t.Fatalf("expected the token to join once, got %d: %v", n, statuses)
+	}
+}
+
+func TestDeviceEnrolment(t *testing.T) {
+	db := openDB(t)
+	base, wsBase := startServer(t, manager.WithDevices(data.NewDeviceStore(db)))
+	id := createParty(t, base, "device-party", "s3cr3t")
+	post := func(path, body string, secret bool) *http.Response {
+		req, _ := http.NewRequest("POST", base+"/api/parties"+path, strings.NewReader(body))
+		if secret {
+			req.Header.Set("X-Secret", "s3cr3t")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST %s: %v", path, err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	public, private, _ := ed25519.GenerateKey(nil)
+	deviceToken := func(key ed25519.PrivateKey) *http.Response {
+		var challenge manager.ChallengeResponse
+		json.NewDecoder(post("/devices/laptop/challenge?id="+id, "", false).Body).Decode(&challenge)
+		signature := base64.StdEncoding.EncodeToString(ed25519.Sign(key, []byte(challenge.Nonce)))
+		return post("/devices/laptop/token?id="+id, `{"nonce":"`+challenge.Nonce+`","signature":"`+signature+`"}`, false)
+	}
+	joinDevice := func(query string) (*websocket.Conn, context.Context) {
+		var auth manager.AuthResponse
+		json.NewDecoder(deviceToken(private).Body).Decode(&auth)
+		conn, ctx, cancel := dialParty(t, wsBase+"/api/parties/join?id="+id+"&token="+url.QueryEscape(auth.Token)+query, nil)
+		t.Cleanup(cancel)
+		t.Cleanup(func() { conn.Close(websocket.StatusNormalClosure, "") })
+		return conn, ctx
+	}
+
+	body := `{"memberId":"laptop","name":"Laptop","publicKey":"` + base64.StdEncoding.EncodeToString(public) + `"}`
+	if resp := post("/devices?id="+id, body, true); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201 enrolling device, got %d", resp.StatusCode)
+	}
+	if resp := post("/devices?id="+id, body, true); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected 409 enrolling twice, got %d", resp.StatusCode)
+	}
+	readOnly := authenticateAs(t, base, id, "s3cr3t", "read-only")
+	if resp := post("/devices?id="+id+"&token="+url.QueryEscape(readOnly), `{"name":"Kiosk","publicKey":"`+base64.StdEncoding.EncodeToString(public)+`","role":"admin"}`, false); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected a read-only token not to enrol an admin, got %d", resp.StatusCode)
+	}
+	// IDs with an assigned role, or in use, cannot be taken over by enrolling
+	req, _ := http.NewRequest("PUT", base+"/api/parties/members/boss/role?id="+id, strings.NewReader(`{"role":"admin"}`))
+	req.Header.Set("X-Secret", "s3cr3t")
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("set role: %v", err)
+	}
+	readOnly = authenticateAs(t, base, id, "s3cr3t", "read-only")
+	if resp := post("/devices?id="+id+"&token="+url.QueryEscape(readOnly), `{"memberId":"boss","name":"Boss","publicKey":"`+base64.StdEncoding.EncodeToString(public)+`","role":"read-only"}`, false); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected 409 enrolling a member id with a role, got %d", resp.StatusCode)
+	}
+	busy, _, cancelB := joinPartyAs(t, wsBase, id, authenticate(t, base, id, "s3cr3t"), "busy")
+	defer cancelB()
+	defer busy.Close(websocket.StatusNormalClosure, "")
+	if resp := post("/devices?id="+id, `{"memberId":"busy","name":"Busy","publicKey":"`+base64.StdEncoding.EncodeToString(public)+`"}`, true); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected 409 enrolling a connected member id, got %d", resp.StatusCode)
+	}
+
+	resp, err := http.Get(base + "/api/parties/join?id=" + id + "&memberId=laptop&token=" + url.QueryEscape(authenticate(t, base, id, "s3cr3t")))
+	if err != nil {
+		t.Fatalf("join as enrolled device: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 claiming an enrolled member id, got %d", resp.StatusCode)
+	}
+	_, otherKey, _ := ed25519.GenerateKey(nil)
+	if resp := deviceToken(otherKey); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a wrong key, got %d", resp.StatusCode)
+	}
+
+	// unknown devices cannot be told from enrolled ones
+	var unknown manager.ChallengeResponse
+	resp = post("/devices/ghost/challenge?id="+id, "", false)
+	json.NewDecoder(resp.Body).Decode(&unknown)
+	if resp.StatusCode != http.StatusOK || unknown.Nonce == "" || unknown.ExpiresAt.IsZero() {
+		t.Fatalf("expected a challenge for an unknown device, got %d %+v", resp.StatusCode, unknown)
+	}
+	// a new challenge replaces the device's open one
+	var stale, fresh manager.ChallengeResponse
+	json.NewDecoder(post("/devices/laptop/challenge?id="+id, "", false).Body).Decode(&stale)
+	json.NewDecoder(post("/devices/laptop/challenge?id="+id, "", false).Body).Decode(&fresh)
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(private, []byte(stale.Nonce)))
+	if resp := post("/devices/laptop/token?id="+id, `{"nonce":"`+stale.Nonce+`","signature":"`+signature+`"}`, false); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected a replaced challenge to be refused, got %d", resp.StatusCode)
+	}
+
+	observer, ctxO, cancelO := joinPartyAs(t, wsBase, id, authenticate(t, base, id, "s3cr3t"), "observer")
+	defer cancelO()
+	defer observer.Close(websocket.StatusNormalClosure, "")
+	first, ctxF := joinDevice("")
+	if joined := readMessageOfType(t, ctxO, observer, "joined"); joined["sender"] != "laptop" {
+		t.Fatalf("expected the device to join as laptop, got %v", joined)
+	}
+
+	var auth manager.AuthResponse
+	json.NewDecoder(deviceToken(private).Body).Decode(&auth)
+	resp, err = http.Get(base + "/api/parties/join?id=" + id + "&token=" + url.QueryEscape(auth.Token))
+	if err != nil {
+		t.Fatalf("duplicate join: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected 409 for a duplicate session, got %d", resp.StatusCode)
+	}
+
+	second, ctxD := joinDevice("&supersede=true")
+	for {
+		if _, _, err := first.Read(ctxF); err != nil {
+			if status := websocket.CloseStatus(err); status != 4005 {
+				t.Fatalf("expected close code 4005 for the superseded session, got %v", err)
+			}
+			break
+		}
+	}
+
+	req, _ = http.NewRequest("DELETE", base+"/api/parties/devices/laptop?id="+id, nil)
+	req.Header.Set("X-Secret", "s3cr3t")
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("remove device: %v", err)
+	}
+	for {
+		if _, _, err := second.Read(ctxD); err != nil {
+			if status := websocket.CloseStatus(err); status != 4004 {
+				t.Fatalf("expected close code 4004 for a removed device, got %v", err)
+			}
+			break
+		}
+	}
+}
+
+func TestDeviceChallengeLockout(t *testing.T) {
+	db := openDB(t)
+	guard := manager.GuardConfig{MaxFailures: 2, BaseLockout: time.Minute, MaxLockout: time.Hour, ResetAfter: time.Hour}
+	base, _ := startServer(t,
+		manager.WithDevices(data.NewDeviceStore(db)),
+		manager.WithBruteForceProtection(guard, manager.DefaultPartyGuardConfig()),
+	)
+	id := createParty(t, base, "challenge-lockout-party", "s3cr3t")
+	post := func(path, body string) int {
+		resp, err := http.Post(base+"/api/parties"+path, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("POST %s: %v", path, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	for range 3 {
+		post("/devices/ghost/token?id="+id, `{"nonce":"guess","signature":"guess"}`)
+	}
+	if status := post("/devices/ghost/challenge?id="+id, ""); status != http.StatusTooManyRequests {
+		t.Fatalf("expected challenges to be refused while locked out, got %d", status)
+	}
+}
+
+// startTLSServer starts the server over TLS, requesting client certificates.
+// It returns the server's certificate pool for clients to trust.
+func startTLSServer(t testing.TB, opts ...manager.Option) (base, wsBase string, roots *x509.CertPool) {
+	t.Helper()
+	mc := manager.NewManagerCtrl(data.NewPartyStore(openDB(t)), logrus.New(), opts...)
+	globalMux := http.NewServeMux()
+	mc.RegisterRoutes(globalMux)
+	topMux := http.NewServeMux()
+	topMux.Handle("/api/", http.StripPrefix("/api", globalMux))
+
+	srv := httptest.NewUnstartedServer(topMux)
+	srv.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	roots = x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	return srv.URL, "wss" + strings.TrimPrefix(srv.URL, "https"), roots
+}
+
+// tlsClient returns a client trusting roots that presents certs.
+func tlsClient(roots *x509.CertPool, certs ...tls.Certificate) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs},
+	}}
+}
+
+// clientCert signs a client certificate for memberId of partyId with the CA
+// of party, which must include the CA key.
+func clientCert(t testing.TB, party manager.PartyResponse, partyId, memberId string) tls.Certificate {
+	t.Helper()
+	certPEM, _ := base64.StdEncoding.DecodeString(party.CertPEM)
+	keyPEM, _ := base64.StdEncoding.DecodeString(party.KeyPEM)
+	ca, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("load party CA: %v", err)
+	}
+	caCert, _ := x509.ParseCertificate(ca.Certificate[0])
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{Organization: []string{partyId}, CommonName: memberId},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, &key.PublicKey, ca.PrivateKey)
+	if err != nil {
+		t.Fatalf("sign client certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestMutualTLSJoin(t *testing.T) {
+	db := openDB(t)
+	base, wsBase, roots := startTLSServer(t, manager.WithDevices(data.NewDeviceStore(db)))
+	client := tlsClient(roots)
+	createParty := func(name string) (string, manager.PartyResponse) {
+		resp, err := client.Post(base+"/api/parties/", "application/json", strings.NewReader(`{"name":"`+name+`","secret":"s3cr3t"}`))
+		if err != nil {
+			t.Fatalf("create party: %v", err)
+		}
+		defer resp.Body.Close()
+		var party manager.PartyResponse
+		json.NewDecoder(resp.Body).Decode(&party)
+		return party.ID.String(), party
+	}
+	id, party := createParty("mtls-party")
+	_, other := createParty("other-party")
+	join := func(cert tls.Certificate, query string) (*websocket.Conn, *http.Response, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		t.Cleanup(cancel)
+		return websocket.Dial(ctx, wsBase+"/api/parties/join?"+query, &websocket.DialOptions{
+			HTTPClient:   tlsClient(roots, cert),
+			Subprotocols: []string{"clippa.v3"},
+		})
+	}
+
+	conn, _, err := join(clientCert(t, party, id, "laptop"), "")
+	if err != nil {
+		t.Fatalf("join with client certificate: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if welcome := readMessageOfType(t, ctx, conn, "welcome"); welcome["data"].(map[string]any)["memberId"] != "laptop" {
+		t.Fatalf("expected to join as the certificate's member, got %v", welcome)
+	}
+	conn.Close(websocket.StatusNormalClosure, "")
+
+	if _, resp, err := join(clientCert(t, other, id, "intruder"), ""); err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a certificate of another party's CA, got %v", err)
+	}
+	if _, resp, err := join(clientCert(t, party, id, "laptop"), "id="+url.QueryEscape(other.ID.String())); err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a certificate of another party, got %v", err)
+	}
+
+	enrolled := clientCert(t, party, id, "desktop")
+	leaf, _ := x509.ParseCertificate(enrolled.Certificate[0])
+	fingerprint := sha256.Sum256(leaf.Raw)
+	req, _ := http.NewRequest("POST", base+"/api/parties/devices?id="+id, strings.NewReader(`{"memberId":"desktop","name":"Desktop","role":"read-only","certFingerprint":"`+hex.EncodeToString(fingerprint[:])+`"}`))
+	req.Header.Set("X-Secret", "s3cr3t")
+	if resp, err := client.Do(req); err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201 enrolling device, got %v %v", resp, err)
+	}
+	if _, resp, err := join(clientCert(t, party, id, "desktop"), ""); err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 for another certificate of an enrolled device, got %v", err)
+	}
+	conn, _, err = join(enrolled, "")
+	if err != nil {
+		t.Fatalf("join as enrolled device: %v", err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	readMessageOfType(t, ctx, conn, "welcome")
+	if err := conn.Write(ctx, websocket.MessageText, []byte(`{"messageType":"clipboard","data":{"content":"hi"}}`)); err != nil {
+		t.Fatalf("write clipboard: %v", err)
+	}
+	if errMsg := readMessageOfType(t, ctx, conn, "error"); errMsg["data"].(map[string]any)["code"] != "FORBIDDEN" {
+		t.Fatalf("expected the device to join with its read-only role, got %v", errMsg)
+	}
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	mc, base, wsBase := startServerCtrl(t)
+	id := createParty(t, base, "shutdown-party", "s3cr3t")
+	conn, ctx, cancel := dialParty(t, wsBase+"/api/parties/join?id="+id+"&token="+url.QueryEscape(authenticate(t, base, id, "s3cr3t")), &websocket.DialOptions{Subprotocols: []string{"clippa.v3"}})
+	defer cancel()
+	readMessageOfType(t, ctx, conn, "welcome")
+	older, olderCtx, cancelOlder := joinPartyAs(t, wsBase, id, authenticate(t, base, id, "s3cr3t"), "older")
+	defer cancelOlder()
+	readMessageOfType(t, ctx, conn, "joined")
+	token := authenticate(t, base, id, "s3cr3t")
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdown <- mc.Shutdown(shutdownCtx, 3*time.Second)
+	}()
+
+	notice := readMessageOfType(t, ctx, conn, "server-shutdown")
+	if reconnectAfter := notice["data"].(map[string]any)["reconnectAfter"]; reconnectAfter != float64(3000) {
+		t.Fatalf("expected reconnectAfter of 3000ms, got %v", notice)
+	}
+	notice = readMessageOfType(t, olderCtx, older, "error")
+	if data := notice["data"].(map[string]any); data["code"] != "SHUTTING_DOWN" || data["retryAfter"] != float64(3000) {
+		t.Fatalf("expected version 1 members to get SHUTTING_DOWN with retryAfter of 3000ms, got %v", notice)
+	}
+	for _, c := range []struct {
+		conn *websocket.Conn
+		ctx  context.Context
+	}{{conn, ctx}, {older, olderCtx}} {
+		for {
+			if _, _, err := c.conn.Read(c.ctx); err != nil {
+				if status := websocket.CloseStatus(err); status != websocket.StatusGoingAway {
+					t.Fatalf("expected close code 1001, got %v", err)
+				}
+				break
+			}
+		}
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatalf("expected shutdown to finish before its deadline, got %v", err)
+	}
+
+	_, resp, err := websocket.Dial(context.Background(), wsBase+"/api/parties/join?id="+id+"&token="+url.QueryEscape(token), nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 joining during shutdown, got %v", err)
+	}
+}
+
+// gathered returns the value of the metric called name with the given label
+// pairs in reg, or zero if it has not been recorded.
+func gathered(t testing.TB, reg *prometheus.Registry, name string, labels ...string) float64 {
+	t.Helper()
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("gather metrics: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, metric := range family.GetMetric() {
+			values := map[string]string{}
+			for _, pair := range metric.GetLabel() {
+				values[pair.GetName()] = pair.GetValue()
+			}
+			for i := 0; i+1 < len(labels); i += 2 {
+				if values[labels[i]] != labels[i+1] {
+					continue metrics
+				}
+			}
+			switch {
+			case metric.Counter != nil:
+				return metric.GetCounter().GetValue()
+			case metric.Gauge != nil:
+				return metric.GetGauge().GetValue()
+			case metric.Histogram != nil:
+				return float64(metric.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+	return 0
+}
+
+func TestMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	base, wsBase := startServer(t, manager.WithMetrics(reg))
+	id := createParty(t, base, "metrics-party", "s3cr3t")
+
+	req, _ := http.NewRequest("GET", base+"/api/parties/?id="+id, nil)
+	req.Header.Set("X-Secret", "wrong")
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a wrong secret, got %v %v", resp, err)
+	}
+
+	sender, ctxS, cancelS := joinPartyAs(t, wsBase, id, authenticate(t, base, id, "s3cr3t"), "sender")
+	defer cancelS()
+	defer sender.Close(websocket.StatusNormalClosure, "")
+	receiver, ctxR, cancelR := joinPartyAs(t, wsBase, id, authenticate(t, base, id, "s3cr3t"), "receiver")
+	defer cancelR()
+	defer receiver.Close(websocket.StatusNormalClosure, "")
+	readMessageOfType(t, ctxS, sender, "joined")
+	if err := sender.Write(ctxS, websocket.MessageText, []byte(`{"messageType":"clipboard","data":{"content":"hi"}}`)); err != nil {
+		t.Fatalf("write clipboard: %v", err)
+	}
+	readMessageOfType(t, ctxR, receiver, "clipboard")
+	if err := sender.Write(ctxS, websocket.MessageText, []byte(`{"messageType":"leader-elected","data":{"address":"10.0.0.2:4000"}}`)); err != nil {
+		t.Fatalf("write leader-elected: %v", err)
+	}
+	readMessageOfType(t, ctxR, receiver, "leader-elected")
+
+	for _, check := range []struct {
+		name   string
+		labels []string
+		want   float64
+	}{
+		{"clippa_parties_created_total", nil, 1},
+		{"clippa_active_parties", nil, 1},
+		{"clippa_connected_members", nil, 2},
+		{"clippa_messages_total", []string{"type", "clipboard"}, 1},
+		{"clippa_election_outcomes_total", []string{"outcome", "leader-elected"}, 1},
+		{"clippa_auth_failures_total", []string{"credential", "secret"}, 1},
+		{"clippa_bcrypt_duration_seconds", []string{"operation", "hash"}, 1},
+		{"clippa_bcrypt_duration_seconds", []string{"operation", "compare"}, 3},
+	} {
+		if got := gathered(t, reg, check.name, check.labels...); got != check.want {
+			t.Errorf("expected %s%v of %v, got %v", check.name, check.labels, check.want, got)
+		}
+	}
+	if got := gathered(t, reg, "clippa_relayed_bytes_total"); got == 0 {
+		t.Errorf("expected relayed bytes to be counted")
+	}
+
+	// the party is no longer served once its last member leaves
+	sender.Close(websocket.StatusNormalClosure, "")
+	receiver.Close(websocket.StatusNormalClosure, "")
+	for deadline := time.Now().Add(5 * time.Second); gathered(t, reg, "clippa_active_parties") != 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected no active parties once everyone left, got %v", gathered(t, reg, "clippa_active_parties"))
+		}
+	}
+	again, _, cancelA := joinPartyAs(t, wsBase, id, authenticate(t, base, id, "s3cr3t"), "again")
+	defer cancelA()
+	defer again.Close(websocket.StatusNormalClosure, "")
+	for deadline := time.Now().Add(5 * time.Second); gathered(t, reg, "clippa_active_parties") != 1; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the party to be served again on rejoin, got %v", gathered(t, reg, "clippa_active_parties"))
+		}
+	}
+}
+
+func TestHealthAndReadiness(t *testing.T) {
+	// a database of its own, so closing it leaves the other tests' alone
+	db, err := gorm.Open(sqlite.Open("file:readiness?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	mc := manager.NewManagerCtrl(data.NewPartyStore(db), logrus.New())
+	base, _, shutdown := setupServer(t, mc)
+	t.Cleanup(shutdown)
+	get := func(path string) (int, manager.HealthResponse) {
+		t.Helper()
+		resp, err := http.Get(base + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		var health manager.HealthResponse
+		json.NewDecoder(resp.Body).Decode(&health)
+		return resp.StatusCode, health
+	}
+
+	if status, health := get("/healthz"); status != http.StatusOK || health.Status != "ok" {
+		t.Fatalf("expected healthz ok, got %d %+v", status, health)
+	}
+	if status, health := get("/readyz"); status != http.StatusOK || health.Components["database"].Status != "ok" {
+		t.Fatalf("expected readyz ok, got %d %+v", status, health)
+	}
+
+	sqlDB, _ := db.DB()
+	sqlDB.Close()
+	if status, health := get("/readyz"); status != http.StatusServiceUnavailable || health.Components["database"].Status != "unavailable" || health.Components["server"].Status != "ok" {
+		t.Fatalf("expected readyz to report the database down, got %d %+v", status, health)
+	}
+
+	mc.Shutdown(context.Background(), time.Second)
+	if status, health := get("/readyz"); status != http.StatusServiceUnavailable || health.Components["server"].Status != "draining" {
+		t.Fatalf("expected readyz to report draining, got %d %+v", status, health)
+	}
+	if status, _ := get("/healthz"); status != http.StatusOK {
+		t.Fatalf("expected healthz ok while draining, got %d", status)
+	}
+}
+
+// logBuffer collects the lines of a JSON logger written from many goroutines.
+type logBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+// find returns the first line with message msg.
+func (b *logBuffer) find(msg string) (map[string]any, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, line := range strings.Split(b.buf.String(), "\n") {
+		entry := map[string]any{}
+		if json.Unmarshal([]byte(line), &entry) == nil && entry["msg"] == msg {
+			return entry, true
+		}
+	}
+	return nil, false
+}
+
+func (b *logBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.String()
+}
+
+func TestRequestLogging(t *testing.T) {
+	logs := &logBuffer{}
+	logger := logrus.New()
+	logger.SetOutput(logs)
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	mc := manager.NewManagerCtrl(data.NewPartyStore(openDB(t)), logger)
+
+	globalMux := http.NewServeMux()
+	mc.RegisterRoutes(globalMux)
+	topMux := http.NewServeMux()
+	topMux.Handle("/api/", http.StripPrefix("/api", globalMux))
+	srv := httptest.NewServer(manager.RequestLogger(logger, topMux))
+	t.Cleanup(srv.Close)
+	base, wsBase := srv.URL, "ws"+strings.TrimPrefix(srv.URL, "http")
+
+	id := createParty(t, base, "logging-party", "s3cr3t")
+	token := authenticate(t, base, id, "s3cr3t")
+
+	// a request ID from a proxy is kept, an unsafe one replaced
+	for _, check := range []struct {
+		sent string
+		kept bool
+	}{
+		{"proxy-id.42", true},
+		{"not <safe> to log", false},
+	} {
+		req, _ := http.NewRequest("GET", base+"/api/parties/?id="+id, nil)
+		req.Header.Set("X-Secret", "s3cr3t")
+		req.Header.Set("X-Request-ID", check.sent)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("get party: %v", err)
+		}
+		resp.Body.Close()
+		got := resp.Header.Get("X-Request-ID")
+		if check.kept != (got == check.sent) || got == "" {
+			t.Errorf("expected request ID %q to be kept=%v, got %q", check.sent, check.kept, got)
+		}
+	}
+
+	opts := &websocket.DialOptions{HTTPHeader: http.Header{"X-Request-ID": {"join-request"}}}
+	u := wsBase + "/api/parties/join?id=" + url.QueryEscape(id) + "&token=" + url.QueryEscape(token) + "&memberId=alice"
+	conn, ctx, cancel := dialParty(t, u, opts)
+	defer cancel()
+	if err := conn.Write(ctx, websocket.MessageText, []byte(`not json`)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	readMessageOfType(t, ctx, conn, "error")
+	conn.Close(websocket.StatusNormalClosure, "")
+
+	// lines about the member carry its party, its ID and its join request
+	for _, msg := range []string{"joined party with handle", "invalid frame"} {
+		entry, ok := logs.find(msg)
+		if !ok {
+			t.Fatalf("expected a %q line, got:\n%s", msg, logs)
+		}
+		if entry["party"] != id || entry["member"] != "alice" || entry["request_id"] != "join-request" {
+			t.Errorf("expected %q to carry party, member and request ID, got %v", msg, entry)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		entry, ok := logs.find("handled request")
+		if ok {
+			for _, field := range []string{"request_id", "method", "url", "status", "latency_ms"} {
+				if _, ok := entry[field]; !ok {
+					t.Errorf("expected the access log to have %s, got %v", field, entry)
+				}
+			}
+		}
+		if strings.Contains(logs.String(), "join-request") && strings.Contains(logs.String(), `"status":101`) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the websocket request to be logged, got:\n%s", logs)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if strings.Contains(logs.String(), token) || !strings.Contains(logs.String(), "token=REDACTED") {
+		t.Errorf("expected join tokens to be redacted, got:\n%s", logs)
+	}
+	if strings.Contains(logs.String(), "s3cr3t") {
+		t.Errorf("expected secrets to stay out of the logs")
+	}
+}
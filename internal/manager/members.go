@@ -0,0 +1,115 @@
+package manager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/dino16m/clippa-server/internal/service"
+)
+
+type MemberRoleRequest struct {
+	Role service.Role `json:"role"`
+}
+
+type MemberModeRequest struct {
+	Mode service.Mode `json:"mode"`
+}
+
+// requestedMode reads the mode query parameter of a join.
+func requestedMode(r *http.Request) (service.Mode, error) {
+	name := strings.TrimSpace(r.URL.Query().Get("mode"))
+	mode, ok := service.ParseMode(name)
+	if !ok {
+		return "", service.ErrBadRequest.WithMessage(fmt.Sprintf("unknown mode %q", name))
+	}
+	return mode, nil
+}
+
+// writeMemberError answers a failed kick or role change.
+func writeMemberError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, service.ErrForbidden):
+		WriteError(w, http.StatusForbidden, err)
+	case errors.Is(err, service.ErrNotFound):
+		WriteError(w, http.StatusNotFound, err)
+	default:
+		WriteError(w, http.StatusInternalServerError, err)
+	}
+}
+
+// ListMembers returns the roster of connected members.
+func (mc *ManagerCtrl) ListMembers(w http.ResponseWriter, r *http.Request) {
+	granted, ok := mc.authorize(w, r, ScopeManageMembers)
+	if !ok {
+		return
+	}
+	WriteJson(w, http.StatusOK, mc.partyProvider.Members(granted.party.ID.String()))
+}
+
+// KickMember disconnects a member of the party.
+func (mc *ManagerCtrl) KickMember(w http.ResponseWriter, r *http.Request) {
+	granted, ok := mc.authorize(w, r, ScopeManageMembers)
+	if !ok {
+		return
+	}
+
+	memberId := r.PathValue("memberId")
+	if err := mc.partyProvider.Kick(granted.party.ID.String(), granted.role(), memberId); err != nil {
+		writeMemberError(w, err)
+		return
+	}
+	mc.requestLogger(r).WithField("party", granted.party.ID).WithField("member", memberId).Info("kicked member")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SetMemberRole assigns a role to a member of the party, connected or not.
+// The role applies to every later join of the member.
+func (mc *ManagerCtrl) SetMemberRole(w http.ResponseWriter, r *http.Request) {
+	granted, ok := mc.authorize(w, r, ScopeManageMembers)
+	if !ok {
+		return
+	}
+
+	var req MemberRoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteError(w, http.StatusBadRequest, service.ErrBadRequest.WithMessage("invalid request body"))
+		return
+	}
+	role, ok := service.ParseRole(strings.TrimSpace(string(req.Role)))
+	if !ok {
+		WriteError(w, http.StatusBadRequest, service.ErrBadRequest.WithMessage(fmt.Sprintf("unknown role %q", req.Role)))
+		return
+	}
+	if err := mc.partyProvider.SetRole(granted.party.ID.String(), granted.role(), r.PathValue("memberId"), role); err != nil {
+		writeMemberError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SetMemberMode changes the mode of a connected member until it leaves.
+func (mc *ManagerCtrl) SetMemberMode(w http.ResponseWriter, r *http.Request) {
+	granted, ok := mc.authorize(w, r, ScopeManageMembers)
+	if !ok {
+		return
+	}
+
+	var req MemberModeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteError(w, http.StatusBadRequest, service.ErrBadRequest.WithMessage("invalid request body"))
+		return
+	}
+	mode, ok := service.ParseMode(strings.TrimSpace(string(req.Mode)))
+	if !ok || req.Mode == "" {
+		WriteError(w, http.StatusBadRequest, service.ErrBadRequest.WithMessage(fmt.Sprintf("unknown mode %q", req.Mode)))
+		return
+	}
+	if err := mc.partyProvider.SetMode(granted.party.ID.String(), granted.role(), r.PathValue("memberId"), mode); err != nil {
+		writeMemberError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
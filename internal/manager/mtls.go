@@ -0,0 +1,122 @@
+package manager
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/dino16m/clippa-server/internal/service"
+)
+
+// Client certificates name their party and member: the first organization of
+// the subject is the party ID and the common name the member ID. They must be
+// signed by the party's CA for client authentication.
+
+// certFingerprint returns the hex SHA-256 of cert, as devices are enrolled
+// with.
+func certFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// peerCertificate returns the client certificate of a request made over
+// mutual TLS, if any.
+func peerCertificate(r *http.Request) (*x509.Certificate, bool) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil, false
+	}
+	return r.TLS.PeerCertificates[0], true
+}
+
+// joinMembership returns what a join request is granted: by its client
+// certificate when it has one and no token, else by its join token.
+func (mc *ManagerCtrl) joinMembership(w http.ResponseWriter, r *http.Request) (membership, error) {
+	if _, ok := peerCertificate(r); ok && !r.URL.Query().Has("token") {
+		return mc.certMembership(w, r)
+	}
+	return mc.validatePartyMembership(w, r)
+}
+
+// certMembership checks the client certificate of r against the CA of the
+// party it names. Certificates of enrolled devices must match the enrolled
+// fingerprint and join with the device's role; other certificates join as
+// members.
+func (mc *ManagerCtrl) certMembership(w http.ResponseWriter, r *http.Request) (membership, error) {
+	leaf, _ := peerCertificate(r)
+	memberId := strings.TrimSpace(leaf.Subject.CommonName)
+	partyId := ""
+	if len(leaf.Subject.Organization) > 0 {
+		partyId = strings.TrimSpace(leaf.Subject.Organization[0])
+	}
+	if partyId == "" || memberId == "" {
+		WriteError(w, http.StatusBadRequest, service.ErrBadRequest.WithMessage("the client certificate must name a party and a member"))
+		return membership{}, errors.New("incomplete client certificate")
+	}
+	if idFromURL := strings.TrimSpace(r.URL.Query().Get("id")); idFromURL != "" && idFromURL != partyId {
+		WriteError(w, http.StatusUnauthorized, service.ErrUnauthorized)
+		return membership{}, errors.New("client certificate does not match party id")
+	}
+
+	ip := clientIP(r, mc.trustProxy)
+	if mc.rejectLockedOut(w, ip, partyId) {
+		return membership{}, errors.New("locked out")
+	}
+	if err := mc.verifyClientCert(partyId, r.TLS.PeerCertificates); err != nil {
+		mc.requestLogger(r).WithError(err).WithField("party", partyId).WithField("member", memberId).Warn("invalid client certificate")
+		mc.recordFailure(ip, partyId, credentialCertificate)
+		WriteError(w, http.StatusUnauthorized, service.ErrUnauthorized)
+		return membership{}, err
+	}
+	mc.recordSuccess(partyId)
+
+	granted := membership{partyId: partyId, role: service.RoleMember, memberId: memberId}
+	if mc.devices == nil {
+		return granted, nil
+	}
+	device, err := mc.devices.Get(partyId, memberId)
+	if err != nil {
+		return granted, nil
+	}
+	if device.CertFingerprint != certFingerprint(leaf) {
+		WriteError(w, http.StatusForbidden, service.ErrForbidden.WithMessage("the member id belongs to an enrolled device"))
+		return membership{}, errors.New("client certificate is not the enrolled one")
+	}
+	if err := mc.devices.Touch(device); err != nil {
+		mc.requestLogger(r).WithError(err).WithField("member", memberId).Warn("failed to record device use")
+	}
+	if role, ok := service.ParseRole(device.Role); ok {
+		granted.role = role
+	}
+	return granted, nil
+}
+
+// verifyClientCert checks that chain, leaf first, leads to the CA of party
+// partyId.
+func (mc *ManagerCtrl) verifyClientCert(partyId string, chain []*x509.Certificate) error {
+	party, err := mc.store.Get(partyId)
+	if err != nil {
+		return err
+	}
+	caPEM, err := base64.StdEncoding.DecodeString(party.CertPEM)
+	if err != nil {
+		return err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		return errors.New("party has no CA certificate")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err = chain[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return err
+}
@@ -0,0 +1,102 @@
+package manager
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/dino16m/clippa-server/internal/service"
+)
+
+// subprotocolPrefix names the websocket subprotocols clients can offer to
+// negotiate a protocol version and encoding, e.g. clippa.v2 or
+// clippa.v2+cbor.
+const subprotocolPrefix = "clippa.v"
+
+// preferredEncodings are the non-default encodings the server offers, in
+// order of preference.
+var preferredEncodings = []service.Codec{service.CBORCodec}
+
+// subprotocols lists the subprotocols the server accepts, in order of
+// preference: newer versions first and, within a version, compact encodings
+// before JSON.
+func subprotocols() []string {
+	protocols := []string{}
+	for _, version := range service.SupportedVersions() {
+		name := subprotocolPrefix + strconv.Itoa(version)
+		for _, codec := range preferredEncodings {
+			protocols = append(protocols, name+"+"+codec.Name())
+		}
+		protocols = append(protocols, name)
+	}
+	return protocols
+}
+
+// memberProtocol is what a member asked for with the version and encoding
+// query parameters. Zero values were not asked for.
+type memberProtocol struct {
+	version int
+	codec   service.Codec
+}
+
+func requestedProtocol(r *http.Request) (memberProtocol, error) {
+	var requested memberProtocol
+	q := r.URL.Query()
+	if raw := strings.TrimSpace(q.Get("version")); raw != "" {
+		version, err := strconv.Atoi(raw)
+		if err != nil || !service.IsSupportedVersion(version) {
+			return requested, service.ErrUnsupportedVersion.WithMessage(fmt.Sprintf("protocol version %q is not supported, use one of %v", raw, service.SupportedVersions()))
+		}
+		requested.version = version
+	}
+	if name := strings.TrimSpace(q.Get("encoding")); name != "" {
+		codec, ok := service.CodecByName(name)
+		if !ok {
+			return requested, service.ErrUnsupportedEncoding.WithMessage(fmt.Sprintf("encoding %q is not supported", name))
+		}
+		requested.codec = codec
+	}
+	return requested, nil
+}
+
+// subprotocols lists the subprotocols the server accepts that agree with
+// what the member asked for in the query, so the handshake never names a
+// protocol other than the one spoken. With none left, the handshake selects
+// no subprotocol and the query decides.
+func (requested memberProtocol) subprotocols() []string {
+	matching := []string{}
+	for _, name := range subprotocols() {
+		offered := memberProtocol{}.negotiate(name)
+		if requested.version != 0 && requested.version != offered.version {
+			continue
+		}
+		if requested.codec != nil && requested.codec.Name() != offered.codec.Name() {
+			continue
+		}
+		matching = append(matching, name)
+	}
+	return matching
+}
+
+// negotiate settles the protocol of a member: what it asked for in the query,
+// else what the subprotocol the server selected says, else version 1 in JSON.
+func (requested memberProtocol) negotiate(subprotocol string) memberProtocol {
+	negotiated := memberProtocol{version: service.ProtocolV1, codec: service.JSONCodec}
+	if rest, ok := strings.CutPrefix(subprotocol, subprotocolPrefix); ok {
+		rawVersion, encoding, _ := strings.Cut(rest, "+")
+		if version, err := strconv.Atoi(rawVersion); err == nil {
+			negotiated.version = version
+		}
+		if codec, ok := service.CodecByName(encoding); ok {
+			negotiated.codec = codec
+		}
+	}
+	if requested.version != 0 {
+		negotiated.version = requested.version
+	}
+	if requested.codec != nil {
+		negotiated.codec = requested.codec
+	}
+	return negotiated
+}
@@ -0,0 +1,70 @@
+package manager
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/dino16m/clippa-server/internal/service"
+)
+
+// pushSenderPrefix marks the sender of pushed clipboard items, so they cannot
+// be mistaken for a member's.
+const pushSenderPrefix = "api:"
+
+// PushClipboard relays a clipboard item to the members of a party without
+// joining it. A JSON body is a clipboard message's data; a text body is the
+// content itself, typed by its Content-Type. The optional sender query
+// parameter names the pushing client.
+func (mc *ManagerCtrl) PushClipboard(w http.ResponseWriter, r *http.Request) {
+	granted, ok := mc.authorize(w, r, ScopePushClipboard)
+	if !ok {
+		return
+	}
+	party := granted.party
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, mc.partyProvider.MaxFrameSize()))
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			WriteError(w, http.StatusRequestEntityTooLarge, service.ErrPayloadTooLarge.WithMessage("clipboard item too large"))
+			return
+		}
+		WriteError(w, http.StatusBadRequest, service.ErrBadRequest.WithMessage("could not read clipboard item"))
+		return
+	}
+
+	var data service.ClipboardData
+	mimeType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mimeType {
+	case "application/json":
+		if err := json.Unmarshal(body, &data); err != nil {
+			WriteError(w, http.StatusBadRequest, service.ErrBadRequest.WithMessage("invalid clipboard item"))
+			return
+		}
+	case "":
+		data = service.ClipboardData{Content: string(body), MimeType: "text/plain"}
+	default:
+		// content travels as a JSON string, which binary data would not survive
+		if !strings.HasPrefix(mimeType, "text/") {
+			WriteError(w, http.StatusUnsupportedMediaType, service.ErrBadRequest.WithMessage("only text can be pushed, upload other content as a blob"))
+			return
+		}
+		data = service.ClipboardData{Content: string(body), MimeType: mimeType}
+	}
+
+	sender := pushSenderPrefix + strings.TrimSpace(r.URL.Query().Get("sender"))
+	result, err := mc.partyProvider.PushClipboard(party.ID.String(), sender, data)
+	switch {
+	case err == nil:
+		mc.requestLogger(r).WithField("party", party.ID).WithField("sender", sender).WithField("delivered", result.Delivered).Info("pushed clipboard item")
+		WriteJson(w, http.StatusOK, result)
+	case errors.Is(err, service.ErrRateLimited):
+		WriteError(w, http.StatusTooManyRequests, err)
+	default:
+		WriteError(w, http.StatusBadRequest, err)
+	}
+}
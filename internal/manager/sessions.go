@@ -0,0 +1,448 @@
+package manager
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dino16m/clippa-server/internal/service"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// sessionQueueSize is how many frames may wait for an HTTP member to
+	// fetch them before it is disconnected as a slow consumer.
+	sessionQueueSize = 256
+	// sessionIdleTimeout is how long a session without a stream or poll
+	// attached stays in its party.
+	sessionIdleTimeout = time.Minute
+	// pollWait is the longest a long-poll waits for messages.
+	pollWait = 25 * time.Second
+	// keepaliveInterval is how often an idle event stream sends a comment so
+	// proxies keep it open.
+	keepaliveInterval = 15 * time.Second
+)
+
+// session is a party member connected over HTTP instead of a websocket. It
+// receives messages through an event stream or long-polls and sends them with
+// POST requests. A pump moves frames from the member's inbox into a queue, so
+// the member stays in the party between requests.
+type session struct {
+	id       string
+	partyId  string
+	handle   *service.PartyHandle
+	mutex    sync.Mutex
+	queue    []service.Frame
+	notify   chan struct{}
+	closed   bool
+	reason   service.DisconnectReason
+	idle     *time.Timer
+	readLock sync.Mutex
+	done     chan struct{}
+	// release ends the hold on the member's join token.
+	release func()
+}
+
+// sessions holds the HTTP members of every party by session ID.
+type sessions struct {
+	mutex    sync.Mutex
+	sessions map[string]*session
+}
+
+func newSessions() *sessions {
+	return &sessions{sessions: map[string]*session{}}
+}
+
+func (s *sessions) get(id string) (*session, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	sess, ok := s.sessions[id]
+	return sess, ok
+}
+
+func (s *sessions) remove(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.sessions, id)
+}
+
+// openSession joins the member to the party granted and starts pumping its
+// inbox.
+func (mc *ManagerCtrl) openSession(granted membership, memberId string, opts ...service.JoinOption) (*session, error) {
+	partyId := granted.partyId
+	handle, err := mc.partyProvider.JoinParty(partyId, memberId, opts...)
+	if err != nil {
+		return nil, err
+	}
+	id, _ := SecureRandomString(32)
+	sess := &session{
+		id:      id,
+		partyId: partyId,
+		handle:  handle,
+		notify:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		release: mc.holdToken(granted, memberId),
+	}
+	sess.idle = time.AfterFunc(sessionIdleTimeout, func() {
+		mc.logger.WithField("party", partyId).WithField("member", memberId).Info("session idle, leaving party")
+		mc.closeSession(sess)
+	})
+	mc.sessions.mutex.Lock()
+	mc.sessions.sessions[id] = sess
+	mc.sessions.mutex.Unlock()
+
+	go mc.pumpSession(sess)
+	return sess, nil
+}
+
+// pumpSession queues the frames of the member's inbox until the inbox is
+// closed or the session ends.
+func (mc *ManagerCtrl) pumpSession(sess *session) {
+	for {
+		select {
+		case <-sess.done:
+			return
+		case frame, ok := <-sess.handle.Inbox():
+			sess.mutex.Lock()
+			if !ok {
+				sess.closed = true
+				sess.reason = sess.handle.CloseReason()
+				sess.mutex.Unlock()
+				sess.release()
+				// kept until idle, so the member can still learn why it ended
+				sess.idle.Reset(sessionIdleTimeout)
+				sess.wake()
+				return
+			}
+			full := len(sess.queue) >= sessionQueueSize
+			if !full {
+				sess.queue = append(sess.queue, frame)
+			}
+			sess.mutex.Unlock()
+			if full {
+				mc.partyProvider.Disconnect(sess.partyId, sess.handle.ID(), service.ReasonSlowConsumer)
+				continue
+			}
+			sess.wake()
+		}
+	}
+}
+
+// closeSession takes the member out of its party and forgets the session.
+func (mc *ManagerCtrl) closeSession(sess *session) {
+	mc.sessions.remove(sess.id)
+	sess.release()
+	sess.mutex.Lock()
+	if sess.closed {
+		sess.mutex.Unlock()
+		return
+	}
+	sess.closed = true
+	sess.mutex.Unlock()
+	sess.idle.Stop()
+	close(sess.done)
+	sess.handle.Leave()
+	sess.wake()
+}
+
+func (s *session) wake() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// take removes the queued frames. closed is set once the session has ended
+// and nothing is left to fetch.
+func (s *session) take() (frames []service.Frame, closed bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	frames, s.queue = s.queue, nil
+	return frames, s.closed && len(frames) == 0
+}
+
+// attach marks a reader as fetching the session's messages, returning false
+// if another reader already is.
+func (s *session) attach() bool {
+	if !s.readLock.TryLock() {
+		return false
+	}
+	s.idle.Stop()
+	return true
+}
+
+// detach ends a reader. Closed sessions are forgotten once idle too.
+func (s *session) detach() {
+	s.idle.Reset(sessionIdleTimeout)
+	s.readLock.Unlock()
+}
+
+// ended reports whether the member has left the party or been disconnected.
+func (s *session) ended() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.closed
+}
+
+func (s *session) closeError() error {
+	return service.ErrSessionClosed.WithMessage(s.reason.String())
+}
+
+// SessionResponse is returned when an HTTP member joins a party.
+type SessionResponse struct {
+	SessionID string `json:"sessionId"`
+	MemberID  string `json:"memberId"`
+}
+
+// PollEvent is a message fetched by a long-poll: a JSON message, or a binary
+// frame in the layout websocket members receive.
+type PollEvent struct {
+	Message json.RawMessage `json:"message,omitempty"`
+	Binary  []byte          `json:"binary,omitempty"`
+}
+
+type PollResponse struct {
+	Events []PollEvent `json:"events"`
+}
+
+// joinOverHTTP validates the join token of the request and opens a session.
+// HTTP members always use JSON.
+func (mc *ManagerCtrl) joinOverHTTP(w http.ResponseWriter, r *http.Request) (*session, bool) {
+	if mc.Draining() {
+		WriteError(w, http.StatusServiceUnavailable, service.ErrShuttingDown)
+		return nil, false
+	}
+	requested, err := requestedProtocol(r)
+	if err == nil && requested.codec != nil && requested.codec != service.JSONCodec {
+		err = service.ErrUnsupportedEncoding.WithMessage("HTTP members must use json")
+	}
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, err)
+		return nil, false
+	}
+	mode, err := requestedMode(r)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, err)
+		return nil, false
+	}
+	granted, err := mc.joinMembership(w, r)
+	if err != nil {
+		return nil, false
+	}
+	memberId, supersede, ok := mc.joinIdentity(w, r, granted)
+	if !ok {
+		return nil, false
+	}
+	version := requested.negotiate("").version
+	sess, err := mc.openSession(granted, memberId,
+		service.WithProtocolVersion(version),
+		service.WithRole(granted.role),
+		service.WithVerifiedIdentity(granted.memberId != ""),
+		service.WithMode(mode),
+		service.WithSupersede(supersede),
+		service.WithLogFields(logrus.Fields{"request_id": requestID(r)}),
+	)
+	if errors.Is(err, service.ErrShuttingDown) {
+		WriteError(w, http.StatusServiceUnavailable, err)
+		return nil, false
+	}
+	if errors.Is(err, service.ErrForbidden) {
+		WriteError(w, http.StatusForbidden, err)
+		return nil, false
+	}
+	if err != nil {
+		WriteError(w, http.StatusConflict, err)
+		return nil, false
+	}
+	mc.requestLogger(r).WithField("party", granted.partyId).WithField("member", memberId).WithField("version", version).Info("joined party over http")
+	return sess, true
+}
+
+// sessionFromRequest looks up the session named by the session query
+// parameter.
+func (mc *ManagerCtrl) sessionFromRequest(w http.ResponseWriter, r *http.Request) (*session, bool) {
+	sess, ok := mc.sessions.get(r.URL.Query().Get("session"))
+	if !ok {
+		WriteError(w, http.StatusNotFound, service.ErrNotFound.WithMessage("no such session"))
+		return nil, false
+	}
+	return sess, true
+}
+
+// CreateSession joins a party over HTTP, for members that then long-poll.
+func (mc *ManagerCtrl) CreateSession(w http.ResponseWriter, r *http.Request) {
+	sess, ok := mc.joinOverHTTP(w, r)
+	if !ok {
+		return
+	}
+	WriteJson(w, http.StatusCreated, SessionResponse{SessionID: sess.id, MemberID: sess.handle.ID()})
+}
+
+// DeleteSession leaves the party.
+func (mc *ManagerCtrl) DeleteSession(w http.ResponseWriter, r *http.Request) {
+	sess, ok := mc.sessionFromRequest(w, r)
+	if !ok {
+		return
+	}
+	mc.closeSession(sess)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// StreamSession sends the messages of a session as server-sent events. With
+// id and token instead of a session it joins the party first and announces
+// the new session in a session event.
+func (mc *ManagerCtrl) StreamSession(w http.ResponseWriter, r *http.Request) {
+	var sess *session
+	var ok bool
+	if r.URL.Query().Has("session") {
+		sess, ok = mc.sessionFromRequest(w, r)
+	} else {
+		sess, ok = mc.joinOverHTTP(w, r)
+	}
+	if !ok {
+		return
+	}
+	if !sess.attach() {
+		WriteError(w, http.StatusConflict, service.ErrSessionBusy)
+		return
+	}
+	defer sess.detach()
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	announce, _ := json.Marshal(SessionResponse{SessionID: sess.id, MemberID: sess.handle.ID()})
+	writeEvent(w, "session", string(announce))
+	rc.Flush()
+
+	keepalive := time.NewTicker(keepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		frames, closed := sess.take()
+		for _, frame := range frames {
+			if frame.Binary {
+				writeEvent(w, "binary", base64.StdEncoding.EncodeToString(frame.Data))
+			} else {
+				writeEvent(w, "", string(frame.Data))
+			}
+		}
+		if closed {
+			reason, _ := json.Marshal(map[string]any{"code": int(closeStatus(sess.reason)), "reason": sess.reason.String()})
+			writeEvent(w, "close", string(reason))
+			rc.Flush()
+			mc.sessions.remove(sess.id)
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-sess.notify:
+		case <-keepalive.C:
+			io.WriteString(w, ": keepalive\n\n")
+		}
+	}
+}
+
+// writeEvent writes a server-sent event. data must not contain newlines,
+// which holds for compact JSON and base64.
+func writeEvent(w io.Writer, event, data string) {
+	if event != "" {
+		fmt.Fprintf(w, "event: %s\n", event)
+	}
+	fmt.Fprintf(w, "data: %s\n\n", data)
+}
+
+// PollSession long-polls the messages of a session, waiting until at least
+// one arrives or pollWait passes.
+func (mc *ManagerCtrl) PollSession(w http.ResponseWriter, r *http.Request) {
+	sess, ok := mc.sessionFromRequest(w, r)
+	if !ok {
+		return
+	}
+	if !sess.attach() {
+		WriteError(w, http.StatusConflict, service.ErrSessionBusy)
+		return
+	}
+	defer sess.detach()
+
+	ctx, cancel := context.WithTimeout(r.Context(), pollWait)
+	defer cancel()
+	for {
+		frames, closed := sess.take()
+		if closed {
+			mc.sessions.remove(sess.id)
+			WriteError(w, http.StatusGone, sess.closeError())
+			return
+		}
+		if len(frames) > 0 {
+			resp := PollResponse{Events: make([]PollEvent, 0, len(frames))}
+			for _, frame := range frames {
+				if frame.Binary {
+					resp.Events = append(resp.Events, PollEvent{Binary: frame.Data})
+				} else {
+					resp.Events = append(resp.Events, PollEvent{Message: frame.Data})
+				}
+			}
+			WriteJson(w, http.StatusOK, resp)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			WriteJson(w, http.StatusOK, PollResponse{Events: []PollEvent{}})
+			return
+		case <-sess.notify:
+		}
+	}
+}
+
+// PostMessage sends a message from a session to its party. The body is a JSON
+// message, or a binary frame when sent as application/octet-stream.
+func (mc *ManagerCtrl) PostMessage(w http.ResponseWriter, r *http.Request) {
+	sess, ok := mc.sessionFromRequest(w, r)
+	if !ok {
+		return
+	}
+	if sess.ended() {
+		WriteError(w, http.StatusGone, sess.closeError())
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, mc.partyProvider.MaxFrameSize()))
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			WriteError(w, http.StatusRequestEntityTooLarge, service.ErrPayloadTooLarge.WithMessage("message too large"))
+			return
+		}
+		WriteError(w, http.StatusBadRequest, service.ErrBadRequest.WithMessage("could not read message"))
+		return
+	}
+	frame := service.Frame{Binary: r.Header.Get("Content-Type") == "application/octet-stream", Data: body}
+
+	err = sess.handle.HandleFrame(frame)
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusAccepted)
+	case errors.Is(err, service.ErrRateLimitAbuse):
+		mc.requestLogger(r).WithField("party", sess.partyId).WithField("member", sess.handle.ID()).Warn("disconnecting member over rate limit")
+		mc.partyProvider.Disconnect(sess.partyId, sess.handle.ID(), service.ReasonRateLimited)
+		WriteError(w, http.StatusTooManyRequests, err)
+	case errors.Is(err, service.ErrRateLimited):
+		WriteError(w, http.StatusTooManyRequests, err)
+	case errors.Is(err, service.ErrNotConnected):
+		WriteError(w, http.StatusGone, err)
+	default:
+		WriteError(w, http.StatusBadRequest, err)
+	}
+}
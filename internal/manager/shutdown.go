@@ -0,0 +1,67 @@
+package manager
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// drain tracks the connections being served so shutdown can wait for them.
+type drain struct {
+	mutex    sync.Mutex
+	draining bool
+	active   sync.WaitGroup
+}
+
+// enter counts a connection in, unless the server is shutting down.
+func (d *drain) enter() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.draining {
+		return false
+	}
+	d.active.Add(1)
+	return true
+}
+
+func (d *drain) leave() {
+	d.active.Done()
+}
+
+func (d *drain) start() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.draining = true
+}
+
+// Draining reports whether the server is shutting down.
+func (mc *ManagerCtrl) Draining() bool {
+	mc.drain.mutex.Lock()
+	defer mc.drain.mutex.Unlock()
+	return mc.drain.draining
+}
+
+// Shutdown stops members from joining and tells every connected member to
+// reconnect after reconnectAfter. Their connections are closed with
+// StatusGoingAway once they have been sent the messages queued for them.
+// Shutdown waits for that until ctx is done, returning ctx's error if the
+// connections did not close in time. HTTP transport sessions end with a close
+// event, which the server's own shutdown waits for.
+func (mc *ManagerCtrl) Shutdown(ctx context.Context, reconnectAfter time.Duration) error {
+	mc.drain.start()
+	mc.partyProvider.Shutdown(reconnectAfter)
+
+	closed := make(chan struct{})
+	go func() {
+		mc.drain.active.Wait()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		mc.logger.Info("closed all member connections")
+		return nil
+	case <-ctx.Done():
+		mc.logger.Warn("member connections did not close before the shutdown deadline")
+		return ctx.Err()
+	}
+}
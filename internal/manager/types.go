@@ -1,6 +1,10 @@
 package manager
 
-import "github.com/google/uuid"
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
 
 type PartyCreateRequest struct {
 	Name   string `json:"name"`
@@ -28,3 +32,12 @@ type PartyResponse struct {
 	CertPEM       string    `json:"certPem,omitempty"`
 	KeyPEM        string    `json:"keyPem,omitempty"`
 }
+
+type BlobResponse struct {
+	ID        uuid.UUID `json:"id"`
+	MimeType  string    `json:"mimeType"`
+	Size      int64     `json:"size"`
+	Checksum  string    `json:"checksum"`
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
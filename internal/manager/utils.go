@@ -9,9 +9,13 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
+	"math"
 	"math/big"
 	"net/http"
+	"strconv"
 	"time"
+
+	"github.com/dino16m/clippa-server/internal/service"
 )
 
 // CABundle holds PEM bytes and parsed objects for a generated CA.
@@ -143,3 +147,13 @@ func WriteJson(w http.ResponseWriter, status int, v any) {
 		http.Error(w, "internal error", http.StatusInternalServerError)
 	}
 }
+
+// WriteError writes err as a JSON ProtocolError with the given status code,
+// setting Retry-After when the error says when to retry.
+func WriteError(w http.ResponseWriter, status int, err error) {
+	perr := service.AsProtocolError(err)
+	if perr.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(perr.RetryAfter.Seconds()))))
+	}
+	WriteJson(w, status, perr)
+}
@@ -0,0 +1,113 @@
+// Package metrics defines the Prometheus metrics of the server.
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "clippa"
+
+// Metrics are the server's metrics, shared by the manager and the party
+// services.
+type Metrics struct {
+	PartiesCreated   prometheus.Counter
+	ActiveParties    prometheus.Gauge
+	ConnectedMembers prometheus.Gauge
+	// Messages counts the messages accepted from members, by type.
+	Messages *prometheus.CounterVec
+	// BytesRelayed counts the bytes handed to members' inboxes.
+	BytesRelayed prometheus.Counter
+	// SendTimeouts counts members that did not take a message in time.
+	SendTimeouts prometheus.Counter
+	// AuthFailures counts failed credential checks, by credential.
+	AuthFailures *prometheus.CounterVec
+	// Bcrypt times hashing and comparing party secrets, by operation.
+	Bcrypt *prometheus.HistogramVec
+	// Elections counts the election outcomes members report, by outcome.
+	Elections *prometheus.CounterVec
+	// SocketMessageBytes and SocketWireBytes count, by direction, the bytes
+	// of the messages exchanged with websocket members and the bytes that
+	// went over the wire for them, framing and compression included. Wire
+	// bytes over message bytes is the compression ratio.
+	SocketMessageBytes *prometheus.CounterVec
+	SocketWireBytes    *prometheus.CounterVec
+}
+
+// New creates the metrics and registers them with reg. With a nil reg the
+// metrics are recorded but not exported.
+func New(reg prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		PartiesCreated: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "parties_created_total",
+			Help:      "Parties created.",
+		}),
+		ActiveParties: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "active_parties",
+			Help:      "Parties with a running party service.",
+		}),
+		ConnectedMembers: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "connected_members",
+			Help:      "Members connected to a party.",
+		}),
+		Messages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "messages_total",
+			Help:      "Messages accepted from members, by type.",
+		}, []string{"type"}),
+		BytesRelayed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "relayed_bytes_total",
+			Help:      "Bytes of the frames relayed to members.",
+		}),
+		SendTimeouts: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "send_timeouts_total",
+			Help:      "Frames a member did not take in time.",
+		}),
+		AuthFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "auth_failures_total",
+			Help:      "Failed credential checks, by credential.",
+		}, []string{"credential"}),
+		Bcrypt: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "bcrypt_duration_seconds",
+			Help:      "Time spent hashing and comparing party secrets, by operation.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 2, 10),
+		}, []string{"operation"}),
+		Elections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "election_outcomes_total",
+			Help:      "Leader election outcomes reported by members, by outcome.",
+		}, []string{"outcome"}),
+		SocketMessageBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "websocket_message_bytes_total",
+			Help:      "Bytes of the messages exchanged with websocket members, by direction.",
+		}, []string{"direction"}),
+		SocketWireBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "websocket_wire_bytes_total",
+			Help:      "Bytes sent and received on member websockets, framing and compression included, by direction.",
+		}, []string{"direction"}),
+	}
+	if reg != nil {
+		reg.MustRegister(
+			m.PartiesCreated, m.ActiveParties, m.ConnectedMembers, m.Messages,
+			m.BytesRelayed, m.SendTimeouts, m.AuthFailures, m.Bcrypt, m.Elections,
+			m.SocketMessageBytes, m.SocketWireBytes,
+		)
+	}
+	return m
+}
+
+// ObserveBcrypt records how long a bcrypt operation that started at start
+// took.
+func (m *Metrics) ObserveBcrypt(operation string, start time.Time) {
+	m.Bcrypt.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,158 @@
+package service
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Frame is a single websocket message queued for a member. Binary frames
+// carry a JSON header followed by raw payload bytes, see encodeBinaryFrame.
+type Frame struct {
+	Binary bool
+	Data   []byte
+}
+
+func TextFrame(msg []byte) Frame {
+	return Frame{Data: msg}
+}
+
+// binaryHeaderLen is the size of the big-endian length prefix that precedes
+// the JSON header of a binary frame.
+const binaryHeaderLen = 4
+
+// encodeBinaryFrame lays out a binary frame as
+//
+//	| header length (uint32, big-endian) | JSON header | payload |
+//
+// where the payload is the concatenated content of every binary
+// representation listed in the header, in order.
+func encodeBinaryFrame(header, payload []byte) Frame {
+	data := make([]byte, binaryHeaderLen+len(header)+len(payload))
+	binary.BigEndian.PutUint32(data, uint32(len(header)))
+	copy(data[binaryHeaderLen:], header)
+	copy(data[binaryHeaderLen+len(header):], payload)
+	return Frame{Binary: true, Data: data}
+}
+
+func decodeBinaryFrame(data []byte) (header, payload []byte, err error) {
+	if len(data) < binaryHeaderLen {
+		return nil, nil, errors.New("binary frame too short")
+	}
+	n := binary.BigEndian.Uint32(data)
+	if uint64(n) > uint64(len(data)-binaryHeaderLen) {
+		return nil, nil, errors.New("binary frame header length out of range")
+	}
+	header = data[binaryHeaderLen : binaryHeaderLen+int(n)]
+	payload = data[binaryHeaderLen+int(n):]
+	return header, payload, nil
+}
+
+// SizeLimits maps MIME type patterns such as "image/*" to the largest
+// clipboard representation of that type, in bytes. "*" matches any type.
+type SizeLimits map[string]int
+
+// DefaultSizeLimits are applied unless overridden with WithClipboardLimit.
+func DefaultSizeLimits() SizeLimits {
+	return SizeLimits{
+		"text/*":  1 << 20,
+		"image/*": 10 << 20,
+		"*":       5 << 20,
+	}
+}
+
+// limitFor returns the limit of the most specific pattern matching mimeType.
+func (l SizeLimits) limitFor(mimeType string) int {
+	if limit, ok := l[mimeType]; ok {
+		return limit
+	}
+	major, _, _ := strings.Cut(mimeType, "/")
+	if limit, ok := l[major+"/*"]; ok {
+		return limit
+	}
+	for pattern, limit := range l {
+		if pattern == "*" {
+			continue
+		}
+		if ok, _ := path.Match(pattern, mimeType); ok {
+			return limit
+		}
+	}
+	return l["*"]
+}
+
+// maxLimit returns the largest limit of any type.
+func (l SizeLimits) maxLimit() int {
+	largest := 0
+	for _, limit := range l {
+		largest = max(largest, limit)
+	}
+	return largest
+}
+
+// validateClipboard checks that every representation has a type, fits its
+// size limit and that binary representations account for exactly payloadSize
+// bytes.
+func validateClipboard(data ClipboardData, payloadSize int, limits SizeLimits) error {
+	if len(data.Representations) == 0 {
+		mimeType := data.MimeType
+		if mimeType == "" {
+			mimeType = "text/plain"
+		}
+		if payloadSize != 0 {
+			return errors.New("binary payload without binary representations")
+		}
+		if len(data.Content) > limits.limitFor(mimeType) {
+			return fmt.Errorf("%s content exceeds size limit", mimeType)
+		}
+		return nil
+	}
+
+	binarySize := 0
+	for _, rep := range data.Representations {
+		if rep.MimeType == "" {
+			return errors.New("representation without mime type")
+		}
+		if rep.BlobID != "" {
+			// blobs are limited by the blob store, not the message size
+			if rep.Binary || rep.Content != "" {
+				return fmt.Errorf("blob %s representation must not carry content", rep.MimeType)
+			}
+			continue
+		}
+		size := len(rep.Content)
+		if rep.Binary {
+			if rep.Content != "" || rep.Size <= 0 {
+				return fmt.Errorf("binary %s representation must have a size and no inline content", rep.MimeType)
+			}
+			size = rep.Size
+			binarySize += rep.Size
+		}
+		if size > limits.limitFor(rep.MimeType) {
+			return fmt.Errorf("%s representation exceeds size limit", rep.MimeType)
+		}
+	}
+	if binarySize != payloadSize {
+		return fmt.Errorf("binary representations total %d bytes, payload has %d", binarySize, payloadSize)
+	}
+	return nil
+}
+
+// checkBlobs verifies that the blobs data references were uploaded to party
+// partyId and have not expired.
+func (c config) checkBlobs(partyId string, data ClipboardData) error {
+	for _, rep := range data.Representations {
+		if rep.BlobID == "" {
+			continue
+		}
+		if c.blobs == nil {
+			return ErrInvalidMessage.WithMessage("blobs are not enabled")
+		}
+		if _, err := c.blobs.Get(partyId, rep.BlobID); err != nil {
+			return ErrInvalidMessage.WithMessage(fmt.Sprintf("blob %s is not a blob of this party", rep.BlobID))
+		}
+	}
+	return nil
+}
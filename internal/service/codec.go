@@ -0,0 +1,178 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Codec translates between the frames a member exchanges on its socket and
+// the server's canonical form: JSON text frames, or binary frames with a JSON
+// header. Members of a party may use different codecs; every frame relayed to
+// a member is encoded with that member's codec.
+type Codec interface {
+	// Name is the encoding's name in subprotocols, e.g. "cbor".
+	Name() string
+	// Decode parses a frame received from a member into its message and the
+	// binary payload that came with it, if any. The message data is left in
+	// the codec's encoding until its type is known.
+	Decode(frame Frame) (Message[RawData], []byte, error)
+	// Encode renders a canonical frame for a member.
+	Encode(frame Frame) (Frame, error)
+}
+
+var (
+	JSONCodec Codec = jsonCodec{}
+	CBORCodec Codec = cborCodec{}
+)
+
+var codecs = map[string]Codec{
+	JSONCodec.Name(): JSONCodec,
+	CBORCodec.Name(): CBORCodec,
+}
+
+// CodecByName returns the codec called name.
+func CodecByName(name string) (Codec, bool) {
+	codec, ok := codecs[name]
+	return codec, ok
+}
+
+// splitFrame returns the header and payload of a canonical frame.
+func splitFrame(frame Frame) ([]byte, []byte, error) {
+	if !frame.Binary {
+		return frame.Data, nil, nil
+	}
+	return decodeBinaryFrame(frame.Data)
+}
+
+// jsonCodec is the default encoding, which is also the canonical form.
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Decode(frame Frame) (Message[RawData], []byte, error) {
+	header, payload, err := splitFrame(frame)
+	if err != nil {
+		return Message[RawData]{}, nil, err
+	}
+	message, err := parseRawMessage(header)
+	return message, payload, err
+}
+
+func (jsonCodec) Encode(frame Frame) (Frame, error) {
+	return frame, nil
+}
+
+// cborCodec encodes messages as CBOR (RFC 8949) with the same field names as
+// JSON. Every frame is binary, laid out like a canonical binary frame with a
+// CBOR header and a possibly empty payload.
+type cborCodec struct{}
+
+var (
+	cborDecMode, _ = cbor.DecOptions{DefaultMapType: reflect.TypeOf(map[string]any{})}.DecMode()
+	cborEncMode, _ = cbor.EncOptions{Sort: cbor.SortCoreDeterministic}.EncMode()
+)
+
+func (cborCodec) Name() string {
+	return "cbor"
+}
+
+func (cborCodec) Decode(frame Frame) (Message[RawData], []byte, error) {
+	if !frame.Binary {
+		return Message[RawData]{}, nil, errors.New("cbor messages must be sent as binary frames")
+	}
+	header, payload, err := decodeBinaryFrame(frame.Data)
+	if err != nil {
+		return Message[RawData]{}, nil, err
+	}
+	var message Message[cbor.RawMessage]
+	if err := cborDecMode.Unmarshal(header, &message); err != nil {
+		return Message[RawData]{}, nil, err
+	}
+	if len(payload) == 0 {
+		// only messages with a payload are relayed as binary frames
+		payload = nil
+	}
+	var data RawData = &cborData{raw: message.Data}
+	// absent and null data are empty, as in JSON
+	if len(message.Data) == 0 || bytes.Equal(message.Data, cborNull) {
+		data = emptyData
+	}
+	return Message[RawData]{
+		ID:          message.ID,
+		Data:        data,
+		Sender:      message.Sender,
+		MessageType: message.MessageType,
+		CreatedAt:   message.CreatedAt,
+	}, payload, nil
+}
+
+// cborNull is the encoding of a CBOR null.
+var cborNull = []byte{0xf6}
+
+// cborData is message data received as CBOR. It is rendered as JSON from the
+// value it was decoded into, so it is only decoded once.
+type cborData struct {
+	raw     cbor.RawMessage
+	decoded any
+}
+
+func (d *cborData) Decode(dst any) error {
+	if err := cborDecMode.Unmarshal(d.raw, dst); err != nil {
+		return err
+	}
+	d.decoded = dst
+	return nil
+}
+
+func (d *cborData) JSON() (json.RawMessage, error) {
+	if d.decoded == nil {
+		return nil, errors.New("cbor data is rendered before it is decoded")
+	}
+	return json.Marshal(d.decoded)
+}
+
+func (cborCodec) Encode(frame Frame) (Frame, error) {
+	header, payload, err := splitFrame(frame)
+	if err != nil {
+		return Frame{}, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(header))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return Frame{}, err
+	}
+	encoded, err := cborEncMode.Marshal(fromJSON(value))
+	if err != nil {
+		return Frame{}, err
+	}
+	return encodeBinaryFrame(encoded, payload), nil
+}
+
+// fromJSON converts the numbers of a value decoded with UseNumber to integers
+// where they are whole, so they are not encoded as floats.
+func fromJSON(value any) any {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]any:
+		for key, item := range v {
+			v[key] = fromJSON(item)
+		}
+	case []any:
+		for i, item := range v {
+			v[i] = fromJSON(item)
+		}
+	}
+	return value
+}
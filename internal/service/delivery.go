@@ -0,0 +1,140 @@
+package service
+
+import (
+	"slices"
+	"time"
+)
+
+// delivery tracks the acknowledgements received for a single relayed message.
+type delivery struct {
+	senderId   string
+	recipients []string
+	acked      map[string]bool
+	started    bool
+	timer      *time.Timer
+}
+
+func (d *delivery) report(messageId string, final bool) DeliveryReportData {
+	report := DeliveryReportData{
+		MessageID:   messageId,
+		Total:       len(d.recipients),
+		DeliveredTo: []string{},
+		Final:       final,
+	}
+	for _, id := range d.recipients {
+		if d.acked[id] {
+			report.DeliveredTo = append(report.DeliveredTo, id)
+		} else if final {
+			report.Undelivered = append(report.Undelivered, id)
+		}
+	}
+	report.Delivered = len(report.DeliveredTo)
+	return report
+}
+
+func (d *delivery) complete() bool {
+	for _, id := range d.recipients {
+		if !d.acked[id] {
+			return false
+		}
+	}
+	return true
+}
+
+// trackDelivery registers a message before it is relayed so that acks racing
+// the relay are not lost.
+func (p *PartyService) trackDelivery(messageId, senderId string) {
+	p.deliveryMutex.Lock()
+	defer p.deliveryMutex.Unlock()
+	p.deliveries[messageId] = &delivery{
+		senderId: senderId,
+		acked:    map[string]bool{},
+	}
+}
+
+// startDelivery records the members a tracked message was relayed to and
+// sends the sender its first report.
+func (p *PartyService) startDelivery(messageId string, recipients []string) {
+	p.deliveryMutex.Lock()
+	d, ok := p.deliveries[messageId]
+	if !ok {
+		p.deliveryMutex.Unlock()
+		return
+	}
+	d.recipients = recipients
+	d.started = true
+	final := d.complete()
+	report := d.report(messageId, final)
+	if final {
+		delete(p.deliveries, messageId)
+	} else if p.config.ackTimeout > 0 {
+		d.timer = time.AfterFunc(p.config.ackTimeout, func() {
+			p.expireDelivery(messageId)
+		})
+	}
+	p.deliveryMutex.Unlock()
+
+	p.sendTo(d.senderId, TextFrame(DeliveryReportMessage(report)))
+}
+
+// acknowledge records that memberId received the message and relays the
+// updated report to its sender.
+func (p *PartyService) acknowledge(messageId, memberId string) {
+	p.deliveryMutex.Lock()
+	d, ok := p.deliveries[messageId]
+	if !ok || d.acked[memberId] {
+		p.deliveryMutex.Unlock()
+		return
+	}
+	if d.started && !slices.Contains(d.recipients, memberId) {
+		p.deliveryMutex.Unlock()
+		return
+	}
+	d.acked[memberId] = true
+	if !d.started {
+		p.deliveryMutex.Unlock()
+		return
+	}
+	final := d.complete()
+	report := d.report(messageId, final)
+	if final {
+		if d.timer != nil {
+			d.timer.Stop()
+		}
+		delete(p.deliveries, messageId)
+	}
+	p.deliveryMutex.Unlock()
+
+	p.sendTo(d.senderId, TextFrame(DeliveryReportMessage(report)))
+}
+
+func (p *PartyService) expireDelivery(messageId string) {
+	p.deliveryMutex.Lock()
+	d, ok := p.deliveries[messageId]
+	if !ok {
+		p.deliveryMutex.Unlock()
+		return
+	}
+	report := d.report(messageId, true)
+	delete(p.deliveries, messageId)
+	p.deliveryMutex.Unlock()
+
+	p.logger.WithField("messageId", messageId).WithField("undelivered", len(report.Undelivered)).Debug("delivery timed out")
+	p.sendTo(d.senderId, TextFrame(DeliveryReportMessage(report)))
+}
+
+// dropDeliveries forgets every delivery sent by senderId, since there is no
+// longer anyone to report to.
+func (p *PartyService) dropDeliveries(senderId string) {
+	p.deliveryMutex.Lock()
+	defer p.deliveryMutex.Unlock()
+	for id, d := range p.deliveries {
+		if d.senderId != senderId {
+			continue
+		}
+		if d.timer != nil {
+			d.timer.Stop()
+		}
+		delete(p.deliveries, id)
+	}
+}
@@ -0,0 +1,88 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+)
+
+// maxWrappedKeySize bounds the per-recipient key material of an envelope;
+// the server does not know the scheme, only that keys are small.
+const maxWrappedKeySize = 512
+
+// validateEnvelope checks the shape of an encrypted message without being
+// able to read it.
+func validateEnvelope(data EncryptedData, cfg config) error {
+	if data.KeyID == "" {
+		return errors.New("envelope without sender key id")
+	}
+	if len(data.Nonce) == 0 || len(data.Nonce) > 64 {
+		return errors.New("envelope nonce out of range")
+	}
+	if len(data.Ciphertext) == 0 || len(data.Ciphertext) > cfg.sizeLimits.limitFor("application/octet-stream") {
+		return errors.New("envelope ciphertext out of range")
+	}
+	if len(data.Recipients) == 0 {
+		return errors.New("envelope without recipients")
+	}
+	seen := map[string]bool{}
+	for _, r := range data.Recipients {
+		if r.MemberID == "" || r.KeyID == "" || seen[r.MemberID] {
+			return fmt.Errorf("invalid envelope recipient %q", r.MemberID)
+		}
+		if len(r.WrappedKey) == 0 || len(r.WrappedKey) > maxWrappedKeySize {
+			return fmt.Errorf("wrapped key for %s out of range", r.MemberID)
+		}
+		seen[r.MemberID] = true
+	}
+	return nil
+}
+
+func validateAnnouncement(data KeyAnnounceData) error {
+	if data.KeyID == "" || data.Algorithm == "" {
+		return errors.New("key announcement without key id or algorithm")
+	}
+	if len(data.PublicKey) == 0 || len(data.PublicKey) > maxWrappedKeySize {
+		return errors.New("announced public key out of range")
+	}
+	return nil
+}
+
+func envelopeRecipients(data EncryptedData) []string {
+	ids := make([]string, 0, len(data.Recipients))
+	for _, r := range data.Recipients {
+		ids = append(ids, r.MemberID)
+	}
+	return ids
+}
+
+// announceKey remembers memberId's latest key announcement so that members
+// joining later can be sent it.
+func (p *PartyService) announceKey(memberId string, msg []byte) {
+	p.keysMutex.Lock()
+	defer p.keysMutex.Unlock()
+	p.keys[memberId] = msg
+}
+
+func (p *PartyService) forgetKey(memberId string) {
+	p.keysMutex.Lock()
+	defer p.keysMutex.Unlock()
+	delete(p.keys, memberId)
+}
+
+// replayKeys sends memberId the announcements of every other member.
+func (p *PartyService) replayKeys(memberId string) {
+	p.keysMutex.Lock()
+	announcements := make([][]byte, 0, len(p.keys))
+	for id, msg := range p.keys {
+		if id != memberId {
+			announcements = append(announcements, msg)
+		}
+	}
+	p.keysMutex.Unlock()
+
+	for _, msg := range announcements {
+		if !p.sendTo(memberId, TextFrame(msg)) {
+			return
+		}
+	}
+}
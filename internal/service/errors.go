@@ -0,0 +1,120 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// ProtocolError is an error reported to clients, either as an error message
+// on the websocket or as the JSON body of an HTTP response. Errors compare
+// equal with errors.Is when their codes match, so the values below can be
+// decorated with a message, message ID or retry delay and still be matched.
+type ProtocolError struct {
+	Code       string        `json:"code"`
+	Message    string        `json:"message"`
+	Retryable  bool          `json:"retryable"`
+	MessageID  string        `json:"messageId,omitempty"`
+	RetryAfter time.Duration `json:"-"`
+}
+
+func (e *ProtocolError) Error() string {
+	return e.Code
+}
+
+func (e *ProtocolError) Is(target error) bool {
+	t, ok := target.(*ProtocolError)
+	return ok && t.Code == e.Code
+}
+
+// WithMessage returns a copy of e with a more specific message.
+func (e *ProtocolError) WithMessage(message string) *ProtocolError {
+	c := *e
+	c.Message = message
+	return &c
+}
+
+// WithMessageID returns a copy of e relating it to the message with id.
+func (e *ProtocolError) WithMessageID(id string) *ProtocolError {
+	c := *e
+	c.MessageID = id
+	return &c
+}
+
+// WithRetryAfter returns a copy of e telling the client when to retry.
+func (e *ProtocolError) WithRetryAfter(d time.Duration) *ProtocolError {
+	c := *e
+	c.RetryAfter = d
+	return &c
+}
+
+func newError(code, message string, retryable bool) *ProtocolError {
+	return &ProtocolError{Code: code, Message: message, Retryable: retryable}
+}
+
+// The error catalogue. The codes are part of the protocol and must not change.
+var (
+	ErrInvalidMessage   = newError("INVALID_MESSAGE", "message could not be parsed or failed validation", false)
+	ErrLeaderNotSet     = newError("LEADER_NOT_SET", "the party leader could not be updated", true)
+	ErrUnknownTransfer  = newError("UNKNOWN_TRANSFER", "no such transfer in this party", false)
+	ErrTransferExists   = newError("TRANSFER_EXISTS", "a transfer with this id is already in progress", false)
+	ErrInvalidChunk     = newError("INVALID_CHUNK", "chunk index or size does not match the transfer", false)
+	ErrChecksumMismatch = newError("CHECKSUM_MISMATCH", "content does not match its checksum", true)
+	ErrTransferPartial  = newError("TRANSFER_INCOMPLETE", "some chunks of the transfer are missing", true)
+	ErrTooManyTransfers = newError("TOO_MANY_TRANSFERS", "too many transfers in progress, retry later", true)
+	ErrSenderMismatch   = newError("SENDER_MISMATCH", "sender does not match the authenticated member", false)
+	ErrRateLimited      = newError("RATE_LIMITED", "too many messages, retry later", true)
+	ErrUnsupportedType  = newError("UNSUPPORTED_MESSAGE_TYPE", "message type is not part of the negotiated protocol version", false)
+	// ErrRateLimitAbuse is returned once a member keeps sending past its rate
+	// limit; the member is disconnected.
+	ErrRateLimitAbuse = newError("RATE_LIMIT_ABUSE", "rate limit exceeded too often", false)
+
+	ErrBadRequest          = newError("BAD_REQUEST", "the request is malformed", false)
+	ErrUnsupportedVersion  = newError("UNSUPPORTED_VERSION", "the requested protocol version is not supported", false)
+	ErrUnsupportedEncoding = newError("UNSUPPORTED_ENCODING", "the requested encoding is not supported", false)
+	ErrUnauthorized        = newError("UNAUTHORIZED", "invalid party or credentials", false)
+	ErrForbidden           = newError("FORBIDDEN", "the credentials do not allow this", false)
+	ErrNotFound            = newError("NOT_FOUND", "not found", false)
+	ErrTooManyAttempts     = newError("TOO_MANY_ATTEMPTS", "too many failed attempts, retry later", true)
+	ErrPayloadTooLarge     = newError("PAYLOAD_TOO_LARGE", "the upload is too large", false)
+	ErrQuotaExceeded       = newError("QUOTA_EXCEEDED", "the party has used up its storage quota", false)
+	ErrDeviceExists        = newError("DEVICE_EXISTS", "a device with this member id is already enrolled", false)
+	ErrMemberConnected     = newError("MEMBER_CONNECTED", "a member with this id is already connected", false)
+	ErrMemberHasRole       = newError("MEMBER_HAS_ROLE", "the member id has an assigned role", false)
+	ErrSessionBusy         = newError("SESSION_BUSY", "another request is already receiving this session's messages", true)
+	ErrSessionClosed       = newError("SESSION_CLOSED", "the session has left the party", false)
+	ErrNotConnected        = newError("NOT_CONNECTED", "the member is no longer connected to the party", false)
+	ErrShuttingDown        = newError("SHUTTING_DOWN", "the server is shutting down, reconnect later", true)
+	ErrInternal            = newError("INTERNAL_ERROR", "internal error", true)
+)
+
+// AsProtocolError maps err into the catalogue, treating unknown errors as
+// internal.
+func AsProtocolError(err error) *ProtocolError {
+	var perr *ProtocolError
+	if errors.As(err, &perr) {
+		return perr
+	}
+	return ErrInternal
+}
+
+// ErrorMessageFor builds the error message reporting err to a member.
+func ErrorMessageFor(err error) []byte {
+	perr := AsProtocolError(err)
+	response := Message[ErrorData]{
+		Data: ErrorData{
+			Error:      perr.Code,
+			Code:       perr.Code,
+			Message:    perr.Message,
+			Retryable:  perr.Retryable,
+			MessageID:  perr.MessageID,
+			RetryAfter: perr.RetryAfter.Milliseconds(),
+		},
+		Sender:      "",
+		MessageType: Error,
+		CreatedAt:   time.Now().UTC().Unix(),
+	}
+
+	b, _ := json.Marshal(response)
+	return b
+}
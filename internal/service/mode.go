@@ -0,0 +1,175 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Mode says which way clipboard items flow for a member, e.g. a wall display
+// that only receives or a build agent that only sends. Unlike roles, modes
+// belong to a connection: a member picks one when it joins and an admin may
+// change it until the member leaves.
+type Mode string
+
+const (
+	ModeSendReceive Mode = "send-receive"
+	ModeSendOnly    Mode = "send-only"
+	ModeReceiveOnly Mode = "receive-only"
+)
+
+// ParseMode returns the mode named name. An empty name is ModeSendReceive.
+func ParseMode(name string) (Mode, bool) {
+	switch mode := Mode(name); mode {
+	case "":
+		return ModeSendReceive, true
+	case ModeSendReceive, ModeSendOnly, ModeReceiveOnly:
+		return mode, true
+	}
+	return "", false
+}
+
+// clipboardMessageTypes are the messages that carry clipboard items.
+var clipboardMessageTypes = []MessageType{Clipboard, Encrypted, ClipboardBegin, ClipboardChunk, ClipboardEnd}
+
+func (m Mode) sends() bool {
+	return m != ModeReceiveOnly
+}
+
+func (m Mode) receives() bool {
+	return m != ModeSendOnly
+}
+
+// SetMode changes the mode of a connected member. Only admins may send it;
+// the server relays it to the party once applied.
+const SetMode MessageType = "set-mode"
+
+type SetModeData struct {
+	MemberID string `json:"memberId"`
+	Mode     Mode   `json:"mode"`
+}
+
+func SetModeMessage(sender, memberId string, mode Mode) []byte {
+	response := Message[SetModeData]{
+		Data:        SetModeData{MemberID: memberId, Mode: mode},
+		Sender:      sender,
+		MessageType: SetMode,
+		CreatedAt:   time.Now().UTC().Unix(),
+	}
+
+	b, _ := json.Marshal(response)
+	return b
+}
+
+// WithMode sets the mode the member joins in. Members send and receive by
+// default.
+func WithMode(mode Mode) JoinOption {
+	return func(p *PartyHandle) {
+		p.mode = mode
+	}
+}
+
+// Mode is the member's current mode.
+func (p *PartyHandle) Mode() Mode {
+	p.partyService.outboxMutex.RLock()
+	defer p.partyService.outboxMutex.RUnlock()
+	return p.mode
+}
+
+// sendClipboard relays a frame carrying a clipboard item like sendMessageTo,
+// skipping the members that only send.
+func (p *PartyService) sendClipboard(senderId string, memberIds []string, msg Frame) []string {
+	p.outboxMutex.RLock()
+	receivers := []string{}
+	for id, member := range p.members {
+		if member.mode.receives() && (memberIds == nil || slices.Contains(memberIds, id)) {
+			receivers = append(receivers, id)
+		}
+	}
+	p.outboxMutex.RUnlock()
+	return p.sendMessageTo(senderId, receivers, msg)
+}
+
+// membersSupporting returns the members whose protocol version knows msgType.
+func (p *PartyService) membersSupporting(msgType MessageType) []string {
+	p.outboxMutex.RLock()
+	defer p.outboxMutex.RUnlock()
+	ids := []string{}
+	for id, member := range p.members {
+		if supportsType(member.version, msgType) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// setMode changes the mode of memberId on behalf of sender, a member with
+// role actor, and tells the rest of the party.
+func (p *PartyService) setMode(actor Role, sender, memberId string, mode Mode) error {
+	p.lock("Setting mode")
+	member, ok := p.members[memberId]
+	if !ok {
+		p.unlock("Setting mode")
+		return ErrNotFound.WithMessage(fmt.Sprintf("%s is not connected", memberId))
+	}
+	if !actor.canManage(member.role, member.role) {
+		p.unlock("Setting mode")
+		return ErrForbidden.WithMessage(fmt.Sprintf("%s may not change the mode of %s", actor, memberId))
+	}
+	member.mode = mode
+	p.unlock("Setting mode")
+
+	p.logger.WithField("member", memberId).WithField("mode", mode).Info("set member mode")
+	p.sendMessageTo(sender, p.membersSupporting(SetMode), TextFrame(SetModeMessage(sender, memberId, mode)))
+	return nil
+}
+
+// SetMode changes the mode of a connected member of party id on behalf of a
+// client with role actor. It returns ErrNotFound if the member is not
+// connected.
+func (p *PartyServiceProvider) SetMode(id string, actor Role, memberId string, mode Mode) error {
+	p.partiesMutex.RLock()
+	party, ok := p.parties[id]
+	p.partiesMutex.RUnlock()
+	if !ok {
+		return ErrNotFound.WithMessage(fmt.Sprintf("%s is not connected", memberId))
+	}
+	return party.setMode(actor, "", memberId, mode)
+}
+
+// MemberInfo describes a connected member in the party roster.
+type MemberInfo struct {
+	MemberID string `json:"memberId"`
+	Role     Role   `json:"role"`
+	Mode     Mode   `json:"mode"`
+	Version  int    `json:"version"`
+	Encoding string `json:"encoding"`
+}
+
+// Members returns the roster of party id, ordered by member ID.
+func (p *PartyServiceProvider) Members(id string) []MemberInfo {
+	roster := []MemberInfo{}
+	p.partiesMutex.RLock()
+	party, ok := p.parties[id]
+	p.partiesMutex.RUnlock()
+	if !ok {
+		return roster
+	}
+	party.outboxMutex.RLock()
+	for _, member := range party.members {
+		roster = append(roster, MemberInfo{
+			MemberID: member.id,
+			Role:     member.role,
+			Mode:     member.mode,
+			Version:  member.version,
+			Encoding: member.codec.Name(),
+		})
+	}
+	party.outboxMutex.RUnlock()
+	slices.SortFunc(roster, func(a, b MemberInfo) int {
+		return strings.Compare(a.MemberID, b.MemberID)
+	})
+	return roster
+}
@@ -0,0 +1,125 @@
+package service
+
+import (
+	"time"
+
+	"github.com/dino16m/clippa-server/internal/data"
+	"github.com/dino16m/clippa-server/internal/metrics"
+)
+
+// config holds the tunables shared by every PartyService of a provider.
+type config struct {
+	ackTimeout        time.Duration
+	sizeLimits        SizeLimits
+	maxTransferSize   int
+	maxChunkSize      int
+	transferRetention time.Duration
+	// maxMemberTransfers and maxPartyTransfers cap the transfers held for a
+	// sender and for the party; zero means no cap.
+	maxMemberTransfers int
+	maxPartyTransfers  int
+	strictSender       bool
+	rateLimits         RateLimits
+	metrics            *metrics.Metrics
+	// blobs are the uploaded blobs clipboard items may reference; without
+	// them references are refused.
+	blobs *data.BlobStore
+}
+
+func defaultConfig() config {
+	return config{
+		sizeLimits:         DefaultSizeLimits(),
+		maxTransferSize:    64 << 20,
+		maxChunkSize:       1 << 20,
+		transferRetention:  10 * time.Minute,
+		maxMemberTransfers: 4,
+		maxPartyTransfers:  16,
+		rateLimits:         DefaultRateLimits(),
+		metrics:            metrics.New(nil),
+	}
+}
+
+// maxFrameSize is the largest websocket message a member may send: the
+// biggest clipboard representation or transfer chunk allowed plus room for
+// its JSON header.
+func (c config) maxFrameSize() int {
+	return max(c.sizeLimits.maxLimit(), c.maxChunkSize) + 64<<10
+}
+
+// Option configures a PartyServiceProvider.
+type Option func(*config)
+
+// WithAckTimeout sets how long a relayed message waits for acks before its
+// sender gets a final delivery report listing the members that never
+// acknowledged it. Zero, the default, waits until every recipient has acked
+// or the sender leaves.
+func WithAckTimeout(timeout time.Duration) Option {
+	return func(c *config) {
+		c.ackTimeout = timeout
+	}
+}
+
+// WithClipboardLimit caps clipboard representations whose MIME type matches
+// pattern (e.g. "image/png", "image/*" or "*") at limit bytes.
+func WithClipboardLimit(pattern string, limit int) Option {
+	return func(c *config) {
+		c.sizeLimits[pattern] = limit
+	}
+}
+
+// WithTransferLimits caps the total size of a chunked clipboard transfer and
+// the size of each of its chunks, in bytes.
+func WithTransferLimits(maxSize, maxChunkSize int) Option {
+	return func(c *config) {
+		c.maxTransferSize = maxSize
+		c.maxChunkSize = maxChunkSize
+	}
+}
+
+// WithTransferRetention sets how long an idle chunked transfer is kept for
+// recipients to request missing chunks.
+func WithTransferRetention(retention time.Duration) Option {
+	return func(c *config) {
+		c.transferRetention = retention
+	}
+}
+
+// WithTransferConcurrency caps the chunked transfers held at once for each
+// sender and for the whole party. Completed transfers make way for new ones;
+// a transfer that would exceed a cap while the others are still in progress
+// is refused with ErrTooManyTransfers. Zero disables a cap.
+func WithTransferConcurrency(perMember, perParty int) Option {
+	return func(c *config) {
+		c.maxMemberTransfers = perMember
+		c.maxPartyTransfers = perParty
+	}
+}
+
+// WithStrictSender rejects messages whose sender field names someone other
+// than the member that sent them, instead of silently overwriting it.
+func WithStrictSender(strict bool) Option {
+	return func(c *config) {
+		c.strictSender = strict
+	}
+}
+
+// WithRateLimits replaces the default per-member and per-party rate limits.
+func WithRateLimits(limits RateLimits) Option {
+	return func(c *config) {
+		c.rateLimits = limits
+	}
+}
+
+// WithMetrics records the parties' activity in m.
+func WithMetrics(m *metrics.Metrics) Option {
+	return func(c *config) {
+		c.metrics = m
+	}
+}
+
+// WithBlobs lets clipboard items reference the blobs their party uploaded.
+func WithBlobs(blobs *data.BlobStore) Option {
+	return func(c *config) {
+		c.blobs = blobs
+	}
+}
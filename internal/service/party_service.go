@@ -1,85 +1,403 @@
 package service
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
 	"sync"
 	"time"
 
 	"github.com/dino16m/clippa-server/internal/data"
+	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
 )
 
+// outboxSize is how many messages may be queued for a member before relaying
+// to it starts to block.
+const outboxSize = 16
+
+// DisconnectReason says why the server closed a member's inbox.
+type DisconnectReason int
+
+const (
+	// ReasonLeft is a member that left on its own.
+	ReasonLeft DisconnectReason = iota
+	ReasonKicked
+	ReasonPartyDeleted
+	// ReasonSlowConsumer is a member that stopped draining its inbox.
+	ReasonSlowConsumer
+	// ReasonAuthExpired is a member whose credentials were revoked while it
+	// was connected, such as a removed device.
+	ReasonAuthExpired
+	ReasonRateLimited
+	// ReasonSuperseded is a member replaced by a newer connection with the
+	// same member ID.
+	ReasonSuperseded
+	// ReasonServerShutdown is a member disconnected because the server is
+	// shutting down.
+	ReasonServerShutdown
+)
+
+func (r DisconnectReason) String() string {
+	switch r {
+	case ReasonKicked:
+		return "kicked"
+	case ReasonPartyDeleted:
+		return "party deleted"
+	case ReasonSlowConsumer:
+		return "slow consumer"
+	case ReasonAuthExpired:
+		return "auth expired"
+	case ReasonRateLimited:
+		return "rate limit exceeded"
+	case ReasonSuperseded:
+		return "superseded"
+	case ReasonServerShutdown:
+		return "server shutdown"
+	}
+	return "left"
+}
+
 type PartyHandle struct {
 	partyService *PartyService
-	inbox        chan []byte
+	inbox        chan Frame
 	id           string
-	logger       *logrus.Logger
+	limiter      *memberLimiter
+	version      int
+	codec        Codec
+	// role and mode are guarded by the party's outboxMutex, as admins may
+	// change them.
+	role Role
+	mode Mode
+	// supersede replaces a connected member with the same ID on join.
+	supersede bool
+	// verified is set when the member ID was proven rather than chosen.
+	verified bool
+	// closeReason is set before inbox is closed by the server.
+	closeReason DisconnectReason
+	// logger carries the party and member fields.
+	logger *logrus.Entry
+}
+
+// HandleFrame validates a frame read from the member's socket and relays it
+// to the rest of the party. The frame is decoded once with the member's
+// codec.
+func (p *PartyHandle) HandleFrame(frame Frame) error {
+	message, payload, err := p.codec.Decode(frame)
+	if err != nil {
+		p.logger.WithError(err).Error("invalid frame")
+		return ErrInvalidMessage
+	}
+	return p.handle(message, payload, len(frame.Data))
 }
 
+// HandleMessage handles a JSON message as if it arrived in a text frame.
 func (p *PartyHandle) HandleMessage(msg []byte) error {
-	p.logger.Info("Received message")
-	incomingType, err := getMessageType(msg)
+	message, err := parseRawMessage(msg)
 	if err != nil {
-		p.logger.WithError(err).Error("invalid message type")
+		p.logger.WithError(err).Error("invalid message")
 		return ErrInvalidMessage
 	}
+	return p.handle(message, nil, len(msg))
+}
+
+// Encode renders a frame from the inbox in the member's encoding.
+func (p *PartyHandle) Encode(frame Frame) (Frame, error) {
+	return p.codec.Encode(frame)
+}
+
+// handle validates and relays message. payload is non-nil when message was
+// the header of a binary frame, and size is the size of the whole frame.
+func (p *PartyHandle) handle(message Message[RawData], payload []byte, size int) error {
+	// the server may replace the ID, so keep the one the client chose
+	clientId := message.ID
+	var err error
+	if p.connected() {
+		err = p.process(message, payload, size)
+	} else {
+		// a member that left or was kicked may still be sending
+		err = ErrNotConnected
+	}
+	if err == nil || clientId == "" {
+		return err
+	}
+	// relate the error to the client's message
+	return AsProtocolError(err).WithMessageID(clientId)
+}
 
-	p.logger.WithField("msgType", incomingType).Info("Got message type")
-	obj, err := validateMessage(incomingType, msg)
+func (p *PartyHandle) process(message Message[RawData], payload []byte, size int) error {
+	incomingType := message.MessageType
+	p.logger.WithField("msgType", incomingType).Debug("Received message")
+	if err := p.limiter.allow(p.partyService.limiter, incomingType, size); err != nil {
+		p.logger.WithField("msgType", incomingType).Warn("rate limited")
+		return err
+	}
+	message, err := p.stamp(message)
+	if err != nil {
+		return err
+	}
+	obj, err := validateMessage(p.version, message, len(payload), p.partyService.config)
 	if err != nil {
 		p.logger.WithError(err).Error("invalid message")
+		// version 1 clients only know INVALID_MESSAGE
+		if errors.Is(err, ErrUnsupportedType) && p.version >= ProtocolV2 {
+			return err
+		}
+		return ErrInvalidMessage
+	}
+	p.logger.WithField("msgType", incomingType).Debug("validated message type")
+	if role := p.Role(); !role.permits(incomingType) {
+		p.logger.WithField("role", role).WithField("msgType", incomingType).Warn("message not permitted")
+		return ErrForbidden.WithMessage(fmt.Sprintf("%s members may not send %s", role, incomingType))
+	}
+	if mode := p.Mode(); !mode.sends() && slices.Contains(clipboardMessageTypes, incomingType) {
+		return ErrForbidden.WithMessage(fmt.Sprintf("%s members may not send %s", mode, incomingType))
+	}
+
+	p.partyService.config.metrics.Messages.WithLabelValues(string(incomingType)).Inc()
+	if slices.Contains(electionOutcomes, incomingType) {
+		p.partyService.config.metrics.Elections.WithLabelValues(string(incomingType)).Inc()
+	}
+
+	tracked := incomingType == Clipboard || incomingType == Encrypted
+	if tracked {
+		message.ID = uuid.New().String()
+	}
+	data, err := message.Data.JSON()
+	if err != nil {
+		p.logger.WithError(err).Error("failed to encode message")
 		return ErrInvalidMessage
 	}
-	p.logger.WithField("msgType", incomingType).Info("validated message type")
+	msg, err := json.Marshal(Message[json.RawMessage]{
+		ID:          message.ID,
+		Data:        data,
+		Sender:      message.Sender,
+		MessageType: message.MessageType,
+		CreatedAt:   message.CreatedAt,
+	})
+	if err != nil {
+		p.logger.WithError(err).Error("failed to encode message")
+		return ErrInvalidMessage
+	}
+
+	switch incomingType {
+	case Ack:
+		message := obj.(Message[AckData])
+		p.partyService.acknowledge(message.Data.MessageID, p.id)
+		return nil
+	case Clipboard:
+		clipboard := obj.(Message[ClipboardData])
+		if err := p.partyService.config.checkBlobs(p.partyService.partyId, clipboard.Data); err != nil {
+			return err
+		}
+		p.relayTracked(message.ID, msg, payload, nil)
+		return nil
+	case Encrypted:
+		envelope := obj.(Message[EncryptedData])
+		p.relayTracked(message.ID, msg, payload, envelopeRecipients(envelope.Data))
+		return nil
+	case KeyAnnounce:
+		p.partyService.announceKey(p.id, msg)
+	case ClipboardBegin, ClipboardChunk, ClipboardEnd, ClipboardMissing:
+		return p.handleTransfer(incomingType, obj, msg, payload)
+	case Kick, SetRole, SetMode:
+		// applied by the server rather than relayed
+		return p.handleInternal(incomingType, obj)
+	}
+
+	if err := p.handleInternal(incomingType, obj); err != nil {
+		return err
+	}
+	p.partyService.sendMessage(p.id, TextFrame(msg))
+	return nil
+}
+
+// stamp sets this member as the sender of message and the server's clock as
+// its creation time, so members cannot impersonate each other. In strict mode
+// a message claiming another sender is rejected outright.
+func (p *PartyHandle) stamp(message Message[RawData]) (Message[RawData], error) {
+	if message.Sender != "" && message.Sender != p.id {
+		if p.partyService.config.strictSender {
+			p.logger.WithField("claimed", message.Sender).Warn("sender mismatch")
+			return message, ErrSenderMismatch
+		}
+		p.logger.WithField("claimed", message.Sender).Debug("overwriting claimed sender")
+	}
+	message.Sender = p.id
+	message.CreatedAt = time.Now().UTC().Unix()
+	return message, nil
+}
+
+// relayTracked relays msg, which carries the server-assigned messageId, to
+// memberIds, or the whole party when memberIds is nil, reporting acks from
+// the recipients back to this member.
+func (p *PartyHandle) relayTracked(messageId string, msg, payload []byte, memberIds []string) {
+	frame := TextFrame(msg)
+	if payload != nil {
+		frame = encodeBinaryFrame(msg, payload)
+	}
+	p.partyService.trackDelivery(messageId, p.id)
+	recipients := p.partyService.sendClipboard(p.id, memberIds, frame)
+	p.partyService.startDelivery(messageId, recipients)
+}
 
-	p.handleInternal(incomingType, obj)
-	p.partyService.sendMessage(p.id, msg)
+// handleTransfer relays the messages of a chunked clipboard transfer,
+// reporting progress to the sender, and replays chunks a recipient missed.
+func (p *PartyHandle) handleTransfer(msgType MessageType, obj any, msg, payload []byte) error {
+	switch msgType {
+	case ClipboardBegin:
+		if err := p.partyService.beginTransfer(p.id, obj.(Message[TransferBeginData])); err != nil {
+			return err
+		}
+		p.partyService.sendClipboard(p.id, nil, TextFrame(msg))
+	case ClipboardChunk:
+		progress, err := p.partyService.addChunk(p.id, obj.(Message[TransferChunkData]), payload)
+		if err != nil {
+			return err
+		}
+		p.partyService.sendClipboard(p.id, nil, encodeBinaryFrame(msg, payload))
+		p.reply(TransferProgressMessage(progress))
+	case ClipboardEnd:
+		message := obj.(Message[TransferEndData])
+		progress, err := p.partyService.endTransfer(p.id, message.Data.TransferID)
+		if err != nil {
+			return err
+		}
+		p.partyService.sendClipboard(p.id, nil, TextFrame(msg))
+		p.reply(TransferProgressMessage(progress))
+	case ClipboardMissing:
+		message := obj.(Message[TransferMissingData])
+		frames, err := p.partyService.missingChunks(message.Data.TransferID, message.Data.Indexes)
+		if err != nil {
+			return err
+		}
+		// replayed from another goroutine: this one drains the inbox
+		go func() {
+			for _, frame := range frames {
+				if !p.partyService.sendTo(p.id, frame) {
+					return
+				}
+			}
+		}()
+	}
 	return nil
 }
 
-func (p *PartyHandle) handleInternal(msgType MessageType, msg any) {
-	if msgType == SetLeader {
+// handleInternal applies the messages that change the party. The member's
+// role has already been checked against msgType.
+func (p *PartyHandle) handleInternal(msgType MessageType, msg any) error {
+	switch msgType {
+	case SetLeader:
 		message := msg.(Message[SetLeaderData])
 		err := p.partyService.setLeader(message.Data.Address)
 		if err != nil {
-			p.inbox <- ErrorMessage(ErrLeaderNotSet.Error())
+			p.reply(ErrorMessageFor(ErrLeaderNotSet))
 		}
-	}
-	if msgType == Conclave {
+	case Conclave:
 		err := p.partyService.resetLeader()
 		if err != nil {
-			p.inbox <- ErrorMessage(ErrLeaderNotSet.Error())
+			p.reply(ErrorMessageFor(ErrLeaderNotSet))
 		}
+	case Kick:
+		message := msg.(Message[KickData])
+		return p.partyService.kick(p.Role(), message.Data.MemberID)
+	case SetRole:
+		message := msg.(Message[SetRoleData])
+		return p.partyService.setRole(p.Role(), p.id, message.Data.MemberID, message.Data.Role)
+	case SetMode:
+		message := msg.(Message[SetModeData])
+		return p.partyService.setMode(p.Role(), p.id, message.Data.MemberID, message.Data.Mode)
+	}
+	return nil
+}
+
+// connected reports whether the handle is still its member's connection to
+// the party.
+func (p *PartyHandle) connected() bool {
+	p.partyService.outboxMutex.RLock()
+	defer p.partyService.outboxMutex.RUnlock()
+	return p.partyService.members[p.id] == p
+}
+
+// reply queues msg for this member without blocking; it is called from the
+// goroutine that drains the inbox, so waiting on a full inbox would deadlock.
+func (p *PartyHandle) reply(msg []byte) {
+	p.partyService.outboxMutex.RLock()
+	defer p.partyService.outboxMutex.RUnlock()
+	if p.partyService.members[p.id] != p {
+		return
+	}
+	select {
+	case p.inbox <- TextFrame(msg):
+	default:
+		p.logger.Warn("inbox full, dropping reply")
 	}
 }
 
 func (p *PartyHandle) Leave() {
 	p.logger.Info("leaving party")
-	p.partyService.leave(p.id)
+	p.partyService.leave(p)
+}
+
+// CloseReason says why the inbox was closed. It is only meaningful once the
+// inbox has been closed.
+func (p *PartyHandle) CloseReason() DisconnectReason {
+	p.partyService.outboxMutex.RLock()
+	defer p.partyService.outboxMutex.RUnlock()
+	return p.closeReason
 }
 
 func (p *PartyHandle) ID() string {
 	return p.id
 }
 
-func (p *PartyHandle) Inbox() <-chan []byte {
+// Version is the protocol version the member negotiated.
+func (p *PartyHandle) Version() int {
+	return p.version
+}
+
+func (p *PartyHandle) Inbox() <-chan Frame {
 	return p.inbox
 }
 
 type PartyService struct {
-	partyStore  *data.PartyStore
-	partyId     string
-	outboxes    map[string]chan []byte
-	outboxMutex *sync.RWMutex
-	logger      *logrus.Logger
+	partyStore    *data.PartyStore
+	partyId       string
+	members       map[string]*PartyHandle
+	outboxMutex   *sync.RWMutex
+	deliveries    map[string]*delivery
+	deliveryMutex *sync.Mutex
+	transfers     map[string]*transfer
+	transferMutex *sync.Mutex
+	// transferSweep prunes idle transfers; it is guarded by transferMutex.
+	transferSweep *time.Timer
+	keys          map[string][]byte
+	keysMutex     *sync.Mutex
+	limiter       *partyLimiter
+	config        config
+	// logger carries the party field.
+	logger *logrus.Entry
+	// onEmpty is called when the last member has left, so the provider can
+	// forget the party.
+	onEmpty func(*PartyService)
 }
 
-func newPartyService(partyId string, partyStore *data.PartyStore, logger *logrus.Logger) *PartyService {
+func newPartyService(partyId string, partyStore *data.PartyStore, cfg config, logger *logrus.Logger) *PartyService {
 	return &PartyService{
-		partyStore:  partyStore,
-		partyId:     partyId,
-		outboxes:    make(map[string]chan []byte),
-		logger:      logger,
-		outboxMutex: &sync.RWMutex{},
+		partyStore:    partyStore,
+		partyId:       partyId,
+		members:       make(map[string]*PartyHandle),
+		logger:        logger.WithField("party", partyId),
+		outboxMutex:   &sync.RWMutex{},
+		deliveries:    make(map[string]*delivery),
+		deliveryMutex: &sync.Mutex{},
+		transfers:     make(map[string]*transfer),
+		transferMutex: &sync.Mutex{},
+		keys:          make(map[string][]byte),
+		keysMutex:     &sync.Mutex{},
+		limiter:       newPartyLimiter(cfg),
+		config:        cfg,
 	}
 }
 
@@ -91,7 +409,7 @@ func (p *PartyService) setLeader(address string) error {
 	if party.LeaderAddress == address {
 		return nil
 	}
-	p.logger.WithField("party", p.partyId).WithField("leader", address).Info("Setting leader")
+	p.logger.WithField("leader", address).Info("Setting leader")
 	party.LeaderAddress = address
 	return p.partyStore.Update(party)
 }
@@ -104,33 +422,124 @@ func (p *PartyService) resetLeader() error {
 	if party.LeaderAddress == "" {
 		return nil
 	}
-	p.logger.WithField("party", p.partyId).Info("Resetting leader")
+	p.logger.Info("Resetting leader")
 	party.LeaderAddress = ""
 	return p.partyStore.Update(party)
 }
 
-func (p *PartyService) join(memberId string) *PartyHandle {
-	outbox := make(chan []byte)
-	p.lock("Joining party")
-	p.outboxes[memberId] = outbox
-	p.unlock("Joining party")
-
+// join adds a member to the party. A member with the same ID that is already
+// connected is disconnected if the new one asked to supersede it, else the
+// join fails with ErrMemberConnected.
+func (p *PartyService) join(memberId string, opts ...JoinOption) (*PartyHandle, error) {
 	handle := &PartyHandle{
 		partyService: p,
-		inbox:        outbox,
+		inbox:        make(chan Frame, outboxSize),
 		id:           memberId,
-		logger:       p.logger,
+		limiter:      newMemberLimiter(p.config),
+		version:      ProtocolV1,
+		codec:        JSONCodec,
+		role:         RoleMember,
+		mode:         ModeSendReceive,
+		logger:       p.logger.WithField("member", memberId),
+	}
+	for _, opt := range opts {
+		opt(handle)
+	}
+	if role, ok := p.assignedRole(memberId); ok && (handle.verified || handle.role.AtLeast(role)) {
+		handle.role = role
+	}
+	if handle.version >= ProtocolV2 {
+		// the inbox is new and empty, so this cannot block
+		handle.inbox <- TextFrame(WelcomeMessage(memberId, handle.version))
+	}
+	p.lock("Joining party")
+	if previous, ok := p.members[memberId]; ok {
+		if !handle.supersede {
+			p.unlock("Joining party")
+			return nil, ErrMemberConnected
+		}
+		if !handle.verified && !handle.role.AtLeast(previous.role) {
+			// anyone may claim an unverified ID, but not take over a member
+			// that outranks them
+			p.unlock("Joining party")
+			return nil, ErrForbidden.WithMessage(fmt.Sprintf("%s may not supersede %s", handle.role, memberId))
+		}
+		// the member stays in the party, so the others are not told it left
+		previous.closeReason = ReasonSuperseded
+		close(previous.inbox)
+		p.logger.WithField("member", memberId).Info("superseded member connection")
+	} else {
+		p.config.metrics.ConnectedMembers.Inc()
 	}
-	p.sendMessage(memberId, JoinedMessage(memberId))
-	return handle
+	p.members[memberId] = handle
+	p.unlock("Joining party")
+
+	p.sendMessage(memberId, TextFrame(JoinedMessage(memberId)))
+	go p.replayKeys(memberId)
+	return handle, nil
 }
 
-func (p *PartyService) leave(id string) {
+// leave removes handle from the party, unless it was already replaced or
+// disconnected.
+func (p *PartyService) leave(handle *PartyHandle) {
 	p.lock("Leaving party")
-	delete(p.outboxes, id)
+	if p.members[handle.id] != handle {
+		p.unlock("Leaving party")
+		return
+	}
+	delete(p.members, handle.id)
+	p.config.metrics.ConnectedMembers.Dec()
 	p.unlock("Leaving party")
 
-	p.sendMessage(id, LeftMessage(id))
+	p.forget(handle.id)
+	p.releaseIfEmpty()
+}
+
+// disconnect removes the members with the given IDs and closes their inboxes,
+// telling their connections why.
+func (p *PartyService) disconnect(reason DisconnectReason, memberIds ...string) {
+	p.lock("Disconnecting members")
+	removed := []string{}
+	for _, id := range memberIds {
+		handle, ok := p.members[id]
+		if !ok {
+			continue
+		}
+		delete(p.members, id)
+		p.config.metrics.ConnectedMembers.Dec()
+		handle.closeReason = reason
+		close(handle.inbox)
+		removed = append(removed, id)
+	}
+	p.unlock("Disconnecting members")
+
+	for _, id := range removed {
+		p.logger.WithField("member", id).WithField("reason", reason).Info("disconnected member")
+		p.forget(id)
+	}
+	p.releaseIfEmpty()
+}
+
+// releaseIfEmpty hands the party back to its provider once its last member
+// has left.
+func (p *PartyService) releaseIfEmpty() {
+	p.outboxMutex.RLock()
+	empty := len(p.members) == 0
+	p.outboxMutex.RUnlock()
+	// members are only disconnected during a join while the joining one is
+	// in the party, so this never waits on the provider's lock held by the
+	// join
+	if empty && p.onEmpty != nil {
+		p.onEmpty(p)
+	}
+}
+
+// forget drops the state kept for a departed member and tells the others.
+func (p *PartyService) forget(id string) {
+	p.dropDeliveries(id)
+	p.dropTransfers(id)
+	p.forgetKey(id)
+	p.sendMessage(id, TextFrame(LeftMessage(id)))
 }
 func (p *PartyService) lock(msg string) {
 	p.logger.Debugf("locking %s", msg)
@@ -142,25 +551,64 @@ func (p *PartyService) unlock(msg string) {
 	p.logger.Debugf("unlocked %s", msg)
 }
 
-func (p *PartyService) sendMessage(senderId string, msg []byte) {
-	p.logger.Info("forwarding")
+// sendMessage relays msg to every member except the sender and returns the
+// IDs of the members it was handed to.
+func (p *PartyService) sendMessage(senderId string, msg Frame) []string {
+	return p.sendMessageTo(senderId, nil, msg)
+}
+
+// sendMessageTo relays msg to the listed members, or to every member when
+// memberIds is nil, skipping the sender. Members too slow to take the message
+// are disconnected.
+func (p *PartyService) sendMessageTo(senderId string, memberIds []string, msg Frame) []string {
 	p.outboxMutex.RLock()
-	defer p.outboxMutex.RUnlock()
-	p.logger.Infof("sending message to %d outboxes", len(p.outboxes)-1)
-	for id, outbox := range p.outboxes {
-		if id == senderId {
+	p.logger.Debugf("sending message to %d outboxes", len(p.members)-1)
+	recipients := []string{}
+	slow := []string{}
+	for id, member := range p.members {
+		if id == senderId || (memberIds != nil && !slices.Contains(memberIds, id)) {
 			continue
 		}
-		p.logger.Infof("forwarding message to %s", id)
+		p.logger.Debugf("forwarding message to %s", id)
 		timer := time.NewTimer(time.Millisecond * 100)
 		select {
-		case outbox <- msg:
-			p.logger.Infof("forwarded message to %s", id)
+		case member.inbox <- msg:
+			p.logger.Debugf("forwarded message to %s", id)
+			p.config.metrics.BytesRelayed.Add(float64(len(msg.Data)))
+			recipients = append(recipients, id)
 		case <-timer.C:
-			p.logger.Infof("timed out forwarding message to %s", id)
-			close(outbox)
-			return
+			p.logger.WithField("member", id).Warn("timed out forwarding message")
+			p.config.metrics.SendTimeouts.Inc()
+			slow = append(slow, id)
 		}
+		timer.Stop()
+	}
+	p.outboxMutex.RUnlock()
+
+	if len(slow) > 0 {
+		p.disconnect(ReasonSlowConsumer, slow...)
+	}
+	return recipients
+}
+
+// sendTo relays msg to a single member and reports whether it was handed over.
+func (p *PartyService) sendTo(memberId string, msg Frame) bool {
+	p.outboxMutex.RLock()
+	defer p.outboxMutex.RUnlock()
+	member, ok := p.members[memberId]
+	if !ok {
+		return false
+	}
+	timer := time.NewTimer(time.Millisecond * 100)
+	defer timer.Stop()
+	select {
+	case member.inbox <- msg:
+		p.config.metrics.BytesRelayed.Add(float64(len(msg.Data)))
+		return true
+	case <-timer.C:
+		p.logger.WithField("member", memberId).Warn("timed out sending message")
+		p.config.metrics.SendTimeouts.Inc()
+		return false
 	}
 }
 
@@ -168,32 +616,197 @@ type PartyServiceProvider struct {
 	parties      map[string]*PartyService
 	partyStore   *data.PartyStore
 	partiesMutex *sync.RWMutex
+	config       config
 	logger       *logrus.Logger
+	// draining is set once Shutdown is called, refusing further joins.
+	draining bool
 }
 
-func NewPartyServiceProvider(partyStore *data.PartyStore, logger *logrus.Logger) *PartyServiceProvider {
+func NewPartyServiceProvider(partyStore *data.PartyStore, logger *logrus.Logger, opts ...Option) *PartyServiceProvider {
+	cfg := defaultConfig()
+	for _, opt := range opts {
+		opt(&cfg)
+	}
 	return &PartyServiceProvider{
 		parties:      map[string]*PartyService{},
 		partiesMutex: &sync.RWMutex{},
 		partyStore:   partyStore,
+		config:       cfg,
 		logger:       logger,
 	}
 }
 
-func (p *PartyServiceProvider) JoinParty(id string, memberId string) *PartyHandle {
-	logger := p.logger.WithField("id", id)
+// MaxFrameSize is the largest websocket message a member may send.
+func (p *PartyServiceProvider) MaxFrameSize() int64 {
+	return int64(p.config.maxFrameSize())
+}
+
+// JoinOption configures a member joining a party.
+type JoinOption func(*PartyHandle)
+
+// WithProtocolVersion sets the protocol version the member negotiated. It
+// must be one of SupportedVersions.
+func WithProtocolVersion(version int) JoinOption {
+	return func(p *PartyHandle) {
+		p.version = version
+	}
+}
+
+// WithSupersede makes the member replace a connected member with the same
+// ID, which is disconnected with ReasonSuperseded.
+func WithSupersede(supersede bool) JoinOption {
+	return func(p *PartyHandle) {
+		p.supersede = supersede
+	}
+}
+
+// WithCodec sets the encoding of the member's frames.
+func WithCodec(codec Codec) JoinOption {
+	return func(p *PartyHandle) {
+		p.codec = codec
+	}
+}
+
+// WithLogFields adds fields, such as the ID of the request the member joined
+// with, to the member's log lines.
+func WithLogFields(fields logrus.Fields) JoinOption {
+	return func(p *PartyHandle) {
+		p.logger = p.logger.WithFields(fields)
+	}
+}
+
+// JoinParty adds a member to party id, starting the party's service if it is
+// the first. See WithSupersede for members that are already connected. Once
+// the provider is shutting down it returns ErrShuttingDown.
+func (p *PartyServiceProvider) JoinParty(id string, memberId string, opts ...JoinOption) (*PartyHandle, error) {
+	logger := p.logger.WithField("party", id)
 	p.partiesMutex.RLock()
 	party, ok := p.parties[id]
-	p.partiesMutex.RUnlock()
-	if ok {
-		logger.Info("reusing existing party")
-		return party.join(memberId)
+	if ok && !p.draining {
+		defer p.partiesMutex.RUnlock()
+		logger.Debug("reusing existing party")
+		return party.join(memberId, opts...)
 	}
+	p.partiesMutex.RUnlock()
 
 	p.partiesMutex.Lock()
 	defer p.partiesMutex.Unlock()
-	logger.Info("Creating new party service")
-	party = newPartyService(id, p.partyStore, logger.Logger)
+	if p.draining {
+		return nil, ErrShuttingDown
+	}
+	// another join may have created it since the read lock was released
+	if party, ok := p.parties[id]; ok {
+		return party.join(memberId, opts...)
+	}
+	logger.Info("creating party service")
+	party = newPartyService(id, p.partyStore, p.config, p.logger)
+	party.onEmpty = p.releaseParty
 	p.parties[id] = party
-	return party.join(memberId)
+	p.config.metrics.ActiveParties.Inc()
+	return party.join(memberId, opts...)
+}
+
+// releaseParty forgets party if it is still empty. Joins hold partiesMutex,
+// so none can add a member while it is checked.
+func (p *PartyServiceProvider) releaseParty(party *PartyService) {
+	p.partiesMutex.Lock()
+	defer p.partiesMutex.Unlock()
+	if p.parties[party.partyId] != party {
+		return
+	}
+	party.outboxMutex.RLock()
+	empty := len(party.members) == 0
+	party.outboxMutex.RUnlock()
+	if !empty {
+		return
+	}
+	delete(p.parties, party.partyId)
+	p.config.metrics.ActiveParties.Dec()
+	party.logger.Info("released empty party service")
+}
+
+// Connected reports whether memberId is connected to party id.
+func (p *PartyServiceProvider) Connected(id, memberId string) bool {
+	p.partiesMutex.RLock()
+	party, ok := p.parties[id]
+	p.partiesMutex.RUnlock()
+	if !ok {
+		return false
+	}
+	party.outboxMutex.RLock()
+	defer party.outboxMutex.RUnlock()
+	_, ok = party.members[memberId]
+	return ok
+}
+
+// ConnectedRole returns the role of memberId of party id, if it is
+// connected.
+func (p *PartyServiceProvider) ConnectedRole(id, memberId string) (Role, bool) {
+	p.partiesMutex.RLock()
+	party, ok := p.parties[id]
+	p.partiesMutex.RUnlock()
+	if !ok {
+		return "", false
+	}
+	party.outboxMutex.RLock()
+	defer party.outboxMutex.RUnlock()
+	member, ok := party.members[memberId]
+	if !ok {
+		return "", false
+	}
+	return member.role, true
+}
+
+// CanSendClipboard returns ErrNotConnected unless memberId of party id is
+// connected, and ErrForbidden unless its role and mode let it send clipboard
+// items.
+func (p *PartyServiceProvider) CanSendClipboard(id, memberId string) error {
+	p.partiesMutex.RLock()
+	party, ok := p.parties[id]
+	p.partiesMutex.RUnlock()
+	if !ok {
+		return ErrNotConnected
+	}
+	party.outboxMutex.RLock()
+	defer party.outboxMutex.RUnlock()
+	member, ok := party.members[memberId]
+	switch {
+	case !ok:
+		return ErrNotConnected
+	case !member.role.permits(Clipboard):
+		return ErrForbidden.WithMessage(fmt.Sprintf("%s members may not send %s", member.role, Clipboard))
+	case !member.mode.sends():
+		return ErrForbidden.WithMessage(fmt.Sprintf("%s members may not send %s", member.mode, Clipboard))
+	}
+	return nil
+}
+
+// Disconnect closes the connection of a member of party id, if it is
+// connected.
+func (p *PartyServiceProvider) Disconnect(id, memberId string, reason DisconnectReason) {
+	p.partiesMutex.RLock()
+	party, ok := p.parties[id]
+	p.partiesMutex.RUnlock()
+	if ok {
+		party.disconnect(reason, memberId)
+	}
+}
+
+// CloseParty disconnects every member of party id and forgets the party.
+func (p *PartyServiceProvider) CloseParty(id string, reason DisconnectReason) {
+	p.partiesMutex.Lock()
+	party, ok := p.parties[id]
+	delete(p.parties, id)
+	p.partiesMutex.Unlock()
+	if !ok {
+		return
+	}
+	p.config.metrics.ActiveParties.Dec()
+	party.outboxMutex.RLock()
+	memberIds := make([]string, 0, len(party.members))
+	for id := range party.members {
+		memberIds = append(memberIds, id)
+	}
+	party.outboxMutex.RUnlock()
+	party.disconnect(reason, memberIds...)
 }
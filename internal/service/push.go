@@ -0,0 +1,65 @@
+package service
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// PushResult reports who a pushed clipboard item was relayed to.
+type PushResult struct {
+	MessageID  string   `json:"messageId"`
+	Delivered  int      `json:"delivered"`
+	Recipients []string `json:"recipients"`
+}
+
+// allow charges a message of size bytes to the party's buckets.
+func (l *partyLimiter) allow(size int) error {
+	wait := reserve(time.Now(),
+		bucketCost{l.messages, 1},
+		bucketCost{l.bytes, size},
+	)
+	if wait > 0 {
+		return ErrRateLimited.WithRetryAfter(wait)
+	}
+	return nil
+}
+
+// PushClipboard relays a clipboard item to every connected member of party
+// id on behalf of sender, a client that is not itself a member. Nothing is
+// relayed, and no party service is started, if no member is connected.
+func (p *PartyServiceProvider) PushClipboard(id, sender string, data ClipboardData) (PushResult, error) {
+	for _, rep := range data.Representations {
+		if rep.Binary {
+			return PushResult{}, ErrInvalidMessage.WithMessage("binary representations cannot be pushed, upload a blob instead")
+		}
+	}
+	if err := validateClipboard(data, 0, p.config.sizeLimits); err != nil {
+		return PushResult{}, ErrInvalidMessage.WithMessage(err.Error())
+	}
+	if err := p.config.checkBlobs(id, data); err != nil {
+		return PushResult{}, err
+	}
+	result := PushResult{MessageID: uuid.New().String(), Recipients: []string{}}
+	msg, _ := json.Marshal(Message[ClipboardData]{
+		ID:          result.MessageID,
+		Data:        data,
+		Sender:      sender,
+		MessageType: Clipboard,
+		CreatedAt:   time.Now().UTC().Unix(),
+	})
+
+	p.partiesMutex.RLock()
+	party, ok := p.parties[id]
+	p.partiesMutex.RUnlock()
+	if !ok {
+		return result, nil
+	}
+	if err := party.limiter.allow(len(msg)); err != nil {
+		return PushResult{}, err
+	}
+	result.Recipients = party.sendClipboard(sender, nil, TextFrame(msg))
+	result.Delivered = len(result.Recipients)
+	return result, nil
+}
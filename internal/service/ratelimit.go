@@ -0,0 +1,156 @@
+package service
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimit is a token bucket refilled at Rate tokens per second holding at
+// most Burst tokens. A zero Rate means unlimited.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// RateLimits bounds how fast members and parties may send. Messages are
+// counted per message and per byte, both for each member and for the party
+// as a whole; PerType further limits how many messages of a type each member
+// may send.
+type RateLimits struct {
+	MemberMessages RateLimit
+	MemberBytes    RateLimit
+	PartyMessages  RateLimit
+	PartyBytes     RateLimit
+	PerType        map[MessageType]RateLimit
+	// MaxViolations rejected messages within ViolationWindow get a member
+	// disconnected. Zero never disconnects.
+	MaxViolations   int
+	ViolationWindow time.Duration
+}
+
+func DefaultRateLimits() RateLimits {
+	return RateLimits{
+		MemberMessages:  RateLimit{Rate: 20, Burst: 40},
+		MemberBytes:     RateLimit{Rate: 2 << 20, Burst: 4 << 20},
+		PartyMessages:   RateLimit{Rate: 100, Burst: 200},
+		PartyBytes:      RateLimit{Rate: 8 << 20, Burst: 16 << 20},
+		PerType:         map[MessageType]RateLimit{},
+		MaxViolations:   20,
+		ViolationWindow: time.Minute,
+	}
+}
+
+// newLimiter builds a limiter for limit, or nil if it is unlimited. minBurst
+// raises the burst so that a single event of that size can ever pass.
+func newLimiter(limit RateLimit, minBurst int) *rate.Limiter {
+	if limit.Rate <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(limit.Rate), max(limit.Burst, minBurst, 1))
+}
+
+type bucketCost struct {
+	limiter *rate.Limiter
+	n       int
+}
+
+// reserve takes n tokens from every bucket, or none of them if any bucket
+// would make the caller wait, in which case it returns how long to wait.
+func reserve(now time.Time, costs ...bucketCost) time.Duration {
+	var reservations []*rate.Reservation
+	var wait time.Duration
+	for _, cost := range costs {
+		if cost.limiter == nil {
+			continue
+		}
+		r := cost.limiter.ReserveN(now, cost.n)
+		if !r.OK() {
+			wait = max(wait, time.Second)
+			continue
+		}
+		reservations = append(reservations, r)
+		wait = max(wait, r.DelayFrom(now))
+	}
+	if wait > 0 {
+		for _, r := range reservations {
+			r.CancelAt(now)
+		}
+	}
+	return wait
+}
+
+// partyLimiter holds the buckets shared by every member of a party.
+type partyLimiter struct {
+	messages *rate.Limiter
+	bytes    *rate.Limiter
+}
+
+func newPartyLimiter(cfg config) *partyLimiter {
+	return &partyLimiter{
+		messages: newLimiter(cfg.rateLimits.PartyMessages, 1),
+		bytes:    newLimiter(cfg.rateLimits.PartyBytes, cfg.maxFrameSize()),
+	}
+}
+
+// memberLimiter holds the buckets of a single member and the times of its
+// recent violations.
+type memberLimiter struct {
+	mutex      sync.Mutex
+	limits     RateLimits
+	messages   *rate.Limiter
+	bytes      *rate.Limiter
+	types      map[MessageType]*rate.Limiter
+	violations []time.Time
+}
+
+func newMemberLimiter(cfg config) *memberLimiter {
+	types := map[MessageType]*rate.Limiter{}
+	for msgType, limit := range cfg.rateLimits.PerType {
+		if limiter := newLimiter(limit, 1); limiter != nil {
+			types[msgType] = limiter
+		}
+	}
+	return &memberLimiter{
+		limits:   cfg.rateLimits,
+		messages: newLimiter(cfg.rateLimits.MemberMessages, 1),
+		bytes:    newLimiter(cfg.rateLimits.MemberBytes, cfg.maxFrameSize()),
+		types:    types,
+	}
+}
+
+// allow charges a message of msgType and size bytes to the member's and the
+// party's buckets. It returns nil if the message may be relayed,
+// ErrRateLimited if it must be dropped and ErrRateLimitAbuse once the member
+// has been limited too often and should be disconnected.
+func (m *memberLimiter) allow(party *partyLimiter, msgType MessageType, size int) error {
+	now := time.Now()
+	wait := reserve(now,
+		bucketCost{m.messages, 1},
+		bucketCost{m.bytes, size},
+		bucketCost{m.types[msgType], 1},
+		bucketCost{party.messages, 1},
+		bucketCost{party.bytes, size},
+	)
+	if wait == 0 {
+		return nil
+	}
+
+	if m.limits.MaxViolations > 0 {
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		cutoff := now.Add(-m.limits.ViolationWindow)
+		recent := m.violations[:0]
+		for _, at := range m.violations {
+			if at.After(cutoff) {
+				recent = append(recent, at)
+			}
+		}
+		m.violations = append(recent, now)
+		if len(m.violations) > m.limits.MaxViolations {
+			return ErrRateLimitAbuse
+		}
+	}
+	return ErrRateLimited.WithRetryAfter(wait)
+}
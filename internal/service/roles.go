@@ -0,0 +1,238 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/dino16m/clippa-server/internal/data"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// Role is what a member of a party is allowed to do. Roles are ordered:
+// every role may do what the roles below it may.
+type Role string
+
+const (
+	// RoleReadOnly members receive clipboard items but cannot send them.
+	RoleReadOnly Role = "read-only"
+	RoleMember   Role = "member"
+	// RoleAdmin members may also run leader elections, kick members and
+	// change the roles of members below them.
+	RoleAdmin Role = "admin"
+	// RoleOwner is the role of whoever holds the party secret. Only owners
+	// may manage admins or make other owners.
+	RoleOwner Role = "owner"
+)
+
+var roleRanks = map[Role]int{
+	RoleReadOnly: 0,
+	RoleMember:   1,
+	RoleAdmin:    2,
+	RoleOwner:    3,
+}
+
+// ParseRole returns the role named name.
+func ParseRole(name string) (Role, bool) {
+	role := Role(name)
+	_, ok := roleRanks[role]
+	return role, ok
+}
+
+// AtLeast reports whether r ranks at least as high as other.
+func (r Role) AtLeast(other Role) bool {
+	return roleRanks[r] >= roleRanks[other]
+}
+
+// readOnlyMessageTypes are the messages a read-only member may send: those
+// needed to receive clipboard items.
+var readOnlyMessageTypes = []MessageType{Ping, Pong, Ack, KeyAnnounce, ClipboardMissing}
+
+// adminMessageTypes are the messages that change the party for everyone.
+var adminMessageTypes = []MessageType{SetLeader, Conclave, Kick, SetRole, SetMode}
+
+// permits reports whether a member with role r may send msgType.
+func (r Role) permits(msgType MessageType) bool {
+	switch {
+	case r.AtLeast(RoleAdmin):
+		return true
+	case slices.Contains(adminMessageTypes, msgType):
+		return false
+	case r.AtLeast(RoleMember):
+		return true
+	}
+	return slices.Contains(readOnlyMessageTypes, msgType)
+}
+
+// canManage reports whether r may kick a member with role target, or change
+// its role to role.
+func (r Role) canManage(target, role Role) bool {
+	if r == RoleOwner {
+		return true
+	}
+	return r.AtLeast(RoleAdmin) && !target.AtLeast(r) && r.AtLeast(role)
+}
+
+// Kick asks the server to disconnect a member. Only admins may send it.
+const Kick MessageType = "kick"
+
+// SetRole changes the role of a member. Only admins may send it; the server
+// relays it to the party once applied.
+const SetRole MessageType = "set-role"
+
+type KickData struct {
+	MemberID string `json:"memberId"`
+}
+
+type SetRoleData struct {
+	MemberID string `json:"memberId"`
+	Role     Role   `json:"role"`
+}
+
+func SetRoleMessage(sender, memberId string, role Role) []byte {
+	response := Message[SetRoleData]{
+		Data:        SetRoleData{MemberID: memberId, Role: role},
+		Sender:      sender,
+		MessageType: SetRole,
+		CreatedAt:   time.Now().UTC().Unix(),
+	}
+
+	b, _ := json.Marshal(response)
+	return b
+}
+
+// WithRole sets the role the member's join token was issued with. A role an
+// admin assigned to the member takes precedence when it is lower, or when
+// the member's identity is verified. Members join as RoleMember by default.
+func WithRole(role Role) JoinOption {
+	return func(p *PartyHandle) {
+		p.role = role
+	}
+}
+
+// WithVerifiedIdentity marks the member ID as proven, by a device token or a
+// client certificate, so a role assigned to it applies even above the join
+// token's, and it may supersede its own connection whatever its role. Other
+// members choose their own IDs and could claim anyone's.
+func WithVerifiedIdentity(verified bool) JoinOption {
+	return func(p *PartyHandle) {
+		p.verified = verified
+	}
+}
+
+// Role is the member's current role.
+func (p *PartyHandle) Role() Role {
+	p.partyService.outboxMutex.RLock()
+	defer p.partyService.outboxMutex.RUnlock()
+	return p.role
+}
+
+// assignedRole returns the role an admin assigned to memberId, if any.
+func (p *PartyService) assignedRole(memberId string) (Role, bool) {
+	return storedRole(p.partyStore, p.logger, p.partyId, memberId)
+}
+
+// storedRole returns the role assigned to memberId of partyId, if any.
+func storedRole(store *data.PartyStore, logger *logrus.Entry, partyId, memberId string) (Role, bool) {
+	name, err := store.GetMemberRole(partyId, memberId)
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			logger.WithError(err).WithField("member", memberId).Error("failed to load member role")
+		}
+		return "", false
+	}
+	return ParseRole(name)
+}
+
+// roleOf returns the role of memberId: its connection's if it is connected,
+// else the one assigned to it.
+func (p *PartyService) roleOf(memberId string) Role {
+	p.outboxMutex.RLock()
+	member, ok := p.members[memberId]
+	p.outboxMutex.RUnlock()
+	if ok {
+		return member.Role()
+	}
+	if role, ok := p.assignedRole(memberId); ok {
+		return role
+	}
+	return RoleMember
+}
+
+// kick disconnects memberId on behalf of a member with role actor.
+func (p *PartyService) kick(actor Role, memberId string) error {
+	p.outboxMutex.RLock()
+	_, connected := p.members[memberId]
+	p.outboxMutex.RUnlock()
+	if !connected {
+		return ErrNotFound.WithMessage(fmt.Sprintf("%s is not connected", memberId))
+	}
+	if !actor.canManage(p.roleOf(memberId), RoleReadOnly) {
+		return ErrForbidden.WithMessage(fmt.Sprintf("%s may not kick %s", actor, memberId))
+	}
+	p.disconnect(ReasonKicked, memberId)
+	return nil
+}
+
+// setRole stores role for memberId on behalf of sender, a member with role
+// actor, applies it to its connection and tells the rest of the party.
+func (p *PartyService) setRole(actor Role, sender, memberId string, role Role) error {
+	if !actor.canManage(p.roleOf(memberId), role) {
+		return ErrForbidden.WithMessage(fmt.Sprintf("%s may not make %s %s", actor, memberId, role))
+	}
+	if err := p.partyStore.SetMemberRole(p.partyId, memberId, string(role)); err != nil {
+		p.logger.WithError(err).WithField("member", memberId).Error("failed to store member role")
+		return ErrInternal
+	}
+	p.lock("Setting role")
+	if member, ok := p.members[memberId]; ok {
+		member.role = role
+	}
+	p.unlock("Setting role")
+
+	p.logger.WithField("member", memberId).WithField("role", role).Info("set member role")
+	// older versions do not know the message
+	p.sendMessageTo(sender, p.membersSupporting(SetRole), TextFrame(SetRoleMessage(sender, memberId, role)))
+	return nil
+}
+
+// Kick disconnects memberId from party id on behalf of a client with role
+// actor. It returns ErrNotFound if the member is not connected.
+func (p *PartyServiceProvider) Kick(id string, actor Role, memberId string) error {
+	p.partiesMutex.RLock()
+	party, ok := p.parties[id]
+	p.partiesMutex.RUnlock()
+	if !ok {
+		return ErrNotFound.WithMessage(fmt.Sprintf("%s is not connected", memberId))
+	}
+	return party.kick(actor, memberId)
+}
+
+// SetRole assigns role to memberId in party id on behalf of a client with
+// role actor, whether or not the member is connected.
+func (p *PartyServiceProvider) SetRole(id string, actor Role, memberId string, role Role) error {
+	// held throughout, so no party service starts without the role
+	p.partiesMutex.RLock()
+	defer p.partiesMutex.RUnlock()
+	if party, ok := p.parties[id]; ok {
+		return party.setRole(actor, "", memberId, role)
+	}
+
+	logger := p.logger.WithField("party", id)
+	current, ok := storedRole(p.partyStore, logger, id, memberId)
+	if !ok {
+		current = RoleMember
+	}
+	if !actor.canManage(current, role) {
+		return ErrForbidden.WithMessage(fmt.Sprintf("%s may not make %s %s", actor, memberId, role))
+	}
+	if err := p.partyStore.SetMemberRole(id, memberId, string(role)); err != nil {
+		logger.WithError(err).WithField("member", memberId).Error("failed to store member role")
+		return ErrInternal
+	}
+	logger.WithField("member", memberId).WithField("role", role).Info("set member role")
+	return nil
+}
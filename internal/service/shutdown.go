@@ -0,0 +1,69 @@
+package service
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// ServerShutdown is sent by the server to every member before it shuts down
+// and closes their connections.
+const ServerShutdown MessageType = "server-shutdown"
+
+type ServerShutdownData struct {
+	// ReconnectAfter is how long members should wait before reconnecting,
+	// in milliseconds.
+	ReconnectAfter int64 `json:"reconnectAfter"`
+}
+
+func ServerShutdownMessage(reconnectAfter time.Duration) []byte {
+	response := Message[ServerShutdownData]{
+		Data:        ServerShutdownData{ReconnectAfter: reconnectAfter.Milliseconds()},
+		Sender:      "",
+		MessageType: ServerShutdown,
+		CreatedAt:   time.Now().UTC().Unix(),
+	}
+
+	b, _ := json.Marshal(response)
+	return b
+}
+
+// shutdown tells the members that the server is shutting down and
+// disconnects them once the messages already queued for them.
+func (p *PartyService) shutdown(reconnectAfter time.Duration) {
+	p.outboxMutex.RLock()
+	memberIds := make([]string, 0, len(p.members))
+	current, older := []string{}, []string{}
+	for id, member := range p.members {
+		memberIds = append(memberIds, id)
+		if supportsType(member.version, ServerShutdown) {
+			current = append(current, id)
+		} else {
+			older = append(older, id)
+		}
+	}
+	p.outboxMutex.RUnlock()
+
+	p.sendMessageTo("", current, TextFrame(ServerShutdownMessage(reconnectAfter)))
+	// Older versions don't know server-shutdown, so they are told with an
+	// error carrying the same delay instead.
+	p.sendMessageTo("", older, TextFrame(ErrorMessageFor(ErrShuttingDown.WithRetryAfter(reconnectAfter))))
+	p.disconnect(ReasonServerShutdown, memberIds...)
+}
+
+// Shutdown stops members from joining, then tells the members of every party
+// to reconnect after reconnectAfter and disconnects them with
+// ReasonServerShutdown. Their inboxes are closed after the frames already in
+// them, so connections can drain them before closing.
+func (p *PartyServiceProvider) Shutdown(reconnectAfter time.Duration) {
+	p.partiesMutex.Lock()
+	p.draining = true
+	parties := p.parties
+	p.parties = map[string]*PartyService{}
+	p.partiesMutex.Unlock()
+	p.config.metrics.ActiveParties.Sub(float64(len(parties)))
+
+	p.logger.WithField("parties", len(parties)).Info("shutting down parties")
+	for _, party := range parties {
+		party.shutdown(reconnectAfter)
+	}
+}
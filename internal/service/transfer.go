@@ -0,0 +1,260 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// transfer is a chunked clipboard item. Chunks are relayed as they arrive and
+// kept until the transfer expires so recipients can ask for ones they missed.
+type transfer struct {
+	senderId      string
+	begin         Message[TransferBeginData]
+	chunks        [][]byte
+	received      int
+	receivedBytes int
+	complete      bool
+	updatedAt     time.Time
+}
+
+func validateTransferBegin(data TransferBeginData, cfg config) error {
+	if data.TransferID == "" || len(data.TransferID) > 128 {
+		return errors.New("transfer id must be 1-128 characters")
+	}
+	if data.MimeType == "" {
+		return errors.New("transfer without mime type")
+	}
+	if data.TotalSize <= 0 || data.TotalSize > cfg.maxTransferSize {
+		return errors.New("transfer size out of range")
+	}
+	if data.ChunkSize <= 0 || data.ChunkSize > cfg.maxChunkSize {
+		return errors.New("chunk size out of range")
+	}
+	if data.ChunkCount != (data.TotalSize+data.ChunkSize-1)/data.ChunkSize {
+		return errors.New("chunk count does not match total and chunk size")
+	}
+	if sum, err := hex.DecodeString(data.Checksum); err != nil || len(sum) != sha256.Size {
+		return errors.New("checksum must be a hex sha256")
+	}
+	return nil
+}
+
+// chunkSize is the exact size chunk index must have.
+func (t *transfer) chunkSize(index int) int {
+	info := t.begin.Data
+	if index == info.ChunkCount-1 {
+		return info.TotalSize - info.ChunkSize*(info.ChunkCount-1)
+	}
+	return info.ChunkSize
+}
+
+func (t *transfer) progress() TransferProgressData {
+	return TransferProgressData{
+		TransferID:     t.begin.Data.TransferID,
+		ReceivedChunks: t.received,
+		ChunkCount:     t.begin.Data.ChunkCount,
+		ReceivedBytes:  t.receivedBytes,
+		TotalSize:      t.begin.Data.TotalSize,
+		Complete:       t.complete,
+	}
+}
+
+func (t *transfer) chunkFrame(index int) Frame {
+	header, _ := json.Marshal(Message[TransferChunkData]{
+		Data:        TransferChunkData{TransferID: t.begin.Data.TransferID, Index: index},
+		Sender:      t.senderId,
+		MessageType: ClipboardChunk,
+		CreatedAt:   t.updatedAt.Unix(),
+	})
+	return encodeBinaryFrame(header, t.chunks[index])
+}
+
+func (p *PartyService) beginTransfer(senderId string, begin Message[TransferBeginData]) error {
+	p.transferMutex.Lock()
+	defer p.transferMutex.Unlock()
+	p.pruneTransfers()
+	if _, ok := p.transfers[begin.Data.TransferID]; ok {
+		return ErrTransferExists
+	}
+	if !p.makeRoomForTransfer(senderId) {
+		return ErrTooManyTransfers
+	}
+	p.transfers[begin.Data.TransferID] = &transfer{
+		senderId:  senderId,
+		begin:     begin,
+		chunks:    make([][]byte, begin.Data.ChunkCount),
+		updatedAt: time.Now().UTC(),
+	}
+	p.scheduleTransferSweep()
+	return nil
+}
+
+// makeRoomForTransfer drops the oldest completed transfers while senderId or
+// the party holds as many transfers as allowed, and reports whether another
+// may begin. Transfers in progress are never dropped. The caller must hold
+// transferMutex.
+func (p *PartyService) makeRoomForTransfer(senderId string) bool {
+	perMember, perParty := p.config.maxMemberTransfers, p.config.maxPartyTransfers
+	for {
+		held := 0
+		oldestOwn, oldest := "", ""
+		for id, t := range p.transfers {
+			older := func(other string) bool {
+				return other == "" || t.updatedAt.Before(p.transfers[other].updatedAt)
+			}
+			if t.senderId == senderId {
+				held++
+				if t.complete && older(oldestOwn) {
+					oldestOwn = id
+				}
+			}
+			if t.complete && older(oldest) {
+				oldest = id
+			}
+		}
+		switch {
+		case perMember > 0 && held >= perMember:
+			if oldestOwn == "" {
+				return false
+			}
+			delete(p.transfers, oldestOwn)
+		case perParty > 0 && len(p.transfers) >= perParty:
+			if oldest == "" {
+				return false
+			}
+			delete(p.transfers, oldest)
+		default:
+			return true
+		}
+	}
+}
+
+// addChunk stores a chunk sent by the transfer's sender and returns the
+// transfer's progress.
+func (p *PartyService) addChunk(senderId string, chunk Message[TransferChunkData], payload []byte) (TransferProgressData, error) {
+	p.transferMutex.Lock()
+	defer p.transferMutex.Unlock()
+	t, ok := p.transfers[chunk.Data.TransferID]
+	if !ok || t.senderId != senderId {
+		return TransferProgressData{}, ErrUnknownTransfer
+	}
+	index := chunk.Data.Index
+	if t.complete || index < 0 || index >= len(t.chunks) || len(payload) != t.chunkSize(index) {
+		return TransferProgressData{}, ErrInvalidChunk
+	}
+	if chunk.Data.Checksum != "" {
+		sum := sha256.Sum256(payload)
+		if hex.EncodeToString(sum[:]) != chunk.Data.Checksum {
+			return TransferProgressData{}, ErrChecksumMismatch
+		}
+	}
+	if t.chunks[index] == nil {
+		t.received++
+		t.receivedBytes += len(payload)
+	}
+	t.chunks[index] = append([]byte(nil), payload...)
+	t.updatedAt = time.Now().UTC()
+	return t.progress(), nil
+}
+
+// endTransfer verifies that every chunk arrived and that the reassembled
+// item matches the announced checksum. A transfer failing the checksum is
+// discarded.
+func (p *PartyService) endTransfer(senderId, transferId string) (TransferProgressData, error) {
+	p.transferMutex.Lock()
+	defer p.transferMutex.Unlock()
+	t, ok := p.transfers[transferId]
+	if !ok || t.senderId != senderId {
+		return TransferProgressData{}, ErrUnknownTransfer
+	}
+	if t.received != len(t.chunks) {
+		return t.progress(), ErrTransferPartial
+	}
+	hash := sha256.New()
+	for _, chunk := range t.chunks {
+		hash.Write(chunk)
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != t.begin.Data.Checksum {
+		delete(p.transfers, transferId)
+		return TransferProgressData{}, ErrChecksumMismatch
+	}
+	t.complete = true
+	t.updatedAt = time.Now().UTC()
+	return t.progress(), nil
+}
+
+// missingChunks returns the frames needed to replay a transfer to a member:
+// its begin message, the requested chunks the server holds and, once the
+// transfer is complete, its end message.
+func (p *PartyService) missingChunks(transferId string, indexes []int) ([]Frame, error) {
+	p.transferMutex.Lock()
+	defer p.transferMutex.Unlock()
+	t, ok := p.transfers[transferId]
+	if !ok {
+		return nil, ErrUnknownTransfer
+	}
+	if len(indexes) == 0 {
+		for i := range t.chunks {
+			indexes = append(indexes, i)
+		}
+	}
+
+	begin, _ := json.Marshal(t.begin)
+	frames := []Frame{TextFrame(begin)}
+	for _, index := range indexes {
+		if index < 0 || index >= len(t.chunks) || t.chunks[index] == nil {
+			continue
+		}
+		frames = append(frames, t.chunkFrame(index))
+	}
+	if t.complete {
+		end, _ := json.Marshal(Message[TransferEndData]{
+			Data:        TransferEndData{TransferID: transferId},
+			Sender:      t.senderId,
+			MessageType: ClipboardEnd,
+			CreatedAt:   t.updatedAt.Unix(),
+		})
+		frames = append(frames, TextFrame(end))
+	}
+	return frames, nil
+}
+
+// pruneTransfers drops transfers idle for longer than the retention period.
+// The caller must hold transferMutex.
+func (p *PartyService) pruneTransfers() {
+	for id, t := range p.transfers {
+		if time.Since(t.updatedAt) > p.config.transferRetention {
+			delete(p.transfers, id)
+		}
+	}
+}
+
+// scheduleTransferSweep arms a timer pruning the transfers once the retention
+// period passes, unless one is armed or there is nothing to prune. The caller
+// must hold transferMutex.
+func (p *PartyService) scheduleTransferSweep() {
+	if p.transferSweep != nil || len(p.transfers) == 0 {
+		return
+	}
+	p.transferSweep = time.AfterFunc(p.config.transferRetention, func() {
+		p.transferMutex.Lock()
+		defer p.transferMutex.Unlock()
+		p.transferSweep = nil
+		p.pruneTransfers()
+		p.scheduleTransferSweep()
+	})
+}
+
+// dropTransfers drops the transfers sent by a member that left.
+func (p *PartyService) dropTransfers(senderId string) {
+	p.transferMutex.Lock()
+	defer p.transferMutex.Unlock()
+	for id, t := range p.transfers {
+		if t.senderId == senderId {
+			delete(p.transfers, id)
+		}
+	}
+}
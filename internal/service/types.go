@@ -5,6 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"time"
+
+	"github.com/dino16m/clippa-server/pkg/e2ee"
 )
 
 type MessageType string
@@ -22,16 +24,32 @@ const (
 	Joined            MessageType = "joined"
 	Left              MessageType = "left"
 	Error             MessageType = "error"
+	Ack               MessageType = "ack"
+	DeliveryReport    MessageType = "delivery-report"
+	ClipboardBegin    MessageType = "clipboard-begin"
+	ClipboardChunk    MessageType = "clipboard-chunk"
+	ClipboardEnd      MessageType = "clipboard-end"
+	ClipboardProgress MessageType = "clipboard-progress"
+	ClipboardMissing  MessageType = "clipboard-missing"
+	Encrypted         MessageType = "encrypted"
+	KeyAnnounce       MessageType = "key-announce"
 )
 
-var (
-	ErrInvalidMessage = errors.New("INVALID_MESSAGE")
-	ErrLeaderNotSet   = errors.New("LEADER_NOT_SET")
-)
+// electionOutcomes are the messages with which members report how a leader
+// election ended.
+var electionOutcomes = []MessageType{LeaderElected, Inconclusive, LeaderUnreachable}
 
 type UnitData struct{}
+
+// ErrorData reports a ProtocolError. Error repeats Code for older clients.
 type ErrorData struct {
-	Error string `json:"error"`
+	Error     string `json:"error"`
+	Code      string `json:"code,omitempty"`
+	Message   string `json:"message,omitempty"`
+	Retryable bool   `json:"retryable,omitempty"`
+	MessageID string `json:"messageId,omitempty"`
+	// RetryAfter is how many milliseconds to wait before retrying.
+	RetryAfter int64 `json:"retryAfter,omitempty"`
 }
 
 type InconclusiveData struct {
@@ -59,30 +77,99 @@ type SetLeaderData struct {
 	Generation string `json:"generation"`
 }
 
+// ClipboardData carries either a single text Content, typed by MimeType
+// (text/plain when empty), or one or more Representations of the same
+// clipboard item. Binary representations have no inline content; their bytes
+// follow the JSON header of a binary websocket frame. Blob representations
+// reference an item uploaded to the party's blob store instead.
 type ClipboardData struct {
-	Content string `json:"content"`
+	Content         string                    `json:"content"`
+	MimeType        string                    `json:"mimeType,omitempty"`
+	Representations []ClipboardRepresentation `json:"representations,omitempty"`
+}
+
+type ClipboardRepresentation struct {
+	MimeType string `json:"mimeType"`
+	Content  string `json:"content,omitempty"`
+	Binary   bool   `json:"binary,omitempty"`
+	Size     int    `json:"size,omitempty"`
+	BlobID   string `json:"blobId,omitempty"`
+	URL      string `json:"url,omitempty"`
+}
+
+type AckData struct {
+	MessageID string `json:"messageId"`
+}
+
+// DeliveryReportData tells the sender of a message how many of the members
+// it was relayed to have acknowledged it. A report with Final set is the last
+// one the sender will receive for that message; any members that had not
+// acknowledged by then are listed in Undelivered.
+type DeliveryReportData struct {
+	MessageID   string   `json:"messageId"`
+	Delivered   int      `json:"delivered"`
+	Total       int      `json:"total"`
+	DeliveredTo []string `json:"deliveredTo"`
+	Undelivered []string `json:"undelivered,omitempty"`
+	Final       bool     `json:"final"`
+}
+
+// TransferBeginData announces a chunked clipboard transfer. Checksum is the
+// hex SHA-256 of the whole item; ChunkCount chunks of ChunkSize bytes (the
+// last one possibly shorter) follow as binary clipboard-chunk frames.
+type TransferBeginData struct {
+	TransferID string `json:"transferId"`
+	MimeType   string `json:"mimeType"`
+	TotalSize  int    `json:"totalSize"`
+	ChunkSize  int    `json:"chunkSize"`
+	ChunkCount int    `json:"chunkCount"`
+	Checksum   string `json:"checksum"`
+}
+
+// TransferChunkData is the header of a binary clipboard-chunk frame. Checksum
+// is the optional hex SHA-256 of the chunk.
+type TransferChunkData struct {
+	TransferID string `json:"transferId"`
+	Index      int    `json:"index"`
+	Checksum   string `json:"checksum,omitempty"`
+}
+
+type TransferEndData struct {
+	TransferID string `json:"transferId"`
+}
+
+type TransferProgressData struct {
+	TransferID     string `json:"transferId"`
+	ReceivedChunks int    `json:"receivedChunks"`
+	ChunkCount     int    `json:"chunkCount"`
+	ReceivedBytes  int    `json:"receivedBytes"`
+	TotalSize      int    `json:"totalSize"`
+	Complete       bool   `json:"complete"`
 }
 
+// TransferMissingData asks the server to resend chunks of a transfer, e.g.
+// after reconnecting mid-transfer. An empty Indexes resends every chunk the
+// server holds.
+type TransferMissingData struct {
+	TransferID string `json:"transferId"`
+	Indexes    []int  `json:"indexes,omitempty"`
+}
+
+// EncryptedData is an end-to-end encrypted clipboard item. The server checks
+// its shape and relays it to the listed recipients only; see package e2ee.
+type EncryptedData = e2ee.Envelope
+
+// KeyAnnounceData publishes a member's public key to the party.
+type KeyAnnounceData = e2ee.Announcement
+
 type Message[T any] struct {
+	ID          string      `json:"id,omitempty"`
 	Data        T           `json:"data"`
 	Sender      string      `json:"sender"`
 	MessageType MessageType `json:"messageType"`
 	CreatedAt   int64       `json:"createdAt"`
 }
 
-func ErrorMessage(msg string) []byte {
-
-	response := Message[ErrorData]{
-		Data:        ErrorData{Error: msg},
-		Sender:      "",
-		MessageType: Error,
-		CreatedAt:   time.Now().UTC().Unix(),
-	}
-
-	b, _ := json.Marshal(response)
-	return b
-}
-
 func JoinedMessage(sender string) []byte {
 	response := Message[UnitData]{
 		Data:        UnitData{},
@@ -107,13 +194,28 @@ func LeftMessage(sender string) []byte {
 	return b
 }
 
-func getMessageType(raw []byte) (MessageType, error) {
-	var msg Message[any]
-	err := json.Unmarshal(raw, &msg)
-	if err != nil {
-		return "", err
+func DeliveryReportMessage(report DeliveryReportData) []byte {
+	response := Message[DeliveryReportData]{
+		Data:        report,
+		Sender:      "",
+		MessageType: DeliveryReport,
+		CreatedAt:   time.Now().UTC().Unix(),
 	}
-	return MessageType(msg.MessageType), nil
+
+	b, _ := json.Marshal(response)
+	return b
+}
+
+func TransferProgressMessage(progress TransferProgressData) []byte {
+	response := Message[TransferProgressData]{
+		Data:        progress,
+		Sender:      "",
+		MessageType: ClipboardProgress,
+		CreatedAt:   time.Now().UTC().Unix(),
+	}
+
+	b, _ := json.Marshal(response)
+	return b
 }
 
 func parseMessage[T any](raw []byte) (Message[T], error) {
@@ -125,22 +227,168 @@ func parseMessage[T any](raw []byte) (Message[T], error) {
 	return msg, nil
 }
 
-func validateMessage(msgType MessageType, raw []byte) (any, error) {
+// RawData is the data of a message received from a member, still in the
+// encoding it arrived in. It is decoded once, into the type its message type
+// calls for.
+type RawData interface {
+	// Decode unmarshals the data into dst.
+	Decode(dst any) error
+	// JSON renders the data in the canonical form relayed to the party.
+	JSON() (json.RawMessage, error)
+}
+
+// jsonData is message data received as JSON, relayed as it was sent.
+type jsonData json.RawMessage
+
+// emptyData stands in for absent or null data.
+var emptyData = jsonData("{}")
+
+func (d jsonData) Decode(dst any) error {
+	return json.Unmarshal(d, dst)
+}
+
+func (d jsonData) JSON() (json.RawMessage, error) {
+	return json.RawMessage(d), nil
+}
+
+// parseRawMessage parses a JSON message, leaving its data to be decoded once
+// its type is known.
+func parseRawMessage(raw []byte) (Message[RawData], error) {
+	message, err := parseMessage[json.RawMessage](raw)
+	if err != nil {
+		return Message[RawData]{}, err
+	}
+	var data RawData = jsonData(message.Data)
+	if len(message.Data) == 0 || string(message.Data) == "null" {
+		data = emptyData
+	}
+	return Message[RawData]{
+		ID:          message.ID,
+		Data:        data,
+		Sender:      message.Sender,
+		MessageType: message.MessageType,
+		CreatedAt:   message.CreatedAt,
+	}, nil
+}
+
+// parseData decodes the data of message as T.
+func parseData[T any](message Message[RawData]) (Message[T], error) {
+	parsed := Message[T]{
+		ID:          message.ID,
+		Sender:      message.Sender,
+		MessageType: message.MessageType,
+		CreatedAt:   message.CreatedAt,
+	}
+	if err := message.Data.Decode(&parsed.Data); err != nil {
+		return Message[T]{}, err
+	}
+	return parsed, nil
+}
+
+// validateMessage decodes the data of raw according to its type in the given
+// protocol version. payloadSize is the number of binary bytes that
+// accompanied raw in a binary frame. Fields a version does not know are
+// ignored.
+func validateMessage(version int, raw Message[RawData], payloadSize int, cfg config) (any, error) {
+	msgType := raw.MessageType
+	if !supportsType(version, msgType) {
+		return nil, ErrUnsupportedType.WithMessage(fmt.Sprintf("message type %q is not part of protocol version %d", msgType, version))
+	}
+	if payloadSize > 0 && msgType != Clipboard && msgType != ClipboardChunk {
+		return nil, fmt.Errorf("message type %s cannot carry a binary payload", msgType)
+	}
+
 	switch msgType {
 	case Conclave:
-		return parseMessage[ConclaveData](raw)
+		return parseData[ConclaveData](raw)
 	case Inconclusive:
-		return parseMessage[InconclusiveData](raw)
+		return parseData[InconclusiveData](raw)
 	case Vote:
-		return parseMessage[VoteData](raw)
+		return parseData[VoteData](raw)
 	case Ping, Pong, Joined, Left, LeaderUnreachable:
-		return parseMessage[UnitData](raw)
+		return parseData[UnitData](raw)
 	case SetLeader, LeaderElected:
-		return parseMessage[SetLeaderData](raw)
+		return parseData[SetLeaderData](raw)
 	case Clipboard:
-		return parseMessage[ClipboardData](raw)
+		msg, err := parseData[ClipboardData](raw)
+		if err != nil {
+			return nil, err
+		}
+		if err := validateClipboard(msg.Data, payloadSize, cfg.sizeLimits); err != nil {
+			return nil, err
+		}
+		return msg, nil
 	case Error:
-		return parseMessage[ErrorData](raw)
+		return parseData[ErrorData](raw)
+	case Kick:
+		msg, err := parseData[KickData](raw)
+		if err != nil {
+			return nil, err
+		}
+		if msg.Data.MemberID == "" {
+			return nil, errors.New("kick without member id")
+		}
+		return msg, nil
+	case SetMode:
+		msg, err := parseData[SetModeData](raw)
+		if err != nil {
+			return nil, err
+		}
+		if mode, ok := ParseMode(string(msg.Data.Mode)); !ok || mode != msg.Data.Mode || msg.Data.MemberID == "" {
+			return nil, errors.New("set-mode without member id or with an unknown mode")
+		}
+		return msg, nil
+	case SetRole:
+		msg, err := parseData[SetRoleData](raw)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := ParseRole(string(msg.Data.Role)); !ok || msg.Data.MemberID == "" {
+			return nil, errors.New("set-role without member id or with an unknown role")
+		}
+		return msg, nil
+	case Ack:
+		return parseData[AckData](raw)
+	case ClipboardBegin:
+		msg, err := parseData[TransferBeginData](raw)
+		if err != nil {
+			return nil, err
+		}
+		if err := validateTransferBegin(msg.Data, cfg); err != nil {
+			return nil, err
+		}
+		return msg, nil
+	case ClipboardChunk:
+		msg, err := parseData[TransferChunkData](raw)
+		if err != nil {
+			return nil, err
+		}
+		if msg.Data.TransferID == "" || payloadSize == 0 {
+			return nil, errors.New("chunk without transfer id or payload")
+		}
+		return msg, nil
+	case ClipboardEnd:
+		return parseData[TransferEndData](raw)
+	case ClipboardMissing:
+		return parseData[TransferMissingData](raw)
+	case Encrypted:
+		msg, err := parseData[EncryptedData](raw)
+		if err != nil {
+			return nil, err
+		}
+		if err := validateEnvelope(msg.Data, cfg); err != nil {
+			return nil, err
+		}
+		return msg, nil
+	case KeyAnnounce:
+		msg, err := parseData[KeyAnnounceData](raw)
+		if err != nil {
+			return nil, err
+		}
+		if err := validateAnnouncement(msg.Data); err != nil {
+			return nil, err
+		}
+		return msg, nil
 	default:
 		return nil, fmt.Errorf("unknown message type: %s", msgType)
 	}
@@ -0,0 +1,84 @@
+package service
+
+import (
+	"encoding/json"
+	"slices"
+	"time"
+)
+
+// Protocol versions. Version 1 is the protocol spoken by clients that do not
+// negotiate a version; version 2 adds the welcome message and version 3 the
+// admin messages kick, set-role and set-mode, and the server-shutdown notice.
+const (
+	ProtocolV1 = 1
+	ProtocolV2 = 2
+	ProtocolV3 = 3
+
+	LatestProtocolVersion = ProtocolV3
+)
+
+// Welcome is sent by the server to a member that negotiated version 2 or
+// later, as the first message after it joins.
+const Welcome MessageType = "welcome"
+
+// v1MessageTypes are the message types of the first protocol version.
+var v1MessageTypes = []MessageType{
+	Conclave, Inconclusive, Ping, Pong, Vote, SetLeader, LeaderElected,
+	LeaderUnreachable, Clipboard, Joined, Left, Error, Ack, DeliveryReport,
+	ClipboardBegin, ClipboardChunk, ClipboardEnd, ClipboardProgress,
+	ClipboardMissing, Encrypted, KeyAnnounce,
+}
+
+// protocolVersions lists the message types each supported version knows.
+var protocolVersions = map[int][]MessageType{
+	ProtocolV1: v1MessageTypes,
+	ProtocolV2: append(slices.Clone(v1MessageTypes), Welcome),
+	ProtocolV3: append(slices.Clone(v1MessageTypes), Welcome, Kick, SetRole, SetMode, ServerShutdown),
+}
+
+// SupportedVersions returns the protocol versions the server speaks, newest
+// first.
+func SupportedVersions() []int {
+	versions := make([]int, 0, len(protocolVersions))
+	for version := range protocolVersions {
+		versions = append(versions, version)
+	}
+	slices.Sort(versions)
+	slices.Reverse(versions)
+	return versions
+}
+
+// IsSupportedVersion reports whether the server speaks version.
+func IsSupportedVersion(version int) bool {
+	_, ok := protocolVersions[version]
+	return ok
+}
+
+// supportsType reports whether msgType is part of version.
+func supportsType(version int, msgType MessageType) bool {
+	return slices.Contains(protocolVersions[version], msgType)
+}
+
+type WelcomeData struct {
+	MemberID     string        `json:"memberId"`
+	Version      int           `json:"version"`
+	Versions     []int         `json:"versions"`
+	MessageTypes []MessageType `json:"messageTypes"`
+}
+
+func WelcomeMessage(memberId string, version int) []byte {
+	response := Message[WelcomeData]{
+		Data: WelcomeData{
+			MemberID:     memberId,
+			Version:      version,
+			Versions:     SupportedVersions(),
+			MessageTypes: protocolVersions[version],
+		},
+		Sender:      "",
+		MessageType: Welcome,
+		CreatedAt:   time.Now().UTC().Unix(),
+	}
+
+	b, _ := json.Marshal(response)
+	return b
+}
@@ -0,0 +1,157 @@
+// Package e2ee seals clipboard content for a set of party members so that the
+// server relaying it cannot read it.
+//
+// Content is encrypted once with a random key using NaCl secretbox, and that
+// key is wrapped for every recipient with NaCl box between the sender's and
+// the recipient's X25519 keys. Members publish their public keys to the
+// party with an Announcement.
+package e2ee
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Algorithm names the scheme used by this package in announcements.
+const Algorithm = "x25519-xsalsa20-poly1305"
+
+var (
+	ErrNotRecipient = errors.New("e2ee: envelope is not addressed to this member")
+	ErrDecrypt      = errors.New("e2ee: message authentication failed")
+	ErrInvalidKey   = errors.New("e2ee: invalid public key")
+)
+
+// Envelope is the data of an "encrypted" party message.
+type Envelope struct {
+	// KeyID identifies the sender key the content keys were wrapped with.
+	KeyID      string         `json:"keyId"`
+	Nonce      []byte         `json:"nonce"`
+	Ciphertext []byte         `json:"ciphertext"`
+	Recipients []RecipientKey `json:"recipients"`
+}
+
+// RecipientKey is the content key wrapped for one member.
+type RecipientKey struct {
+	MemberID   string `json:"memberId"`
+	KeyID      string `json:"keyId"`
+	WrappedKey []byte `json:"wrappedKey"`
+}
+
+// Announcement is the data of a "key-announce" party message publishing a
+// member's public key.
+type Announcement struct {
+	KeyID     string `json:"keyId"`
+	Algorithm string `json:"algorithm"`
+	PublicKey []byte `json:"publicKey"`
+}
+
+// KeyPair is a member's X25519 key pair.
+type KeyPair struct {
+	ID         string
+	PublicKey  *[32]byte
+	PrivateKey *[32]byte
+}
+
+// Recipient is a member to seal content for, as learned from its
+// announcement.
+type Recipient struct {
+	MemberID  string
+	KeyID     string
+	PublicKey *[32]byte
+}
+
+func GenerateKeyPair() (*KeyPair, error) {
+	public, private, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyPair{ID: KeyID(public), PublicKey: public, PrivateKey: private}, nil
+}
+
+// KeyID derives a short identifier for a public key.
+func KeyID(publicKey *[32]byte) string {
+	sum := sha256.Sum256(publicKey[:])
+	return hex.EncodeToString(sum[:8])
+}
+
+// Announce returns the announcement publishing kp's public key.
+func (kp *KeyPair) Announce() Announcement {
+	return Announcement{KeyID: kp.ID, Algorithm: Algorithm, PublicKey: kp.PublicKey[:]}
+}
+
+// RecipientFromAnnouncement turns a member's announcement into a Recipient.
+func RecipientFromAnnouncement(memberId string, a Announcement) (Recipient, error) {
+	if a.Algorithm != Algorithm || len(a.PublicKey) != 32 {
+		return Recipient{}, ErrInvalidKey
+	}
+	var publicKey [32]byte
+	copy(publicKey[:], a.PublicKey)
+	if a.KeyID != KeyID(&publicKey) {
+		return Recipient{}, ErrInvalidKey
+	}
+	return Recipient{MemberID: memberId, KeyID: a.KeyID, PublicKey: &publicKey}, nil
+}
+
+// Seal encrypts plaintext from sender to every recipient.
+func Seal(sender *KeyPair, plaintext []byte, recipients []Recipient) (*Envelope, error) {
+	if len(recipients) == 0 {
+		return nil, errors.New("e2ee: no recipients")
+	}
+	var nonce [24]byte
+	var key [32]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(key[:]); err != nil {
+		return nil, err
+	}
+
+	env := &Envelope{
+		KeyID:      sender.ID,
+		Nonce:      nonce[:],
+		Ciphertext: secretbox.Seal(nil, plaintext, &nonce, &key),
+	}
+	// the nonce is shared safely: each box uses a distinct shared key and the
+	// content key is never reused
+	for _, r := range recipients {
+		env.Recipients = append(env.Recipients, RecipientKey{
+			MemberID:   r.MemberID,
+			KeyID:      r.KeyID,
+			WrappedKey: box.Seal(nil, key[:], &nonce, r.PublicKey, sender.PrivateKey),
+		})
+	}
+	return env, nil
+}
+
+// Open decrypts an envelope addressed to memberId with kp, checking that it
+// was sealed by the holder of senderPublicKey.
+func Open(env *Envelope, memberId string, kp *KeyPair, senderPublicKey *[32]byte) ([]byte, error) {
+	if len(env.Nonce) != 24 {
+		return nil, ErrDecrypt
+	}
+	var nonce [24]byte
+	copy(nonce[:], env.Nonce)
+
+	for _, r := range env.Recipients {
+		if r.MemberID != memberId || r.KeyID != kp.ID {
+			continue
+		}
+		rawKey, ok := box.Open(nil, r.WrappedKey, &nonce, senderPublicKey, kp.PrivateKey)
+		if !ok || len(rawKey) != 32 {
+			return nil, ErrDecrypt
+		}
+		var key [32]byte
+		copy(key[:], rawKey)
+		plaintext, ok := secretbox.Open(nil, env.Ciphertext, &nonce, &key)
+		if !ok {
+			return nil, ErrDecrypt
+		}
+		return plaintext, nil
+	}
+	return nil, ErrNotRecipient
+}
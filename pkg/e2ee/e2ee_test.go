@@ -0,0 +1,39 @@
+package e2ee_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/dino16m/clippa-server/pkg/e2ee"
+)
+
+func TestSealOpenRoundTrip(t *testing.T) {
+	alice, _ := e2ee.GenerateKeyPair()
+	bob, _ := e2ee.GenerateKeyPair()
+	carol, _ := e2ee.GenerateKeyPair()
+
+	recipient, err := e2ee.RecipientFromAnnouncement("bob", bob.Announce())
+	if err != nil {
+		t.Fatalf("recipient from announcement: %v", err)
+	}
+	env, err := e2ee.Seal(alice, []byte("top secret clip"), []e2ee.Recipient{recipient})
+	if err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+
+	plaintext, err := e2ee.Open(env, "bob", bob, alice.PublicKey)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if string(plaintext) != "top secret clip" {
+		t.Fatalf("unexpected plaintext %q", plaintext)
+	}
+
+	if _, err := e2ee.Open(env, "carol", carol, alice.PublicKey); !errors.Is(err, e2ee.ErrNotRecipient) {
+		t.Fatalf("expected ErrNotRecipient for carol, got %v", err)
+	}
+	// a forged sender key fails authentication
+	if _, err := e2ee.Open(env, "bob", bob, carol.PublicKey); !errors.Is(err, e2ee.ErrDecrypt) {
+		t.Fatalf("expected ErrDecrypt with the wrong sender key, got %v", err)
+	}
+}